@@ -0,0 +1,661 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a first-class versioned HTTP API, authenticated with the same credentials
+// as the lndhub interface (a base64 of "<id>:<password>" as a Bearer token).
+func startAPI() {
+	http.HandleFunc("/api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Replace(openAPISpec, "{{SERVICE_URL}}", s.ServiceURL, -1)))
+	})
+
+	http.HandleFunc("/api/v1/balance", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "GET")
+		if !ok {
+			return
+		}
+
+		info, err := user.getInfo()
+		if err != nil {
+			log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to get info")
+			apiError(w, 500, "internal", "Failed to fetch balance.")
+			return
+		}
+
+		apiJSON(w, 200, APIBalance{
+			Balance:       info.Balance,
+			TotalReceived: info.TotalReceived,
+			TotalSent:     info.TotalSent,
+			TotalFees:     info.TotalFees,
+		})
+	})
+
+	http.HandleFunc("/api/v1/transactions", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "GET")
+		if !ok {
+			return
+		}
+
+		var inOrOut InOut
+		switch r.URL.Query().Get("direction") {
+		case "in":
+			inOrOut = In
+		case "out":
+			inOrOut = Out
+		case "", "both":
+			inOrOut = Both
+		default:
+			apiError(w, 400, "invalid_params", "direction must be one of 'in', 'out' or 'both'.")
+			return
+		}
+
+		limit, ok := apiLimit(w, r)
+		if !ok {
+			return
+		}
+
+		before, beforeHash, err := decodeCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			apiError(w, 400, "invalid_params", "Invalid cursor.")
+			return
+		}
+
+		txns, err := user.listTransactionsBefore(before, beforeHash, limit, 1000, inOrOut)
+		if err != nil {
+			log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to list transactions")
+			apiError(w, 500, "internal", "Failed to list transactions.")
+			return
+		}
+
+		page := APITransactionPage{Transactions: make([]APITransaction, len(txns))}
+		for i, txn := range txns {
+			page.Transactions[i] = apiTransaction(txn)
+		}
+		if len(txns) == limit {
+			last := txns[len(txns)-1]
+			page.NextCursor = encodeCursor(last.Time, last.Hash)
+		}
+
+		apiJSON(w, 200, page)
+	})
+
+	http.HandleFunc("/api/v1/invoices", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "GET", "POST")
+		if !ok {
+			return
+		}
+
+		if r.Method == "GET" {
+			limit, ok := apiLimit(w, r)
+			if !ok {
+				return
+			}
+
+			before, beforeHash, err := decodeCursor(r.URL.Query().Get("cursor"))
+			if err != nil {
+				apiError(w, 400, "invalid_params", "Invalid cursor.")
+				return
+			}
+
+			invoices, err := user.listInvoicesBefore(before, beforeHash, limit)
+			if err != nil {
+				log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to list invoices")
+				apiError(w, 500, "internal", "Failed to list invoices.")
+				return
+			}
+
+			page := APIInvoicePage{Invoices: make([]APIInvoice, len(invoices))}
+			for i, inv := range invoices {
+				page.Invoices[i] = apiInvoice(inv)
+			}
+			if len(invoices) == limit {
+				last := invoices[len(invoices)-1]
+				page.NextCursor = encodeCursor(last.CreatedAt, last.Hash)
+			}
+
+			apiJSON(w, 200, page)
+			return
+		}
+
+		var params struct {
+			Amount      *int   `json:"amount"`
+			Description string `json:"description"`
+			Expiry      int    `json:"expiry"`
+		}
+		if !apiDecode(w, r, &params) {
+			return
+		}
+
+		sats := INVOICE_UNDEFINED_AMOUNT
+		if params.Amount != nil {
+			if *params.Amount <= 0 {
+				apiError(w, 400, "invalid_params", "amount must be a positive number of satoshis.")
+				return
+			}
+			sats = *params.Amount
+		}
+
+		var expiry *time.Duration
+		if params.Expiry > 0 {
+			exp := time.Second * time.Duration(params.Expiry)
+			expiry = &exp
+		}
+
+		bolt11, hash, _, err := user.makeInvoice(sats, params.Description, "", expiry, nil, "", true)
+		if err != nil {
+			log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to make invoice")
+			apiError(w, 500, "invoice_failed", messageFromError(err, "Failed to generate invoice"))
+			return
+		}
+
+		exp := s.InvoiceTimeout
+		if expiry != nil {
+			exp = *expiry
+		}
+
+		inv := APIInvoice{
+			PaymentHash:    hash,
+			PaymentRequest: bolt11,
+			Description:    params.Description,
+			Status:         "unpaid",
+			CreatedAt:      time.Now().Unix(),
+			ExpiresAt:      time.Now().Add(exp).Unix(),
+		}
+		if params.Amount != nil {
+			inv.Amount = params.Amount
+		}
+
+		apiJSON(w, 201, inv)
+	})
+
+	http.HandleFunc("/api/v1/payments", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "POST")
+		if !ok {
+			return
+		}
+
+		var params struct {
+			Invoice string `json:"invoice"`
+			Amount  int    `json:"amount"`
+		}
+		if !apiDecode(w, r, &params) {
+			return
+		}
+		if params.Invoice == "" {
+			apiError(w, 400, "invalid_params", "invoice is required.")
+			return
+		}
+
+		decoded, err := decodeInvoiceAsLndHub(params.Invoice)
+		if err != nil {
+			apiError(w, 400, "invalid_invoice", messageFromError(err, "Failed to decode invoice"))
+			return
+		}
+
+		err = user.payInvoice(0, params.Invoice, params.Amount*1000)
+		if err != nil {
+			apiError(w, 400, "payment_failed", err.Error())
+			return
+		}
+
+		apiJSON(w, 202, APIPayment{
+			PaymentHash: decoded.PaymentHash,
+			Status:      "pending",
+		})
+	})
+
+	http.HandleFunc("/api/v1/sends", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "POST")
+		if !ok {
+			return
+		}
+
+		var params struct {
+			Username  string `json:"username"`
+			Amount    int    `json:"amount"`
+			Anonymous bool   `json:"anonymous"`
+		}
+		if !apiDecode(w, r, &params) {
+			return
+		}
+
+		username := strings.TrimPrefix(strings.TrimSpace(params.Username), "@")
+		if username == "" {
+			apiError(w, 400, "invalid_params", "username is required.")
+			return
+		}
+		if params.Amount <= 0 {
+			apiError(w, 400, "invalid_params", "amount must be a positive number of satoshis.")
+			return
+		}
+
+		receiver, err := ensureUsername(username)
+		if err != nil {
+			log.Warn().Err(err).Str("username", username).Msg("api: failed to ensure receiver")
+			apiError(w, 500, "internal", "Failed to save receiver.")
+			return
+		}
+
+		errMsg, err := user.sendInternally(0, 0, receiver, params.Anonymous, params.Amount*1000, nil, nil)
+		if err != nil {
+			log.Warn().Err(err).Int("from", user.Id).Str("to", username).Msg("api: failed to send")
+			apiError(w, 400, "send_failed", errMsg)
+			return
+		}
+
+		if params.Anonymous {
+			receiver.notify(fmt.Sprintf("Someone has sent you %d sat.", params.Amount))
+		} else {
+			receiver.notify(fmt.Sprintf("%s has sent you %d sat.", user.AtName(), params.Amount))
+		}
+
+		apiJSON(w, 201, APISend{
+			Receiver:  receiver.AtName(),
+			Amount:    params.Amount,
+			Anonymous: params.Anonymous,
+		})
+	})
+
+	http.HandleFunc("/api/v1/hidden", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "POST")
+		if !ok {
+			return
+		}
+
+		var params struct {
+			Amount  int    `json:"amount"`
+			Content string `json:"content"`
+			Preview string `json:"preview"`
+		}
+		if !apiDecode(w, r, &params) {
+			return
+		}
+		if params.Amount <= 0 {
+			apiError(w, 400, "invalid_params", "amount must be a positive number of satoshis.")
+			return
+		}
+		if params.Content == "" {
+			apiError(w, 400, "invalid_params", "content is required.")
+			return
+		}
+
+		content := params.Content
+		if params.Preview != "" {
+			content = params.Preview + "~" + content
+		}
+
+		hiddenid, err := createHiddenMessage(user, params.Amount, content)
+		if err != nil {
+			log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to store hidden message")
+			apiError(w, 500, "internal", "Failed to store hidden content.")
+			return
+		}
+
+		apiJSON(w, 201, APIHiddenMessage{
+			Id:     hiddenid,
+			Amount: params.Amount,
+		})
+	})
+
+	// POST /api/v1/hidden/<id>/reveal
+	http.HandleFunc("/api/v1/hidden/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path[len("/api/v1/hidden/"):], "/"), "/")
+		if len(parts) != 2 || parts[1] != "reveal" {
+			apiError(w, 404, "not_found", "Not found.")
+			return
+		}
+
+		user, ok := apiAuth(w, r, "POST")
+		if !ok {
+			return
+		}
+
+		redisKey, ok := findHiddenMessage(parts[0])
+		if !ok {
+			apiError(w, 404, "not_found", "No hidden message found with the given id.")
+			return
+		}
+
+		_, hiddenid, _, _, satoshis, err := getHiddenMessage(redisKey)
+		if err != nil {
+			apiError(w, 404, "not_found", "No hidden message found with the given id.")
+			return
+		}
+
+		content, errMsg, err := revealHiddenMessage(user, 0, redisKey)
+		if err != nil {
+			log.Warn().Err(err).Str("key", redisKey).Msg("api: failed to reveal hidden message")
+			apiError(w, 400, "reveal_failed", errMsg)
+			return
+		}
+
+		apiJSON(w, 200, APIHiddenMessage{
+			Id:      hiddenid,
+			Amount:  satoshis,
+			Content: content,
+		})
+	})
+
+	http.HandleFunc("/api/v1/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "GET", "POST")
+		if !ok {
+			return
+		}
+
+		if r.Method == "GET" {
+			hooks, err := user.listWebhooks()
+			if err != nil {
+				log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to list webhooks")
+				apiError(w, 500, "internal", "Failed to list webhooks.")
+				return
+			}
+
+			apihooks := make([]APIWebhook, len(hooks))
+			for i, hook := range hooks {
+				apihooks[i] = apiWebhook(hook)
+			}
+
+			apiJSON(w, 200, apihooks)
+			return
+		}
+
+		var params struct {
+			URL string `json:"url"`
+		}
+		if !apiDecode(w, r, &params) {
+			return
+		}
+
+		hook, err := user.addWebhook(params.URL)
+		if err != nil {
+			apiError(w, 400, "invalid_params", err.Error())
+			return
+		}
+
+		apiJSON(w, 201, apiWebhook(hook))
+	})
+
+	// DELETE /api/v1/webhooks/<id>
+	// GET /api/v1/webhooks/<id>/deliveries
+	http.HandleFunc("/api/v1/webhooks/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path[len("/api/v1/webhooks/"):], "/"), "/")
+		id, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "deliveries") {
+			apiError(w, 404, "not_found", "Not found.")
+			return
+		}
+
+		if len(parts) == 1 {
+			user, ok := apiAuth(w, r, "DELETE")
+			if !ok {
+				return
+			}
+
+			err = user.removeWebhook(id)
+			if err != nil {
+				apiError(w, 404, "not_found", err.Error())
+				return
+			}
+
+			w.WriteHeader(204)
+			return
+		}
+
+		user, ok := apiAuth(w, r, "GET")
+		if !ok {
+			return
+		}
+
+		limit, ok := apiLimit(w, r)
+		if !ok {
+			return
+		}
+
+		deliveries, err := user.listWebhookDeliveries(id, limit)
+		if err != nil {
+			log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to list webhook deliveries")
+			apiError(w, 500, "internal", "Failed to list deliveries.")
+			return
+		}
+
+		apideliveries := make([]APIWebhookDelivery, len(deliveries))
+		for i, d := range deliveries {
+			apideliveries[i] = APIWebhookDelivery{
+				EventId:    d.EventId,
+				Event:      d.Event,
+				Attempt:    d.Attempt,
+				Time:       d.Time.Unix(),
+				StatusCode: d.StatusCode.Int64,
+				Error:      d.Error.String,
+				Succeeded:  d.Succeeded(),
+			}
+		}
+
+		apiJSON(w, 200, apideliveries)
+	})
+}
+
+type APIWebhook struct {
+	Id        int    `json:"id"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type APIWebhookDelivery struct {
+	EventId    string `json:"event_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	Time       int64  `json:"time"`
+	StatusCode int64  `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Succeeded  bool   `json:"succeeded"`
+}
+
+type APIErrorBody struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type APIBalance struct {
+	Balance       float64 `json:"balance"`
+	TotalReceived float64 `json:"total_received"`
+	TotalSent     float64 `json:"total_sent"`
+	TotalFees     float64 `json:"total_fees"`
+}
+
+type APITransaction struct {
+	Time        int64   `json:"time"`
+	Status      string  `json:"status"`
+	Amount      float64 `json:"amount"`
+	Fees        float64 `json:"fees"`
+	PaymentHash string  `json:"payment_hash"`
+	Preimage    string  `json:"preimage,omitempty"`
+	Description string  `json:"description"`
+	Peer        string  `json:"telegram_peer,omitempty"`
+	Anonymous   bool    `json:"anonymous"`
+}
+
+type APITransactionPage struct {
+	Transactions []APITransaction `json:"transactions"`
+	NextCursor   string           `json:"next_cursor,omitempty"`
+}
+
+type APIInvoice struct {
+	PaymentHash    string  `json:"payment_hash"`
+	PaymentRequest string  `json:"payment_request"`
+	Description    string  `json:"description"`
+	Amount         *int    `json:"amount"`
+	Status         string  `json:"status"`
+	PaidAmount     float64 `json:"paid_amount"`
+	CreatedAt      int64   `json:"created_at"`
+	ExpiresAt      int64   `json:"expires_at"`
+}
+
+type APIInvoicePage struct {
+	Invoices   []APIInvoice `json:"invoices"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type APIPayment struct {
+	PaymentHash string `json:"payment_hash"`
+	Status      string `json:"status"`
+}
+
+type APISend struct {
+	Receiver  string `json:"receiver"`
+	Amount    int    `json:"amount"`
+	Anonymous bool   `json:"anonymous"`
+}
+
+type APIHiddenMessage struct {
+	Id      string `json:"id"`
+	Amount  int    `json:"amount"`
+	Content string `json:"content,omitempty"`
+}
+
+func apiWebhook(hook Webhook) APIWebhook {
+	return APIWebhook{
+		Id:        hook.Id,
+		URL:       hook.URL,
+		Secret:    hook.Secret,
+		CreatedAt: hook.CreatedAt.Unix(),
+	}
+}
+
+func apiTransaction(txn Transaction) APITransaction {
+	peer := ""
+	if txn.TelegramPeer.Valid && !(txn.IsReceive() && txn.Anonymous) {
+		peer = txn.TelegramPeer.String
+	}
+
+	return APITransaction{
+		Time:        txn.Time.Unix(),
+		Status:      strings.ToLower(txn.Status),
+		Amount:      txn.Amount,
+		Fees:        txn.Fees,
+		PaymentHash: txn.Hash,
+		Preimage:    txn.Preimage.String,
+		Description: txn.Description,
+		Peer:        peer,
+		Anonymous:   txn.Anonymous,
+	}
+}
+
+func apiInvoice(inv Invoice) APIInvoice {
+	apiinv := APIInvoice{
+		PaymentHash:    inv.Hash,
+		PaymentRequest: inv.Bolt11,
+		Description:    inv.Description,
+		Status:         strings.ToLower(inv.Status),
+		PaidAmount:     inv.PaidAmount,
+		CreatedAt:      inv.CreatedAt.Unix(),
+		ExpiresAt:      inv.ExpiresAt.Unix(),
+	}
+	if inv.Amount.Valid {
+		sats := int(inv.Amount.Float64)
+		apiinv.Amount = &sats
+	}
+	return apiinv
+}
+
+// apiAuth checks the request method and loads the user from the Authorization header.
+// it writes the error response itself and returns ok=false when the request can't proceed.
+func apiAuth(w http.ResponseWriter, r *http.Request, methods ...string) (user User, ok bool) {
+	allowed := false
+	for _, method := range methods {
+		if r.Method == method {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		apiError(w, 405, "method_not_allowed", "Method not allowed.")
+		return
+	}
+
+	user, err := loadUserFromBlueWalletCall(r)
+	if err != nil {
+		apiError(w, 401, "bad_auth", "Invalid or missing credentials.")
+		return
+	}
+
+	return user, true
+}
+
+func apiLimit(w http.ResponseWriter, r *http.Request) (limit int, ok bool) {
+	limit = 50
+	if slimit := r.URL.Query().Get("limit"); slimit != "" {
+		l, err := strconv.Atoi(slimit)
+		if err != nil || l < 1 || l > 500 {
+			apiError(w, 400, "invalid_params", "limit must be a number between 1 and 500.")
+			return
+		}
+		limit = l
+	}
+	return limit, true
+}
+
+func apiDecode(w http.ResponseWriter, r *http.Request, params interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		apiError(w, 400, "invalid_params", "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	apiJSON(w, status, APIErrorBody{APIErrorDetail{code, message}})
+}
+
+// cursors are opaque to clients, but they're just the time and hash of the last
+// item seen, from which we'll continue.
+func encodeCursor(t time.Time, hash string) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(t.UnixNano(), 10) + ":" + hash))
+}
+
+func decodeCursor(cursor string) (t time.Time, hash string, err error) {
+	if cursor == "" {
+		return
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("invalid cursor '%s'", cursor)
+		return
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	return time.Unix(0, nanos).UTC(), parts[1], nil
+}
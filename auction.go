@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	MIN_AUCTION_DURATION = time.Minute
+	MAX_AUCTION_DURATION = time.Hour * 24 * 7
+)
+
+type Auction struct {
+	Id          int            `db:"id"`
+	SellerId    int            `db:"seller_id"`
+	Reserve     int            `db:"reserve"`
+	Description string         `db:"description"`
+	ChatId      int64          `db:"chat_id"`
+	MessageId   int            `db:"message_id"`
+	EndsAt      time.Time      `db:"ends_at"`
+	Status      string         `db:"status"`
+	TopBid      int            `db:"top_bid"`
+	TopBidderId sql.NullInt64  `db:"top_bidder_id"`
+	TopHoldId   sql.NullString `db:"top_hold_id"`
+	CreatedAt   time.Time      `db:"created_at"`
+	EndedAt     *time.Time     `db:"ended_at"`
+}
+
+// MinBid is the reserve for the first bid, then at least 5% more than the
+// current top bid.
+func (a Auction) MinBid() int {
+	if !a.TopBidderId.Valid {
+		return a.Reserve
+	}
+	step := a.TopBid / 20
+	if step < 1 {
+		step = 1
+	}
+	return a.TopBid + step
+}
+
+func (a Auction) render() string {
+	seller, _ := loadUser(a.SellerId, 0)
+
+	text := fmt.Sprintf("🔨 <b>Auction #%d</b> by %s\n%s\n\n", a.Id, seller.AtName(),
+		escapeHTML(a.Description))
+
+	top := "No bids yet, reserve is " + strconv.Itoa(a.Reserve) + " sat."
+	if a.TopBidderId.Valid {
+		bidder, _ := loadUser(int(a.TopBidderId.Int64), 0)
+		top = fmt.Sprintf("Top bid: <b>%d sat</b> by %s.", a.TopBid, bidder.AtName())
+	}
+
+	switch a.Status {
+	case "open":
+		return text + top + fmt.Sprintf(
+			"\nEnds on %s UTC.\n\n<i>Reply to this message with an amount to bid something else.</i>",
+			a.EndsAt.Format("2 Jan 2006 15:04"))
+	case "sold":
+		bidder, _ := loadUser(int(a.TopBidderId.Int64), 0)
+		return text + fmt.Sprintf("Sold to %s for <b>%d sat</b>.", bidder.AtName(), a.TopBid)
+	default:
+		return text + "Ended without bids."
+	}
+}
+
+func (a Auction) keyboard() tgbotapi.InlineKeyboardMarkup {
+	min := a.MinBid()
+	next := min + min/10
+	if next == min {
+		next = min + 1
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("Bid %d", min), fmt.Sprintf("bid=%d-%d", a.Id, min)),
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("Bid %d", next), fmt.Sprintf("bid=%d-%d", a.Id, next)),
+		),
+	)
+}
+
+func (a Auction) refreshMessage() {
+	if a.Status == "open" {
+		editWithKeyboard(a.ChatId, a.MessageId, a.render(), a.keyboard())
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(a.ChatId, a.MessageId, a.render())
+	edit.ParseMode = "HTML"
+	bot.Send(edit)
+}
+
+func (u User) startAuction(
+	chatId int64,
+	reserve int,
+	duration time.Duration,
+	description string,
+) (a Auction, err error) {
+	if duration < MIN_AUCTION_DURATION || duration > MAX_AUCTION_DURATION {
+		return a, fmt.Errorf("the duration must be between %s and %s",
+			formatInterval(MIN_AUCTION_DURATION), formatInterval(MAX_AUCTION_DURATION))
+	}
+
+	err = pg.Get(&a, `
+INSERT INTO telegram.auction (seller_id, reserve, description, chat_id, ends_at)
+VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+RETURNING *
+    `, u.Id, reserve, description, chatId, duration.Seconds())
+	if err != nil {
+		return
+	}
+
+	chattable := tgbotapi.NewMessage(chatId, a.render())
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = a.keyboard()
+	message, err := bot.Send(chattable)
+	if err != nil {
+		pg.Exec(`DELETE FROM telegram.auction WHERE id = $1`, a.Id)
+		return
+	}
+
+	a.MessageId = message.MessageID
+	_, err = pg.Exec(`UPDATE telegram.auction SET message_id = $2 WHERE id = $1`, a.Id, a.MessageId)
+	setReplyRoute(chatId, a.MessageId, "auction:"+strconv.Itoa(a.Id), duration)
+	return
+}
+
+// bid holds the bidder's funds and releases the previous top bid.
+func (u User) bid(auctionId int, sats int) (a Auction, errMsg string, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return a, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&a, `
+SELECT * FROM telegram.auction
+WHERE id = $1 AND status = 'open' AND ends_at > now()
+FOR UPDATE
+    `, auctionId)
+	if err != nil {
+		return a, "This auction has ended.", err
+	}
+	if a.SellerId == u.Id {
+		return a, "Can't bid on your own auction.", errors.New("seller bidding")
+	}
+	if sats < a.MinBid() {
+		return a, fmt.Sprintf("The minimum bid is %d sat.", a.MinBid()),
+			errors.New("bid too low")
+	}
+
+	// release the previous top bid first, so the top bidder raising their
+	// own bid only needs the new amount
+	previous := a
+	if a.TopHoldId.Valid {
+		_, err = releaseHold(txn, a.TopHoldId.String, "outbid")
+		if err != nil {
+			return a, "Database error.", err
+		}
+	}
+
+	var bidId int
+	err = txn.Get(&bidId, `SELECT nextval('telegram.auction_bid_id_seq')`)
+	if err != nil {
+		return a, "Database error.", err
+	}
+
+	holdId := fmt.Sprintf("bid:%d", bidId)
+	_, errMsg, err = holdFunds(txn, holdId, u, a.SellerId, sats*1000,
+		fmt.Sprintf("bid on auction #%d", a.Id), 0)
+	if err != nil {
+		return
+	}
+
+	_, err = txn.Exec(`
+INSERT INTO telegram.auction_bid (id, auction_id, bidder_id, amount, hold_id)
+VALUES ($1, $2, $3, $4, $5)
+    `, bidId, a.Id, u.Id, sats, holdId)
+	if err != nil {
+		return a, "Database error.", err
+	}
+
+	err = txn.Get(&a, `
+UPDATE telegram.auction
+SET top_bid = $2, top_bidder_id = $3, top_hold_id = $4
+WHERE id = $1
+RETURNING *
+    `, a.Id, sats, u.Id, holdId)
+	if err != nil {
+		return a, "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return a, "Database error.", err
+	}
+
+	if previous.TopBidderId.Valid && int(previous.TopBidderId.Int64) != u.Id {
+		outbid, _ := loadUser(int(previous.TopBidderId.Int64), 0)
+		outbid.notify(fmt.Sprintf("You were outbid on auction #%d, your %d sat are back in your balance.",
+			a.Id, previous.TopBid))
+	}
+
+	a.refreshMessage()
+	return a, "", nil
+}
+
+// bidFromReply handles an amount sent as a reply to the auction message.
+func (u User) bidFromReply(auctionId int, message *tgbotapi.Message) {
+	sats, err := strconv.Atoi(strings.TrimSpace(message.Text))
+	if err != nil || sats <= 0 {
+		if message.Chat.Type == "private" {
+			notifyAsReply(message.Chat.ID, "To bid, reply with just the amount in satoshis.", message.MessageID)
+		}
+		// in groups this is just people talking about it
+		return
+	}
+
+	_, errMsg, err := u.bid(auctionId, sats)
+	if err != nil {
+		log.Debug().Err(err).Int("auction", auctionId).Str("user", u.Username).
+			Msg("failed to bid")
+		notifyAsReply(message.Chat.ID, "Bid not placed: "+errMsg, message.MessageID)
+		return
+	}
+
+	notifyAsReply(message.Chat.ID, fmt.Sprintf("%s bid %d sat.", u.AtName(), sats), message.MessageID)
+}
+
+// endAuction gives the top bid to the seller, or just closes the auction if
+// there were no bids.
+func endAuction(auctionId int) (err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var a Auction
+	err = txn.Get(&a, `
+UPDATE telegram.auction
+SET status = CASE WHEN top_bidder_id IS NULL THEN 'unsold' ELSE 'sold' END,
+    ended_at = now()
+WHERE id = $1 AND status = 'open'
+RETURNING *
+    `, auctionId)
+	if err != nil {
+		return
+	}
+
+	var hold Hold
+	if a.TopHoldId.Valid {
+		hold, err = captureHold(txn, a.TopHoldId.String, a.SellerId, "won")
+		if err != nil {
+			return
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return
+	}
+
+	a.refreshMessage()
+
+	seller, _ := loadUser(a.SellerId, 0)
+	if !a.TopBidderId.Valid {
+		seller.notify(fmt.Sprintf("Auction #%d ended without bids.", a.Id))
+		return
+	}
+
+	winner, _ := loadUser(int(a.TopBidderId.Int64), 0)
+	publish(InternalTransfer{
+		From:        winner,
+		To:          seller,
+		Msats:       hold.Msats,
+		Hash:        hold.Hash,
+		Description: hold.Description,
+	})
+	seller.notify(fmt.Sprintf("Auction #%d sold to %s, %d sat are yours.",
+		a.Id, winner.AtName(), a.TopBid))
+	winner.notify(fmt.Sprintf("You won auction #%d by %s for %d sat: %s",
+		a.Id, seller.AtName(), a.TopBid, escapeHTML(a.Description)))
+	return
+}
+
+func endDueAuctions() {
+	var ids []int
+	err := pg.Select(&ids, `
+SELECT id FROM telegram.auction WHERE status = 'open' AND ends_at < now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load due auctions")
+		return
+	}
+
+	for _, id := range ids {
+		err := endAuction(id)
+		if err != nil {
+			log.Warn().Err(err).Int("auction", id).Msg("failed to end auction")
+		}
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 )
 
 func startBlueWallet() {
@@ -155,7 +154,7 @@ func startBlueWallet() {
 		}
 
 		limit, offset := getLimitAndOffset(r)
-		txns, err := user.listTransactions(limit, offset, 120, Out)
+		txns, err := user.listTransactions(limit, offset, 120, "", Both)
 		if err != nil {
 			errorInternal(w)
 			return
@@ -168,23 +167,44 @@ func startBlueWallet() {
 			Value           float64 `json:"value"`
 			Timestamp       int64   `json:"timestamp"`
 			Memo            string  `json:"memo"`
+			IsPaid          bool    `json:"ispaid,omitempty"`
+			Amount          float64 `json:"amt,omitempty"`
 		}
 
-		payments := make([]Payment, len(txns))
-		for i, txn := range txns {
+		payments := make([]Payment, 0, len(txns))
+		for _, txn := range txns {
+			if txn.IsReceive() && txn.Label.Valid {
+				// received invoices are listed on /getuserinvoices
+				continue
+			}
+			if txn.Status == "INCOMING" || txn.Status == "REFUNDED" {
+				// on hold for this user or given back, not part of the balance
+				continue
+			}
+
 			preimage := txn.Preimage.String
 			if preimage == "" {
 				preimage = "0000000000000000000000000000000000000000000000000000000000000000"
 			}
 
-			payments[i] = Payment{
-				preimage,
-				"paid_invoice",
-				txn.Fees,
-				-txn.Amount,
-				txn.Time.Unix(),
-				txn.Description + " " + txn.PeerActionDescription(),
+			payment := Payment{
+				PaymentPreimage: preimage,
+				Type:            "paid_invoice",
+				Fee:             txn.Fees,
+				Value:           -txn.Amount,
+				Timestamp:       txn.Time.Unix(),
+				Memo:            strings.TrimSpace(txn.Description + " " + txn.PeerActionDescription()),
+			}
+
+			if txn.IsReceive() {
+				// internal transfers received from other users
+				payment.Type = "user_invoice"
+				payment.Value = txn.Amount
+				payment.IsPaid = true
+				payment.Amount = txn.Amount
 			}
+
+			payments = append(payments, payment)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -204,7 +224,7 @@ func startBlueWallet() {
 		}
 
 		limit, offset := getLimitAndOffset(r)
-		txns, err := user.listTransactions(limit, offset, 120, In)
+		invoices, err := user.listInvoices(limit, offset)
 		if err != nil {
 			errorInternal(w)
 			return
@@ -218,46 +238,36 @@ func startBlueWallet() {
 			Description    string  `json:"description"`
 			PaymentHash    string  `json:"payment_hash"`
 			IsPaid         bool    `json:"ispaid"`
+			Status         string  `json:"status"`
 			Amount         float64 `json:"amt"`
+			PaidAmount     float64 `json:"paid_amount"`
 			ExpireTime     float64 `json:"expire_time"`
 			Timestamp      int64   `json:"timestamp"`
 			Type           string  `json:"type"`
 		}
 
-		invs := make([]Inv, len(txns))
-		for i, txn := range txns {
-			invs[i] = Inv{
-				Buffer(txn.Hash),
-				"",
-				"",
-				"1000",
-				txn.PeerActionDescription() + txn.Description,
-				txn.Hash,
-				true,
-				txn.Amount,
-				float64(s.InvoiceTimeout.Seconds()),
-				txn.Time.Unix(),
-				"user_invoice",
+		invs := make([]Inv, len(invoices))
+		for i, inv := range invoices {
+			amount := inv.Amount.Float64
+			if inv.IsPaid() {
+				amount = inv.PaidAmount
 			}
-		}
 
-		iinv, err := rds.Get("justcreatedbluewalletinvoice:" + strconv.Itoa(user.Id)).Result()
-		if err == nil {
-			var inv map[string]interface{}
-			json.Unmarshal([]byte(iinv), &inv)
-			invs = append(invs, Inv{
-				Buffer(inv["hash"].(string)),
-				inv["bolt11"].(string),
-				inv["bolt11"].(string),
+			invs[i] = Inv{
+				Buffer(inv.Hash),
+				inv.Bolt11,
+				inv.Bolt11,
 				"1000",
-				inv["desc"].(string),
-				inv["hash"].(string),
-				false,
-				inv["amount"].(float64),
-				inv["expiry"].(float64),
-				time.Now().Unix(),
+				inv.Description,
+				inv.Hash,
+				inv.IsPaid(),
+				strings.ToLower(inv.Status),
+				amount,
+				inv.PaidAmount,
+				inv.Expiry().Seconds(),
+				inv.CreatedAt.Unix(),
 				"user_invoice",
-			})
+			}
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -280,12 +290,24 @@ func startBlueWallet() {
 
 func loadUserFromBlueWalletCall(r *http.Request) (user User, err error) {
 	// decode user id and password from auth token
-	token := strings.Split(strings.TrimSpace(r.Header.Get("Authorization")), " ")[1]
+	authparts := strings.Split(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	if len(authparts) != 2 {
+		err = errors.New("invalid authorization header")
+		return
+	}
+	return loadUserFromToken(authparts[1])
+}
+
+func loadUserFromToken(token string) (user User, err error) {
 	res, err := base64.StdEncoding.DecodeString(token)
 	if err != nil {
 		return
 	}
-	parts := strings.Split(string(res), ":")
+	parts := strings.SplitN(string(res), ":", 2)
+	if len(parts) != 2 {
+		err = errors.New("invalid token")
+		return
+	}
 	userId, err := strconv.Atoi(parts[0])
 	if err != nil {
 		return
@@ -2,8 +2,7 @@ package main
 
 import (
 	"database/sql"
-
-	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"time"
 )
 
 /*
@@ -16,15 +15,6 @@ type GroupChat struct {
 	Ticket     int  `db:"ticket"`
 }
 
-type KickData struct {
-	InvoiceMessage   tgbotapi.Message          `json:"invoice_message"`
-	NotifyMessage    tgbotapi.Message          `json:"notify_message"`
-	JoinMessage      tgbotapi.Message          `json:"join_message"`
-	ChatMemberConfig tgbotapi.ChatMemberConfig `json:"chat_member_config"`
-	NewMember        tgbotapi.User             `json:"new_member"`
-	Hash             string                    `json:"hash"`
-}
-
 var spammy_cache = map[int64]bool{}
 
 func toggleSpammy(telegramId int64) (spammy bool, err error) {
@@ -57,6 +47,15 @@ func isSpammy(telegramId int64) (spammy bool) {
 	return
 }
 
+// nullChat is the value for the chat_id of a transaction: only group chats
+// are recorded.
+func nullChat(chatId int64) interface{} {
+	if chatId >= 0 {
+		return nil
+	}
+	return chatId
+}
+
 func setTicketPrice(telegramId int64, sat int) (err error) {
 	_, err = pg.Exec(`
       INSERT INTO telegram.chat AS c (telegram_id, ticket) VALUES ($1, $2)
@@ -64,9 +63,33 @@ func setTicketPrice(telegramId int64, sat int) (err error) {
         DO UPDATE SET ticket = $2
         RETURNING spammy
     `, -telegramId, sat)
+	if err == nil {
+		ticket_cache[-telegramId] = sat
+	}
 	return
 }
 
+var ticket_cache = map[int64]int{}
+
+// hasTicket tells if new members of the chat must pay to stay.
+func hasTicket(telegramId int64) bool {
+	if sat, ok := ticket_cache[-telegramId]; ok {
+		return sat > 0
+	}
+
+	var sat int
+	err := pg.Get(&sat, `
+      SELECT ticket FROM telegram.chat WHERE telegram_id = $1
+    `, -telegramId)
+	if err != nil && err != sql.ErrNoRows {
+		return false
+	}
+
+	ticket_cache[-telegramId] = sat
+
+	return sat > 0
+}
+
 func getTicketPrice(telegramId int64) (sat int, err error) {
 	err = pg.Get(&sat, `
       SELECT ticket FROM telegram.chat WHERE telegram_id = $1
@@ -77,3 +100,71 @@ func getTicketPrice(telegramId int64) (sat int, err error) {
 
 	return
 }
+
+// TicketSettings are how a group charges new members. Window and Ban are in
+// seconds, a Ban of 0 means kicked members can join again right away. Payee
+// is "owner", "treasury" or "admins".
+type TicketSettings struct {
+	Price  int    `db:"ticket"`
+	Window int    `db:"ticket_window"`
+	Ban    int    `db:"ticket_ban"`
+	Payee  string `db:"ticket_payee"`
+}
+
+func (ts TicketSettings) WindowDuration() time.Duration {
+	return time.Second * time.Duration(ts.Window)
+}
+
+func (ts TicketSettings) BanDuration() time.Duration {
+	return time.Second * time.Duration(ts.Ban)
+}
+
+func getTicketSettings(telegramId int64) (ts TicketSettings, err error) {
+	err = pg.Get(&ts, `
+      SELECT ticket, ticket_window, ticket_ban, ticket_payee
+      FROM telegram.chat WHERE telegram_id = $1
+    `, -telegramId)
+	if err == sql.ErrNoRows {
+		return TicketSettings{0, 15 * 60, 24 * 60 * 60, "owner"}, nil
+	}
+	return
+}
+
+// setTicketSetting changes one of the ticket_* columns of telegram.chat.
+func setTicketSetting(telegramId int64, column string, value interface{}) (err error) {
+	_, err = pg.Exec(`
+      INSERT INTO telegram.chat AS c (telegram_id, `+column+`) VALUES ($1, $2)
+      ON CONFLICT (telegram_id)
+        DO UPDATE SET `+column+` = $2
+    `, -telegramId, value)
+	return
+}
+
+func setTicketWhitelisted(telegramId int64, u User, whitelisted bool) (err error) {
+	if whitelisted {
+		_, err = pg.Exec(`
+      INSERT INTO telegram.chat (telegram_id) VALUES ($1)
+      ON CONFLICT (telegram_id) DO NOTHING
+        `, -telegramId)
+		if err != nil {
+			return
+		}
+
+		_, err = pg.Exec(`
+      INSERT INTO telegram.ticket_whitelist (chat_id, account_id) VALUES ($1, $2)
+      ON CONFLICT DO NOTHING
+        `, -telegramId, u.Id)
+	} else {
+		_, err = pg.Exec(`
+      DELETE FROM telegram.ticket_whitelist WHERE chat_id = $1 AND account_id = $2
+        `, -telegramId, u.Id)
+	}
+	return
+}
+
+func isTicketWhitelisted(telegramId int64, u User) (whitelisted bool) {
+	pg.Get(&whitelisted, `
+      SELECT true FROM telegram.ticket_whitelist WHERE chat_id = $1 AND account_id = $2
+    `, -telegramId, u.Id)
+	return
+}
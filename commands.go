@@ -84,18 +84,26 @@ var methods = []def{
 	def{
 		aliases:     []string{"send", "tip", "sendanonymously"},
 		explanation: "Sends satoshis to other Telegram users. The receiver is notified on his chat with the bot. If the receiver has never talked to the bot or have blocked it he can't be notified, however. In that case you can cancel the transaction afterwards in the /transactions view.",
-		argstr:      "[anonymously] <satoshis> [<receiver>...] [--anonymous]",
+		argstr:      "[anonymously] <satoshis> [<receiver>...] [--anonymous] [--memo=<memo>]",
 		flags: []flag{
 			{
 				"--anonymous",
 				"The receiver will never know who sent him the satoshis.",
 			},
+			{
+				"--memo",
+				"A note to the receiver, saved as the transaction description. Anything written after the receiver is also taken as a memo.",
+			},
 		},
 		examples: []example{
 			{
 				"/send 500 @username",
 				"Sends 500 satoshis to Telegram user @username.",
 			},
+			{
+				"/send 500 @username for lunch",
+				"Sends 500 satoshis to @username with the memo \"for lunch\", which they will see in their notification and in /transactions.",
+			},
 			{
 				"/tip 100",
 				"When sent as a reply to a message in a group where the bot is added, this will send 100 satoshis to the author of the message.",
@@ -106,6 +114,119 @@ var methods = []def{
 			},
 		},
 	},
+	def{
+		aliases:     []string{"request"},
+		explanation: "Asks another Telegram user to pay you. They get a private message with buttons to pay or decline, and you are notified of the outcome. Requests expire if not answered in time. In a group, send it as a reply to someone's message to request from them.",
+		argstr:      "<satoshis> [<payer>...] [--memo=<memo>]",
+		flags: []flag{
+			{
+				"--memo",
+				"What the payment is for. Anything written after the payer is also taken as a memo.",
+			},
+		},
+		examples: []example{
+			{
+				"/request 500 @username for the pizza",
+				"@username will be asked to pay you 500 satoshis, with the memo \"for the pizza\".",
+			},
+			{
+				"/request 1000",
+				"When sent as a reply to a message in a group, asks its author to pay you 1000 satoshis.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"requests"},
+		explanation: "Lists payment requests that are still open, both those made to you and those you've made.",
+	},
+	def{
+		aliases:     []string{"split"},
+		explanation: "Splits a bill among many people. Each participant gets a payment request for their share and a single message tracks who has paid. You're notified once everything is settled. Shares are equal unless a weight is given after a participant's name, as in \"@someone:2\". Include yourself in the list if you're also taking part, your share is considered paid.",
+		argstr:      "<satoshis> <participants>... [--memo=<memo>]",
+		flags: []flag{
+			{
+				"--memo",
+				"What the bill is for. Anything written after the participants is also taken as a memo.",
+			},
+		},
+		examples: []example{
+			{
+				"/split 3000 @me @alice @bob dinner",
+				"Asks @alice and @bob for 1000 satoshis each, with the memo \"dinner\", assuming you are @me.",
+			},
+			{
+				"/split 4000 @alice:3 @bob",
+				"Asks @alice for 3000 and @bob for 1000 satoshis.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"escrow"},
+		explanation: "Pays someone only when the deal is done. The satoshis leave your balance at once but stay locked until you release them to the seller. The seller can refund them at any time, and they come back to you automatically after the timeout. An arbiter, if given, can do both. Every party gets a private message with the buttons they can use and the whole story is visible on /tx.",
+		argstr:      "<satoshis> <seller>... [--arbiter=<arbiter>] [--timeout=<timeout>] [--memo=<memo>]",
+		flags: []flag{
+			{
+				"--arbiter",
+				"Someone both parties trust to release or refund the satoshis in case of disagreement.",
+			},
+			{
+				"--timeout",
+				"When the satoshis go back to you if they weren't released, in the form 12h, 3d or 2w. Defaults to 7d.",
+			},
+			{
+				"--memo",
+				"What the payment is for. Anything written after the seller is also taken as a memo.",
+			},
+		},
+		examples: []example{
+			{
+				"/escrow 20000 @seller used keyboard --arbiter @friend",
+				"Locks 20000 satoshis to pay @seller for a used keyboard, with @friend as the arbiter.",
+			},
+			{
+				"/escrow 5000 @seller --timeout 2d",
+				"Locks 5000 satoshis that go back to you in 2 days if you don't release them.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"treasury"},
+		explanation: "A wallet owned by the group. The first call by an admin opens it, after which /receive in the group pays into it. Without arguments, shows its balance and latest transactions. Admins propose spending with \"send\", which only happens after enough admins approve it with the buttons (2 by default, changed with \"approvals\"). Proposals expire after a week.",
+		argstr:      "[send <satoshis> <receiver>... [--memo=<memo>] | approvals <approvals>]",
+		examples: []example{
+			{
+				"/treasury send 50000 @designer --memo=\"new logo\"",
+				"Proposes paying @designer 50000 satoshis from the group treasury.",
+			},
+			{
+				"/treasury approvals 3",
+				"Spending needs 3 admins to approve.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"schedule"},
+		explanation: "Schedules payments to run later, once or repeatedly. Recurring sends go to other Telegram users, one-off payments can go to an invoice or a lightning address. Times are in UTC, either absolute, like 2020-01-31T14:00, or relative to now, like 3d. Intervals are given as hourly, daily, weekly or in the form 12h, 3d or 2w. A failed run is reported and not retried, and a schedule is stopped after failing 3 times in a row.",
+		argstr:      "(send <satoshis> <user> every <interval> [starting <start>] [until <date> | times <times>] | pay <target> [<satoshis>] at <time>)",
+		examples: []example{
+			{
+				"/schedule send 1000 @someone every 1w times 10",
+				"Sends 1000 satoshis to @someone now and then every week, 10 times in total.",
+			},
+			{
+				"/schedule send 500 @someone every daily starting 2020-02-01 until 2020-03-01",
+				"Sends 500 satoshis to @someone every day in February.",
+			},
+			{
+				"/schedule pay someone@domain.com 2000 at 2020-01-31T14:00",
+				"Pays 2000 satoshis to the lightning address someone@domain.com at the given time.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"schedules"},
+		explanation: "Lists your active scheduled payments with buttons to cancel them.",
+	},
 	def{
 		aliases:     []string{"balance"},
 		explanation: "Shows your current balance in satoshis, plus the sum of everything you've received and sent within the bot and the total amount of fees paid.",
@@ -118,25 +239,67 @@ var methods = []def{
 				"--page",
 				"To show older transactions, specify a page number greater than 1.",
 			},
+			{
+				"--search",
+				"Only show transactions whose description (or memo) or peer name contains the given text.",
+			},
+		},
+		argstr: "[--page=<page>] [--search=<text>]",
+	},
+	def{
+		aliases:     []string{"rain"},
+		explanation: "Splits an amount equally between the people who talked most recently in the group, up to the given number (10 by default). Bots and yourself are never included. Only people active in the last day count.",
+		argstr:      "<satoshis> [<num_participants>]",
+		examples: []example{
+			{
+				"/rain 1000 5",
+				"The last 5 people to talk in the group get 200 satoshis each.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"stats"},
+		explanation: "Shows the volume of tips and the number of giveaways and coinflips in the group over the last week, month and all time.",
+	},
+	def{
+		aliases:     []string{"leaderboard"},
+		explanation: "Shows who tipped and received the most in the group, this week by default. Anonymous tips never count for their senders. Group admins can hide someone from the boards with \"hide\" and show them again with \"unhide\".",
+		argstr:      "[week | month | all | hide <user> | unhide <user>]",
+		examples: []example{
+			{
+				"/leaderboard month",
+				"Top tippers and receivers of the last 30 days.",
+			},
+			{
+				"/leaderboard hide @someone",
+				"@someone won't appear on this group's boards.",
+			},
 		},
-		argstr: "[--page=<page>]",
 	},
 	def{
 		aliases:     []string{"giveaway"},
-		explanation: "Creates a button in a group chat. The first person to click the button gets the satoshis.",
-		argstr:      "<satoshis>",
+		explanation: "Creates a button in a group chat. The first person to click the button gets the satoshis. With --claimers the amount is split between the first people to click. Naming a user makes it claimable only by them, and --members-only restricts it to members of the group.",
+		argstr:      "<satoshis> [<receiver>...] [--claimers=<claimers>] [--members-only]",
 		examples: []example{
 			{
 				"/giveaway 1000",
 				"Once someone clicks the \"Claim\" button 1000 satoshis will be transferred from you to them.",
 			},
+			{
+				"/giveaway 1000 --claimers=5",
+				"The first 5 people to click get 200 satoshis each.",
+			},
+			{
+				"/giveaway 500 @user",
+				"Only @user can claim the 500 satoshis.",
+			},
 		},
 		inline:         true,
 		inline_example: "giveaway <satoshis>",
 	},
 	def{
 		aliases:     []string{"coinflip", "lottery"},
-		explanation: "Starts a fair lottery with the given number of participants. Everybody pay the same amount as the entry fee. The winner gets it all. Funds are only moved from participants accounts when the lottery is actualized.",
+		explanation: "Starts a fair lottery with the given number of participants. Everybody pay the same amount as the entry fee, which is held from the moment they join and given back if the lottery is canceled or expires. The winner gets it all, drawn from a secret seed and the next Bitcoin block, see /verify.",
 		argstr:      "<satoshis> [<num_participants>]",
 		examples: []example{
 			{
@@ -161,8 +324,8 @@ var methods = []def{
 		inline_example: "giveflip <satoshis> <num_participants>",
 	},
 	def{
-		aliases:     []string{"fundraise", "crowdfund"},
-		explanation: "Starts a crowdfunding event with a predefined number of participants and contribution amount. If the given number of participants contribute, it will be actualized. Otherwise it will be canceled in some hours.",
+		aliases:     []string{"fundraise"},
+		explanation: "Starts a crowdfunding event with a predefined number of participants and contribution amount. If the given number of participants contribute, it will be actualized. Otherwise it will be canceled in some hours. For a campaign with a goal, see /crowdfund.",
 		argstr:      "<satoshis> <num_participants> <receiver>...",
 		examples: []example{
 			{
@@ -171,6 +334,103 @@ var methods = []def{
 			},
 		},
 	},
+	def{
+		aliases:     []string{"verify"},
+		explanation: "Shows how the winner of a coinflip or giveflip was drawn. When the game is created only the hash of a random seed is shown. When it is filled the next Bitcoin block is chosen, and once it is mined the winner is the sha256 of \"seed:block hash:participant ids\" modulo the number of participants, counting over the ids sorted. The seed is revealed after the draw so anyone can reproduce it.",
+		argstr:      "<game>",
+		examples: []example{
+			{
+				"/verify 127",
+				"Shows the seed, the block and the computation that picked the winner of game #127.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"crowdfund"},
+		explanation: "Starts a campaign to raise a goal amount for someone until a deadline. Anyone can contribute any amount, with the buttons or by replying to the campaign message. Contributions are held until the goal is reached, when they all go to the receiver, or given back to everybody if the deadline passes first. Deadlines are given in the form 12h, 3d or 2w.",
+		argstr:      "<satoshis> <deadline> <user> <message>...",
+		examples: []example{
+			{
+				"/crowdfund 1000000 2w @developer a new release of our favorite wallet",
+				"Raises 1000000 satoshis for @developer in up to two weeks.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"inbox"},
+		explanation: "Opens a paid inbox, so anyone can message you through the bot with /dm as long as they pay your price. Each message comes with buttons to reply, refund the sender or block them. Your answers are free and the sender can answer each of them once for free. Without arguments, shows your current price.",
+		argstr:      "[price <satoshis> | off | unblock <user>]",
+		examples: []example{
+			{
+				"/inbox price 200",
+				"Anyone will be able to message you by paying 200 satoshis.",
+			},
+			{
+				"/inbox off",
+				"Closes your inbox.",
+			},
+			{
+				"/inbox unblock @someone",
+				"Allows @someone to message you again after being blocked.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"dm"},
+		explanation: "Sends a message to someone's paid inbox. Their price, set with /inbox, is taken from your balance and the message is relayed by the bot.",
+		argstr:      "<user> <message>...",
+		examples: []example{
+			{
+				"/dm @someone hi, I'd like to hire you",
+				"Pays @someone's inbox price and relays the message to them.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"ask"},
+		explanation: "Pays someone to answer a question. The satoshis are taken from your balance and held until they reply to the question relayed by the bot, and come back to you if there's no answer before the deadline or if they decline. Once answered, they can publish the question and answer as a hidden message.",
+		argstr:      "<user> <satoshis> <message>... [--deadline=<deadline>]",
+		flags: []flag{
+			{
+				"--deadline",
+				"How long they have to answer, in the form 12h, 3d or 2w. Defaults to 2d.",
+			},
+		},
+		examples: []example{
+			{
+				"/ask @expert 5000 what's the best way to run a node at home?",
+				"Holds 5000 satoshis, which @expert will get by answering within 2 days.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"auction"},
+		explanation: "Auctions something in a group. People bid with the buttons or by replying to the auction message with an amount. Each bid is held from the bidder's balance and the previous top bid is given back. When the time is up the top bid goes to you and the message shows the winner. Durations are given in the form 30m, 12h or 3d.",
+		argstr:      "<satoshis> <duration> <message>...",
+		examples: []example{
+			{
+				"/auction 10000 1d handmade wooden bitcoin sign",
+				"Auctions the sign for one day, starting at 10000 satoshis.",
+			},
+		},
+	},
+	def{
+		aliases:     []string{"raffle"},
+		explanation: "Starts a raffle in a group. Anyone can buy as many tickets as they want until the deadline, with the buttons or by replying to the raffle message with a number. The payments are held until the draw, where the winner is picked with odds proportional to their tickets and gets the whole pot, minus your cut if one was given. Deadlines are given in the form 30m, 12h or 3d.",
+		argstr:      "<satoshis> <deadline> [<message>...] [--cut=<percent>]",
+		flags: []flag{
+			{
+				"--cut",
+				"Percent of the pot you keep as the organizer, up to 50.",
+			},
+		},
+		examples: []example{
+			{
+				"/raffle 100 1d a signed copy of the whitepaper --cut 10",
+				"Sells 100 satoshi tickets for a day. The winner gets 90% of the pot and you keep 10%.",
+			},
+		},
+	},
 	def{
 		aliases:     []string{"hide"},
 		argstr:      "<satoshis> <message>...",
@@ -224,7 +484,7 @@ var methods = []def{
 	},
 	def{
 		aliases:     []string{"bluewallet", "lndhub"},
-		explanation: "Returns your credentials for importing your bot wallet on BlueWallet. You can use the same account from both places interchangeably.",
+		explanation: "Returns your credentials for importing your bot wallet on BlueWallet. You can use the same account from both places interchangeably. The same credentials also give access to the HTTP API described at /api/v1/openapi.json, including a live event stream at /api/v1/stream.",
 		argstr:      "[refresh]",
 		examples: []example{
 			{
@@ -237,19 +497,58 @@ var methods = []def{
 			},
 		},
 	},
+	def{
+		aliases:     []string{"webhook", "webhooks"},
+		explanation: "Manages URLs that will receive a POST request with a JSON body whenever an invoice of yours is paid, a payment you've made succeeds or fails, or you receive satoshis from another user. Each request carries an X-Signature header with 'sha256=' followed by the hex-encoded HMAC-SHA256 of the body keyed with the webhook secret. Failed deliveries are retried a few times with increasing delays.",
+		argstr:      "[add <url> | remove <webhook_id> | log <webhook_id>]",
+		examples: []example{
+			{
+				"/webhook add https://myshop.com/lntxbot",
+				"Registers a new webhook and shows its secret.",
+			},
+			{
+				"/webhook",
+				"Lists your webhooks.",
+			},
+			{
+				"/webhook log 12",
+				"Shows the latest delivery attempts for webhook 12.",
+			},
+			{
+				"/webhook remove 12",
+				"Stops sending events to webhook 12.",
+			},
+		},
+	},
 	def{
 		aliases:     []string{"toggle"},
-		explanation: "Toggles bot features in groups on/off. In supergroups it only be run by group admins.",
-		argstr:      "(ticket [<price>]|spammy)",
+		explanation: "Toggles bot features in groups on/off. In supergroups it only be run by group admins. Tickets have more settings: the time new entrants have to pay (15 minutes by default), how long those who don't pay stay banned (a day by default, \"off\" to just kick them), who gets the money (\"owner\", \"treasury\" or \"admins\", who split it) and a whitelist of people who never pay. Admins can also let someone in without paying with the button on the ticket message.",
+		argstr:      "(ticket [<price>] | ticket window <duration> | ticket ban <duration> | ticket payee <payee> | ticket (whitelist | unwhitelist) <user> | spammy)",
 		examples: []example{
 			{
 				"/toggle ticket 10",
-				"New group entrants will be prompted to pay 10 satoshis in 30 minutes or be kicked. Useful as an antispam measure.",
+				"New group entrants will be prompted to pay 10 satoshis in 15 minutes or be kicked. Useful as an antispam measure.",
 			},
 			{
 				"/toggle ticket",
 				"Stop charging new entrants a fee.",
 			},
+			{
+				"/toggle ticket window 1h",
+				"New entrants have an hour to pay.",
+			},
+			{
+				"/toggle ticket ban off",
+				"Those who don't pay are kicked but can join again.",
+			},
+			{
+				"/toggle ticket payee treasury",
+				"Tickets go to the group /treasury.",
+			},
+			{
+				"/toggle ticket whitelist @friend",
+				"@friend can join without paying.",
+			},
 			{
 				"/toggle spammy",
 				"'spammy' mode is off by default. When turned on, tip notifications will be sent in the group instead of only privately.",
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx"
+)
+
+const MAX_CROWDFUND_DURATION = time.Hour * 24 * 90
+
+type Crowdfund struct {
+	Id         int        `db:"id"`
+	CreatorId  int        `db:"creator_id"`
+	ReceiverId int        `db:"receiver_id"`
+	Goal       int        `db:"goal"`
+	Title      string     `db:"title"`
+	ChatId     int64      `db:"chat_id"`
+	MessageId  int        `db:"message_id"`
+	EndsAt     time.Time  `db:"ends_at"`
+	Status     string     `db:"status"`
+	CreatedAt  time.Time  `db:"created_at"`
+	EndedAt    *time.Time `db:"ended_at"`
+}
+
+type CrowdfundBacker struct {
+	BackerId int `db:"backer_id"`
+	Amount   int `db:"amount"`
+}
+
+type CrowdfundContribution struct {
+	BackerId int    `db:"backer_id"`
+	Amount   int    `db:"amount"`
+	HoldId   string `db:"hold_id"`
+}
+
+// backers are sorted by the total each has contributed, biggest first.
+func (c Crowdfund) backers() (backers []CrowdfundBacker, err error) {
+	err = pg.Select(&backers, `
+SELECT backer_id, sum(amount) AS amount
+FROM telegram.crowdfund_contribution
+WHERE crowdfund_id = $1
+GROUP BY backer_id
+ORDER BY amount DESC, min(id)
+    `, c.Id)
+	return
+}
+
+func progressBar(fraction float64) string {
+	const size = 10
+	filled := int(fraction * size)
+	if filled > size {
+		filled = size
+	}
+	return strings.Repeat("▓", filled) + strings.Repeat("░", size-filled)
+}
+
+func (c Crowdfund) render() string {
+	receiver, _ := loadUser(c.ReceiverId, 0)
+	backers, _ := c.backers()
+
+	raised := 0
+	for _, b := range backers {
+		raised += b.Amount
+	}
+	fraction := float64(raised) / float64(c.Goal)
+
+	text := fmt.Sprintf("📢 <b>Crowdfund #%d</b>: %s\nFor %s.\n\n%s %d%%\n<b>%d</b> of %d sat from %d backers.",
+		c.Id, escapeHTML(c.Title), receiver.AtName(),
+		progressBar(fraction), int(fraction*100), raised, c.Goal, len(backers))
+
+	if len(backers) > 0 {
+		text += "\n\nTop backers:"
+		for i, b := range backers {
+			if i == 3 {
+				break
+			}
+			backer, _ := loadUser(b.BackerId, 0)
+			text += fmt.Sprintf("\n%s %d sat", backer.AtName(), b.Amount)
+		}
+	}
+
+	switch c.Status {
+	case "open":
+		return text + fmt.Sprintf(
+			"\n\nEnds on %s UTC. Contributions are held and given back if the goal isn't reached by then.\n\n<i>Reply to this message with an amount to contribute something else.</i>",
+			c.EndsAt.Format("2 Jan 2006 15:04"))
+	case "funded":
+		return text + fmt.Sprintf("\n\n🎉 Goal reached, the funds went to %s!", receiver.AtName())
+	default:
+		return text + "\n\nThe goal wasn't reached, everybody was refunded."
+	}
+}
+
+func (c Crowdfund) keyboard() tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	last := 0
+	for _, div := range []int{100, 20, 10} {
+		amount := c.Goal / div
+		if amount < 1 {
+			amount = 1
+		}
+		if amount == last {
+			continue
+		}
+		last = amount
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("Give %d", amount), fmt.Sprintf("cfund=%d-%d", c.Id, amount)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+func (c Crowdfund) refreshMessage() {
+	if c.Status == "open" {
+		editWithKeyboard(c.ChatId, c.MessageId, c.render(), c.keyboard())
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(c.ChatId, c.MessageId, c.render())
+	edit.ParseMode = "HTML"
+	bot.Send(edit)
+}
+
+func (u User) startCrowdfund(
+	chatId int64,
+	goal int,
+	duration time.Duration,
+	receiver User,
+	title string,
+) (c Crowdfund, err error) {
+	if duration <= 0 || duration > MAX_CROWDFUND_DURATION {
+		return c, fmt.Errorf("the deadline must be at most %s from now",
+			formatInterval(MAX_CROWDFUND_DURATION))
+	}
+
+	err = pg.Get(&c, `
+INSERT INTO telegram.crowdfund (creator_id, receiver_id, goal, title, chat_id, ends_at)
+VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6))
+RETURNING *
+    `, u.Id, receiver.Id, goal, title, chatId, duration.Seconds())
+	if err != nil {
+		return
+	}
+
+	chattable := tgbotapi.NewMessage(chatId, c.render())
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = c.keyboard()
+	message, err := bot.Send(chattable)
+	if err != nil {
+		pg.Exec(`DELETE FROM telegram.crowdfund WHERE id = $1`, c.Id)
+		return
+	}
+
+	c.MessageId = message.MessageID
+	_, err = pg.Exec(`UPDATE telegram.crowdfund SET message_id = $2 WHERE id = $1`, c.Id, c.MessageId)
+	setReplyRoute(chatId, c.MessageId, "crowdfund:"+strconv.Itoa(c.Id), duration)
+	return
+}
+
+// contribute holds the contribution and, when it makes the goal, gives
+// all the contributions to the receiver.
+func (u User) contribute(crowdfundId int, sats int) (c Crowdfund, errMsg string, err error) {
+	if sats <= 0 {
+		return c, "Invalid amount.", errors.New("invalid amount")
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return c, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&c, `
+SELECT * FROM telegram.crowdfund
+WHERE id = $1 AND status = 'open' AND ends_at > now()
+FOR UPDATE
+    `, crowdfundId)
+	if err != nil {
+		return c, "This crowdfund has ended.", err
+	}
+
+	var contributionId int
+	err = txn.Get(&contributionId, `SELECT nextval('telegram.crowdfund_contribution_id_seq')`)
+	if err != nil {
+		return c, "Database error.", err
+	}
+
+	holdId := fmt.Sprintf("crowdfund:%d", contributionId)
+	_, errMsg, err = holdFunds(txn, holdId, u, c.ReceiverId, sats*1000,
+		fmt.Sprintf("crowdfund #%d", c.Id), 0)
+	if err != nil {
+		return
+	}
+
+	_, err = txn.Exec(`
+INSERT INTO telegram.crowdfund_contribution (id, crowdfund_id, backer_id, amount, hold_id)
+VALUES ($1, $2, $3, $4, $5)
+    `, contributionId, c.Id, u.Id, sats, holdId)
+	if err != nil {
+		return c, "Database error.", err
+	}
+
+	var raised int
+	err = txn.Get(&raised, `
+SELECT sum(amount) FROM telegram.crowdfund_contribution WHERE crowdfund_id = $1
+    `, c.Id)
+	if err != nil {
+		return c, "Database error.", err
+	}
+
+	var funded PooledTransfer
+	if raised >= c.Goal {
+		funded, err = c.end(txn, "funded")
+		if err != nil {
+			return c, "Database error.", err
+		}
+		c.Status = "funded"
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return c, "Database error.", err
+	}
+
+	if c.Status == "funded" {
+		publish(funded)
+	}
+
+	c.refreshMessage()
+	return c, "", nil
+}
+
+func (u User) contributeFromReply(crowdfundId int, message *tgbotapi.Message) {
+	sats, err := strconv.Atoi(strings.TrimSpace(message.Text))
+	if err != nil || sats <= 0 {
+		if message.Chat.Type == "private" {
+			notifyAsReply(message.Chat.ID, "To contribute, reply with just the amount in satoshis.", message.MessageID)
+		}
+		// in groups this is just people talking about it
+		return
+	}
+
+	_, errMsg, err := u.contribute(crowdfundId, sats)
+	if err != nil {
+		log.Debug().Err(err).Int("crowdfund", crowdfundId).Str("user", u.Username).
+			Msg("failed to contribute")
+		notifyAsReply(message.Chat.ID, "Contribution not made: "+errMsg, message.MessageID)
+		return
+	}
+
+	notifyAsReply(message.Chat.ID, fmt.Sprintf("%s contributed %d sat.", u.AtName(), sats), message.MessageID)
+}
+
+// end captures (status "funded") or releases (status "failed") all the
+// contributions inside txn. the returned event should be published after
+// the commit.
+func (c Crowdfund) end(txn *sqlx.Tx, status string) (event PooledTransfer, err error) {
+	_, err = txn.Exec(`
+UPDATE telegram.crowdfund SET status = $2, ended_at = now() WHERE id = $1
+    `, c.Id, status)
+	if err != nil {
+		return
+	}
+
+	var contributions []CrowdfundContribution
+	err = txn.Select(&contributions, `
+SELECT backer_id, amount, hold_id FROM telegram.crowdfund_contribution
+WHERE crowdfund_id = $1
+    `, c.Id)
+	if err != nil {
+		return
+	}
+
+	receiver, _ := loadUser(c.ReceiverId, 0)
+	event.To = receiver
+
+	raised := 0
+	for _, contribution := range contributions {
+		raised += contribution.Amount
+		backer, _ := loadUser(contribution.BackerId, 0)
+
+		if status == "funded" {
+			hold, err := captureHold(txn, contribution.HoldId, 0, "goal reached")
+			if err != nil {
+				return event, err
+			}
+			event.Transfers = append(event.Transfers, InternalTransfer{
+				From:        backer,
+				To:          receiver,
+				Msats:       hold.Msats,
+				Hash:        hold.Hash,
+				Description: hold.Description,
+			})
+		} else {
+			_, err = releaseHold(txn, contribution.HoldId, "deadline passed")
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if status == "funded" {
+		event.ReceiverNotice = fmt.Sprintf(
+			"📢 Crowdfund #%d reached its goal! %d sat from %d contributions are in your balance.",
+			c.Id, raised, len(contributions))
+	}
+	return
+}
+
+// failCrowdfund refunds everybody when the deadline passes before the goal.
+func failCrowdfund(crowdfundId int) (err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var c Crowdfund
+	err = txn.Get(&c, `
+SELECT * FROM telegram.crowdfund WHERE id = $1 AND status = 'open' FOR UPDATE
+    `, crowdfundId)
+	if err != nil {
+		return
+	}
+
+	_, err = c.end(txn, "failed")
+	if err != nil {
+		return
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return
+	}
+	c.Status = "failed"
+
+	backers, _ := c.backers()
+	for _, b := range backers {
+		backer, _ := loadUser(b.BackerId, 0)
+		backer.notify(fmt.Sprintf(
+			"Crowdfund #%d didn't reach its goal in time, your %d sat are back in your balance.",
+			c.Id, b.Amount))
+	}
+
+	c.refreshMessage()
+	return
+}
+
+func failDueCrowdfunds() {
+	var ids []int
+	err := pg.Select(&ids, `
+SELECT id FROM telegram.crowdfund WHERE status = 'open' AND ends_at < now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load due crowdfunds")
+		return
+	}
+
+	for _, id := range ids {
+		err := failCrowdfund(id)
+		if err != nil {
+			log.Warn().Err(err).Int("crowdfund", id).Msg("failed to end crowdfund")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the winners of coinflips and giveflips are drawn with a commit-reveal
+// scheme: a random seed is generated when the game is created and only its
+// hash is shown. when the game is filled we pick the next bitcoin block,
+// which nobody knows yet, and when it is mined the winner is
+//
+//   sha256("<seed>:<block hash>:<participant ids, sorted, comma-separated>")
+//
+// read as a big-endian number, modulo the number of participants, indexing
+// the sorted ids. the seed is revealed afterwards so anyone can check.
+
+func newGameSeed() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSeed(seed string) string {
+	h := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(h[:])
+}
+
+func drawInput(seed string, blockHash string, ids []int) string {
+	sorted := make([]int, len(ids))
+	copy(sorted, ids)
+	sort.Ints(sorted)
+
+	strs := make([]string, len(sorted))
+	for i, id := range sorted {
+		strs[i] = strconv.Itoa(id)
+	}
+	return seed + ":" + blockHash + ":" + strings.Join(strs, ",")
+}
+
+// drawWinner returns the id of the winner among ids.
+func drawWinner(seed string, blockHash string, ids []int) int {
+	sorted := make([]int, len(ids))
+	copy(sorted, ids)
+	sort.Ints(sorted)
+
+	h := sha256.Sum256([]byte(drawInput(seed, blockHash, ids)))
+	n := new(big.Int).SetBytes(h[:])
+	i := n.Mod(n, big.NewInt(int64(len(sorted)))).Int64()
+	return sorted[i]
+}
+
+func currentBlockHeight() (int, error) {
+	info, err := ln.Call("getinfo")
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Get("blockheight").Int()), nil
+}
+
+// blockHashAt returns an empty string if the block wasn't mined yet.
+func blockHashAt(height int) (string, error) {
+	res, err := ln.Call("getrawblockbyheight", height)
+	if err != nil {
+		return "", err
+	}
+	return res.Get("blockhash").String(), nil
+}
+
+// verifyGame explains how the winner of a game was drawn, recomputing it.
+func verifyGame(gameId int) (string, error) {
+	g, err := loadGame(gameId)
+	if err != nil {
+		return "", errors.New("game not found")
+	}
+	if !g.hasDraw() {
+		return fmt.Sprintf("The %s #%d doesn't have a draw.", g.Kind, g.Id), nil
+	}
+
+	text := fmt.Sprintf("<b>%s #%d</b>\nSeed hash: <code>%s</code>", g.Kind, g.Id, g.SeedHash)
+	switch g.Status {
+	case "open":
+		return text + "\n\nStill waiting for participants.", nil
+	case "filled":
+		return text + fmt.Sprintf("\n\nWaiting for block %d to draw the winner.", g.DrawHeight), nil
+	case "settled":
+	default:
+		return text + "\n\nThis game ended without a draw.", nil
+	}
+
+	participants := g.participants()
+	ids := make([]int, len(participants))
+	for i, p := range participants {
+		ids[i] = p.Id
+	}
+	sort.Ints(ids)
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.Itoa(id)
+	}
+
+	winnerId := drawWinner(g.Seed, g.DrawBlock, ids)
+	winner, _ := loadUser(winnerId, 0)
+
+	text += fmt.Sprintf(`
+Seed: <code>%s</code>
+Block %d: <code>%s</code>
+Participant ids: %s
+
+sha256(<code>%s</code>) modulo %d picks <b>%s</b>.`,
+		g.Seed, g.DrawHeight, g.DrawBlock, strings.Join(strs, ", "),
+		escapeHTML(drawInput(g.Seed, g.DrawBlock, ids)), len(ids), winner.AtName())
+
+	if hashSeed(g.Seed) != g.SeedHash {
+		text += "\n\n⚠️ The seed doesn't match its hash!"
+	}
+	if hash, err := blockHashAt(g.DrawHeight); err == nil && hash != "" && hash != g.DrawBlock {
+		text += "\n\n⚠️ The block hash doesn't match the chain!"
+	}
+	if winnerId != g.WinnerId {
+		text += "\n\n⚠️ The result doesn't match the recorded winner!"
+	}
+	return text, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	DEFAULT_ESCROW_TIMEOUT = time.Hour * 24 * 7
+	MAX_ESCROW_TIMEOUT     = time.Hour * 24 * 90
+)
+
+type Escrow struct {
+	Id             int           `db:"id"`
+	BuyerId        int           `db:"buyer_id"`
+	SellerId       int           `db:"seller_id"`
+	ArbiterId      sql.NullInt64 `db:"arbiter_id"`
+	Amount         int           `db:"amount"`
+	Memo           string        `db:"memo"`
+	HoldId         string        `db:"hold_id"`
+	Status         string        `db:"status"`
+	BuyerMessage   int           `db:"buyer_message"`
+	SellerMessage  int           `db:"seller_message"`
+	ArbiterMessage int           `db:"arbiter_message"`
+	TimeoutAt      time.Time     `db:"timeout_at"`
+	CreatedAt      time.Time     `db:"created_at"`
+	ResolvedAt     *time.Time    `db:"resolved_at"`
+}
+
+func (e Escrow) MemoNote() string {
+	if e.Memo == "" {
+		return ""
+	}
+	return " for <i>" + escapeHTML(e.Memo) + "</i>"
+}
+
+func escrowKeyboard(escrowId int, release, refund bool) tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	if refund {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+			"Refund buyer", fmt.Sprintf("escrow=refund-%d", escrowId)))
+	}
+	if release {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+			"Release to seller", fmt.Sprintf("escrow=release-%d", escrowId)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// openEscrow takes the funds from the buyer and holds them until the buyer
+// or the arbiter releases them to the seller, the seller or the arbiter
+// refunds them, or the timeout, which refunds the buyer.
+func (buyer User) openEscrow(
+	seller User,
+	arbiter *User,
+	sats int,
+	memo string,
+	timeout time.Duration,
+	messageId int,
+) (escrow Escrow, errMsg string, err error) {
+	if seller.Id == buyer.Id {
+		return escrow, "Can't open an escrow with yourself.", errors.New("buyer is seller")
+	}
+	if arbiter != nil && (arbiter.Id == buyer.Id || arbiter.Id == seller.Id) {
+		return escrow, "The arbiter must be someone else.", errors.New("arbiter is a party")
+	}
+	if timeout <= 0 || timeout > MAX_ESCROW_TIMEOUT {
+		return escrow, fmt.Sprintf("The timeout must be at most %s.", formatInterval(MAX_ESCROW_TIMEOUT)),
+			errors.New("invalid timeout")
+	}
+
+	var varbiter interface{}
+	if arbiter != nil {
+		varbiter = arbiter.Id
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	// the hold is created first so it can be named after the escrow
+	var id int
+	err = txn.Get(&id, `SELECT nextval('telegram.escrow_id_seq')`)
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+
+	desc := fmt.Sprintf("escrow #%d", id)
+	if memo != "" {
+		desc += ": " + memo
+	}
+
+	holdId := fmt.Sprintf("escrow:%d", id)
+	_, errMsg, err = holdFunds(txn, holdId, buyer, seller.Id, sats*1000, desc, messageId)
+	if err != nil {
+		return
+	}
+
+	err = txn.Get(&escrow, `
+INSERT INTO telegram.escrow (id, buyer_id, seller_id, arbiter_id, amount, memo, hold_id, timeout_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, now() + make_interval(secs => $8))
+RETURNING *
+    `, id, buyer.Id, seller.Id, varbiter, sats, memo, holdId, timeout.Seconds())
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+
+	// everybody gets their buttons
+	arbiterNote := ""
+	if arbiter != nil {
+		arbiterNote = fmt.Sprintf(" %s is the arbiter.", arbiter.AtName())
+	}
+	deadline := escrow.TimeoutAt.Format("2 Jan 2006 15:04") + " UTC"
+
+	escrow.BuyerMessage = escrowMessage(buyer, escrowKeyboard(escrow.Id, true, false), fmt.Sprintf(
+		"Escrow #%d: you've locked <b>%d sat</b> to be paid to %s%s.%s Release them once you're satisfied, otherwise they'll come back to you on %s.",
+		escrow.Id, sats, seller.AtName(), escrow.MemoNote(), arbiterNote, deadline))
+	escrow.SellerMessage = escrowMessage(seller, escrowKeyboard(escrow.Id, false, true), fmt.Sprintf(
+		"Escrow #%d: %s has locked <b>%d sat</b> to pay you%s.%s They'll be yours once released by the buyer, or go back to them on %s. You can also refund them now.",
+		escrow.Id, buyer.AtName(), sats, escrow.MemoNote(), arbiterNote, deadline))
+	if arbiter != nil {
+		escrow.ArbiterMessage = escrowMessage(*arbiter, escrowKeyboard(escrow.Id, true, true), fmt.Sprintf(
+			"Escrow #%d: you're the arbiter of <b>%d sat</b> locked by %s to pay %s%s. Release or refund them if they disagree. They go back to the buyer on %s.",
+			escrow.Id, sats, buyer.AtName(), seller.AtName(), escrow.MemoNote(), deadline))
+	}
+
+	pg.Exec(`
+UPDATE telegram.escrow
+SET buyer_message = $2, seller_message = $3, arbiter_message = $4
+WHERE id = $1
+    `, escrow.Id, escrow.BuyerMessage, escrow.SellerMessage, escrow.ArbiterMessage)
+
+	return escrow, "", nil
+}
+
+func escrowMessage(u User, keyboard tgbotapi.InlineKeyboardMarkup, text string) int {
+	if u.ChatId == 0 {
+		return 0
+	}
+
+	chattable := tgbotapi.NewMessage(u.ChatId, text)
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = keyboard
+	message, err := bot.Send(chattable)
+	if err != nil {
+		return 0
+	}
+	return message.MessageID
+}
+
+// resolveEscrow releases (to the seller) or refunds (to the buyer) an open
+// escrow. by is nil when it's the timeout.
+func resolveEscrow(id int, by *User, release bool) (escrow Escrow, errMsg string, err error) {
+	status := "refunded"
+	if release {
+		status = "released"
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&escrow, `
+SELECT * FROM telegram.escrow WHERE id = $1 AND status = 'open' FOR UPDATE
+    `, id)
+	if err != nil {
+		return escrow, "This escrow is not open anymore.", err
+	}
+
+	// the buyer may only release, the seller may only refund, the arbiter may do both
+	if by != nil {
+		isArbiter := escrow.ArbiterId.Valid && int(escrow.ArbiterId.Int64) == by.Id
+		if !isArbiter &&
+			!(release && by.Id == escrow.BuyerId) &&
+			!(!release && by.Id == escrow.SellerId) {
+			return escrow, "You can't do that.", errors.New("not allowed")
+		}
+	}
+
+	note := "on timeout"
+	if by != nil {
+		note = "by " + by.AtName()
+	}
+
+	var hold Hold
+	if release {
+		hold, err = captureHold(txn, escrow.HoldId, escrow.SellerId, "released "+note)
+	} else {
+		hold, err = releaseHold(txn, escrow.HoldId, "refunded "+note)
+	}
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+
+	_, err = txn.Exec(`
+UPDATE telegram.escrow SET status = $2, resolved_at = now() WHERE id = $1
+    `, id, status)
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return escrow, "Database error.", err
+	}
+	escrow.Status = status
+
+	buyer, _ := loadUser(escrow.BuyerId, 0)
+	seller, _ := loadUser(escrow.SellerId, 0)
+
+	if release {
+		publish(InternalTransfer{
+			From:        buyer,
+			To:          seller,
+			Msats:       hold.Msats,
+			Hash:        hold.Hash,
+			Description: hold.Description,
+		})
+	}
+
+	// tell everybody and remove the buttons
+	text := fmt.Sprintf("Escrow #%d of %d sat%s was released to %s %s.",
+		escrow.Id, escrow.Amount, escrow.MemoNote(), seller.AtName(), note)
+	if !release {
+		text = fmt.Sprintf("Escrow #%d of %d sat%s was refunded to %s %s.",
+			escrow.Id, escrow.Amount, escrow.MemoNote(), buyer.AtName(), note)
+	}
+
+	parties := []struct {
+		id      int
+		message int
+	}{{escrow.BuyerId, escrow.BuyerMessage}, {escrow.SellerId, escrow.SellerMessage}}
+	if escrow.ArbiterId.Valid {
+		parties = append(parties, struct {
+			id      int
+			message int
+		}{int(escrow.ArbiterId.Int64), escrow.ArbiterMessage})
+	}
+
+	for _, party := range parties {
+		u, err := loadUser(party.id, 0)
+		if err != nil || u.ChatId == 0 {
+			continue
+		}
+		if party.message != 0 {
+			edit := tgbotapi.NewEditMessageText(u.ChatId, party.message, text)
+			edit.ParseMode = "HTML"
+			bot.Send(edit)
+		} else {
+			u.notify(text)
+		}
+	}
+
+	return escrow, "", nil
+}
+
+func refundTimedOutEscrows() {
+	var ids []int
+	err := pg.Select(&ids, `
+SELECT id FROM telegram.escrow WHERE status = 'open' AND timeout_at < now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load timed out escrows")
+		return
+	}
+
+	for _, id := range ids {
+		_, _, err := resolveEscrow(id, nil, false)
+		if err != nil {
+			log.Warn().Err(err).Int("escrow", id).Msg("failed to refund timed out escrow")
+		}
+	}
+}
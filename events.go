@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// events published by ledger operations, always after their database
+// transaction is committed. everything that is not moving money
+// (telegram notifications, webhooks, statistics, app hooks) should be
+// a subscriber.
+
+type InvoicePaid struct {
+	Receiver    User
+	MessageId   int
+	Msats       int64
+	Description string
+	Hash        string
+	Label       string
+}
+
+type PaymentSent struct {
+	Payer     User
+	MessageId int
+	Msats     float64
+	Fees      float64
+	Hash      string
+	Preimage  string
+}
+
+type PaymentFailed struct {
+	Payer     User
+	MessageId int
+	Hash      string
+}
+
+type InternalTransfer struct {
+	From        User
+	To          User
+	Msats       int
+	Hash        string
+	Description string
+	Anonymous   bool
+
+	// optional notifications, for when the code that triggered the transfer
+	// doesn't notify the parties by itself.
+	SenderNotice   string
+	ReceiverNotice string
+}
+
+// PooledTransfer is many InternalTransfers to the same receiver, committed together.
+type PooledTransfer struct {
+	To             User
+	Transfers      []InternalTransfer
+	ReceiverNotice string
+}
+
+type TicketPaid struct {
+	Owner User
+	Label string
+	Msats int64
+	Hash  string
+}
+
+type eventSubscriber func(event interface{})
+
+var eventSubscribers []eventSubscriber
+
+func init() {
+	subscribe(notifyOnEvent)
+	subscribe(accountEventOnEvent)
+	subscribe(countEvent)
+	subscribe(ticketOnEvent)
+}
+
+func subscribe(subscriber eventSubscriber) {
+	eventSubscribers = append(eventSubscribers, subscriber)
+}
+
+// publish runs each subscriber in its own goroutine, so a slow or broken
+// subscriber can't hold the caller or the others.
+func publish(event interface{}) {
+	for _, subscriber := range eventSubscribers {
+		go func(subscriber eventSubscriber) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error().Str("event", fmt.Sprintf("%T", event)).
+						Str("panic", fmt.Sprint(r)).Msg("event subscriber panicked")
+				}
+			}()
+			subscriber(event)
+		}(subscriber)
+	}
+}
+
+func notifyOnEvent(event interface{}) {
+	switch ev := event.(type) {
+	case InvoicePaid:
+		ev.Receiver.notifyAsReply(
+			fmt.Sprintf("Payment received: %d. /tx%s.", ev.Msats/1000, ev.Hash[:5]),
+			ev.MessageId,
+		)
+	case PaymentSent:
+		ev.Payer.notifyAsReply(fmt.Sprintf(
+			"Paid with <b>%d sat</b> (+ %.3f fee). \n\n<b>Hash:</b> %s\n\n<b>Proof:</b> %s\n\n/tx%s",
+			int(ev.Msats/1000),
+			ev.Fees/1000,
+			ev.Hash,
+			ev.Preimage,
+			ev.Hash[:5],
+		), ev.MessageId)
+	case PaymentFailed:
+		ev.Payer.notifyAsReply(fmt.Sprintf("Payment failed. /log%s", ev.Hash[:5]), ev.MessageId)
+	case InternalTransfer:
+		if ev.SenderNotice != "" {
+			ev.From.notify(ev.SenderNotice)
+		}
+		if ev.ReceiverNotice != "" {
+			ev.To.notify(ev.ReceiverNotice)
+		}
+	case PooledTransfer:
+		for _, transfer := range ev.Transfers {
+			notifyOnEvent(transfer)
+		}
+		if ev.ReceiverNotice != "" {
+			ev.To.notify(ev.ReceiverNotice)
+		}
+	}
+}
+
+// countEvent keeps running totals of everything that happens, by event kind,
+// in the "stats:events" (count) and "stats:msats" (volume) redis hashes.
+func countEvent(event interface{}) {
+	var msats int64
+	switch ev := event.(type) {
+	case InvoicePaid:
+		msats = ev.Msats
+	case PaymentSent:
+		msats = int64(ev.Msats)
+	case InternalTransfer:
+		msats = int64(ev.Msats)
+	case PooledTransfer:
+		for _, transfer := range ev.Transfers {
+			countEvent(transfer)
+		}
+		return
+	case TicketPaid:
+		msats = ev.Msats
+	}
+
+	kind := strings.TrimPrefix(fmt.Sprintf("%T", event), "main.")
+	rds.HIncrBy("stats:events", kind, 1)
+	if msats != 0 {
+		rds.HIncrBy("stats:msats", kind, msats)
+	}
+}
@@ -0,0 +1,883 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// games are giveaway, giveflip, coinflip and fundraise. they all go
+// open -> filled -> settled, or open -> canceled (by the creator) or
+// open -> expired (nobody joined in time). a game that fails to settle is
+// canceled. giveflips and coinflips wait in filled until their draw block is
+// mined, see draw.go.
+type Game struct {
+	Id              int        `db:"id"`
+	Kind            string     `db:"kind"`
+	CreatorId       int        `db:"creator_id"`
+	ReceiverId      int        `db:"receiver_id"`
+	Amount          int        `db:"amount"`
+	NParticipants   int        `db:"nparticipants"`
+	Status          string     `db:"status"`
+	ChatId          int64      `db:"chat_id"`
+	MessageId       int        `db:"message_id"`
+	InlineMessageId string     `db:"inline_message_id"`
+	WinnerId        int        `db:"winner_id"`
+	MembersOnly     bool       `db:"members_only"`
+	Seed            string     `db:"seed"`
+	SeedHash        string     `db:"seed_hash"`
+	DrawHeight      int        `db:"draw_height"`
+	DrawBlock       string     `db:"draw_block"`
+	CreatedAt       time.Time  `db:"created_at"`
+	ExpiresAt       time.Time  `db:"expires_at"`
+	SettledAt       *time.Time `db:"settled_at"`
+}
+
+const GAMEFIELDS = `
+  id, kind, creator_id, coalesce(receiver_id, 0) AS receiver_id, amount,
+  nparticipants, status, chat_id, message_id, inline_message_id,
+  coalesce(winner_id, 0) AS winner_id, members_only, seed, seed_hash,
+  coalesce(draw_height, 0) AS draw_height, coalesce(draw_block, '') AS draw_block,
+  created_at, expires_at, settled_at
+`
+
+// createGame saves a new game. when creatorJoins, the creator is the first
+// participant of a coinflip or fundraise, which holds their stake. receiverId
+// is who gets a fundraise, or the only one who can claim a giveaway.
+// membersOnly restricts joining to members of the chat the game is sent to.
+func createGame(
+	kind string,
+	creator User,
+	receiverId int,
+	sats int,
+	nparticipants int,
+	creatorJoins bool,
+	membersOnly bool,
+) (g Game, errMsg string, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return g, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	var vreceiver interface{}
+	if receiverId != 0 {
+		vreceiver = receiverId
+	}
+
+	seed, err := newGameSeed()
+	if err != nil {
+		return g, "Failed to generate a random seed.", err
+	}
+
+	err = txn.Get(&g, `
+INSERT INTO telegram.game
+  (kind, creator_id, receiver_id, amount, nparticipants, members_only, seed, seed_hash, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now() + make_interval(secs => $9))
+RETURNING `+GAMEFIELDS,
+		kind, creator.Id, vreceiver, sats, nparticipants, membersOnly, seed, hashSeed(seed),
+		s.GiveAwayTimeout.Seconds())
+	if err != nil {
+		return g, "Database error.", err
+	}
+
+	if creatorJoins && g.hasStakes() {
+		errMsg, err = g.addParticipant(txn, creator)
+		if err != nil {
+			return
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return g, "Database error.", err
+	}
+	return g, "", nil
+}
+
+// hasStakes tells if participants pay to join, in which case their stake is
+// held from the moment they join until the game is settled, canceled or expired.
+func (g Game) hasStakes() bool {
+	return g.Kind == "coinflip" || g.Kind == "fundraise"
+}
+
+// hasDraw tells if the winner is drawn among the participants.
+func (g Game) hasDraw() bool {
+	return g.Kind == "giveflip" || g.Kind == "coinflip"
+}
+
+// share is what the nth claimer of a giveaway gets. the amount is split
+// equally and the last one gets the remainder.
+func (g Game) share(n int) int {
+	each := g.Amount / g.NParticipants
+	if n == g.NParticipants {
+		return g.Amount - each*(g.NParticipants-1)
+	}
+	return each
+}
+
+func (g Game) addParticipant(txn *sqlx.Tx, u User) (errMsg string, err error) {
+	res, err := txn.Exec(`
+INSERT INTO telegram.game_participant (game_id, account_id) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+    `, g.Id, u.Id)
+	if err != nil {
+		return "Database error.", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "You're already in.", errors.New("already joined")
+	}
+
+	if !g.hasStakes() {
+		return "", nil
+	}
+
+	holdId := fmt.Sprintf("game:%d:%d", g.Id, u.Id)
+	_, errMsg, err = holdFunds(txn, holdId, u, g.ReceiverId, g.Amount*1000,
+		fmt.Sprintf("%s #%d", g.Kind, g.Id), 0)
+	if err != nil {
+		return
+	}
+
+	_, err = txn.Exec(`
+UPDATE telegram.game_participant SET hold_id = $3
+WHERE game_id = $1 AND account_id = $2
+    `, g.Id, u.Id, holdId)
+	if err != nil {
+		return "Database error.", err
+	}
+	return "", nil
+}
+
+type GameStake struct {
+	AccountId int            `db:"account_id"`
+	HoldId    sql.NullString `db:"hold_id"`
+}
+
+func (g Game) stakes(txn *sqlx.Tx) (stakes []GameStake, err error) {
+	err = txn.Select(&stakes, `
+SELECT account_id, hold_id FROM telegram.game_participant
+WHERE game_id = $1
+ORDER BY joined_at, account_id
+    `, g.Id)
+	return
+}
+
+func loadGame(id int) (g Game, err error) {
+	err = pg.Get(&g, `SELECT `+GAMEFIELDS+` FROM telegram.game WHERE id = $1`, id)
+	return
+}
+
+// sendGame posts the game message on a chat.
+func (g Game) sendGame(chatId int64) (err error) {
+	chattable := tgbotapi.NewMessage(chatId, g.render())
+	chattable.BaseChat.ReplyMarkup = g.keyboard()
+	message, err := bot.Send(chattable)
+	if err != nil {
+		return
+	}
+
+	_, err = pg.Exec(`
+UPDATE telegram.game SET chat_id = $2, message_id = $3 WHERE id = $1
+    `, g.Id, chatId, message.MessageID)
+	return
+}
+
+func (g Game) participants() (participants []User) {
+	var ids []int
+	pg.Select(&ids, `
+SELECT account_id FROM telegram.game_participant
+WHERE game_id = $1
+ORDER BY joined_at, account_id
+    `, g.Id)
+
+	participants = make([]User, 0, len(ids))
+	for _, id := range ids {
+		u, err := loadUser(id, 0)
+		if err != nil {
+			continue
+		}
+		participants = append(participants, u)
+	}
+	return
+}
+
+func (g Game) keyboard() tgbotapi.InlineKeyboardMarkup {
+	return gameKeyboard(g.Kind,
+		fmt.Sprintf("game=cancel-%d", g.Id), fmt.Sprintf("game=join-%d", g.Id))
+}
+
+func gameKeyboard(kind, cancelData, joinData string) tgbotapi.InlineKeyboardMarkup {
+	label := map[string]string{
+		"giveaway":  "Claim!",
+		"giveflip":  "Try to win!",
+		"coinflip":  "Join lottery",
+		"fundraise": "Contribute",
+	}[kind]
+
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Cancel", cancelData),
+			tgbotapi.NewInlineKeyboardButtonData(label, joinData),
+		),
+	)
+}
+
+// games on inline queries are only offered, with their parameters in the
+// buttons, and created once the message is posted, so it's known which inline
+// message to edit when they end. that happens when telegram reports the
+// chosen result or on the first click, whichever comes first.
+func inlineGameData(kind string, creator User, sats int, nparticipants int) string {
+	return fmt.Sprintf("%s-%d-%d-%d", kind, creator.Id, sats, nparticipants)
+}
+
+// parseInlineGameData reads the parameters of an offered game into an
+// unsaved Game.
+func parseInlineGameData(data string) (g Game, err error) {
+	_, err = fmt.Sscanf(strings.Replace(data, "-", " ", -1), "%s %d %d %d",
+		&g.Kind, &g.CreatorId, &g.Amount, &g.NParticipants)
+	g.Status = "open"
+	return
+}
+
+func inlineGameOffer(data string) (text string, keyboard tgbotapi.InlineKeyboardMarkup, err error) {
+	g, err := parseInlineGameData(data)
+	if err != nil {
+		return
+	}
+
+	return g.render(), gameKeyboard(g.Kind, "newgame=cancel-"+data, "newgame=join-"+data), nil
+}
+
+// inlineGame returns the game posted on an inline message, creating it from
+// the offered parameters the first time.
+func inlineGame(inlineMessageId string, data string) (g Game, errMsg string, err error) {
+	offer, err := parseInlineGameData(data)
+	if err != nil {
+		return g, "Invalid game.", err
+	}
+
+	// the chosen result and the first click may arrive together
+	if !rds.SetNX("inlinegame:"+inlineMessageId, data, s.GiveAwayTimeout).Val() {
+		err = pg.Get(&g, `
+SELECT `+GAMEFIELDS+` FROM telegram.game WHERE inline_message_id = $1
+        `, inlineMessageId)
+		if err != nil {
+			return g, "This " + offer.Kind + " isn't ready yet.", err
+		}
+		return g, "", nil
+	}
+
+	creator, err := loadUser(offer.CreatorId, 0)
+	if err != nil {
+		return g, "Database error.", err
+	}
+
+	g, errMsg, err = createGame(offer.Kind, creator, 0, offer.Amount, offer.NParticipants, true, false)
+	if err != nil {
+		bot.Send(tgbotapi.EditMessageTextConfig{
+			BaseEdit: tgbotapi.BaseEdit{InlineMessageID: inlineMessageId},
+			Text:     "This " + offer.Kind + " couldn't be started: " + errMsg,
+		})
+		return
+	}
+
+	g.InlineMessageId = inlineMessageId
+	_, err = pg.Exec(`
+UPDATE telegram.game SET inline_message_id = $2 WHERE id = $1
+    `, g.Id, inlineMessageId)
+	if err != nil {
+		return g, "Database error.", err
+	}
+
+	g.refresh()
+	return g, "", nil
+}
+
+func (g Game) render() string {
+	creator, _ := loadUser(g.CreatorId, 0)
+	participants := g.participants()
+	names := make([]string, len(participants))
+	for i, p := range participants {
+		names[i] = p.AtName()
+	}
+
+	var winner User
+	if g.WinnerId != 0 {
+		winner, _ = loadUser(g.WinnerId, 0)
+	}
+
+	var howtoclaimmessage = ""
+	if g.WinnerId != 0 && winner.ChatId == 0 {
+		howtoclaimmessage = " To manage your funds, start a conversation with @" + s.ServiceId + "."
+	}
+
+	var text string
+	switch g.Kind {
+	case "giveaway":
+		if g.Status == "settled" {
+			if g.NParticipants > 1 {
+				howtoclaimmessage = ""
+				for _, p := range participants {
+					if p.ChatId == 0 {
+						howtoclaimmessage = " To manage your funds, start a conversation with @" + s.ServiceId + "."
+					}
+				}
+			}
+			return fmt.Sprintf("%d sat given from %s to %s.",
+				g.Amount, creator.AtName(), listAnd(names)) + howtoclaimmessage
+		}
+
+		switch {
+		case g.ReceiverId != 0:
+			target, _ := loadUser(g.ReceiverId, 0)
+			text = fmt.Sprintf("%s is giving %d sat away to %s!",
+				creator.AtName(), g.Amount, target.AtName())
+		case g.NParticipants > 1:
+			text = fmt.Sprintf("%s is giving %d sat away to the first %d people, %d each!",
+				creator.AtName(), g.Amount, g.NParticipants, g.Amount/g.NParticipants)
+			if len(names) > 0 {
+				text += fmt.Sprintf("\nClaimed (%d/%d): %s",
+					len(names), g.NParticipants, strings.Join(names, " "))
+			}
+		default:
+			text = fmt.Sprintf("%s is giving %d sat away!", creator.AtName(), g.Amount)
+		}
+		if g.MembersOnly && g.Status == "open" {
+			text += "\nOnly members of this group can claim."
+		}
+	case "giveflip":
+		if g.Status == "settled" {
+			var loserNames []string
+			for _, p := range participants {
+				if p.Id != g.WinnerId {
+					loserNames = append(loserNames, p.AtName())
+				}
+			}
+			return fmt.Sprintf("%s got %d from %s. %s didn't get anything.",
+				winner.AtName(), g.Amount, creator.AtName(), listAnd(loserNames)) +
+				howtoclaimmessage + "\n\n" + g.renderDraw()
+		}
+		text = fmt.Sprintf("%s is giving %d sat away to a lucky person out of %d!",
+			creator.AtName(), g.Amount, g.NParticipants)
+		if len(names) > 0 {
+			text += " " + strings.Join(names, " ") + "?"
+		}
+	case "coinflip":
+		text = fmt.Sprintf(`A lottery round is starting!
+
+Entry fee: %d sat
+Total participants: %d
+Prize: %d
+Registered: %s`, g.Amount, g.NParticipants, g.Amount*g.NParticipants, strings.Join(names, " "))
+		if g.Status == "settled" {
+			text += "\nWinner: " + winner.AtName()
+		}
+	case "fundraise":
+		receiver, _ := loadUser(g.ReceiverId, 0)
+		text = fmt.Sprintf(`A fundraising to %s was started!
+
+Contributors needed for completion: %d
+Each pays: %d sat
+Final amount: %d
+Have contributed: %s`, receiver.AtName(), g.NParticipants, g.Amount,
+			g.Amount*g.NParticipants, strings.Join(names, " "))
+		if g.Status == "settled" {
+			text += "\nCompleted!"
+		}
+	}
+
+	switch g.Status {
+	case "canceled":
+		text += "\n\nCanceled."
+	case "expired":
+		text += "\n\nExpired."
+	}
+
+	if g.hasDraw() {
+		text += "\n\n" + g.renderDraw()
+	}
+	return text
+}
+
+func (g Game) renderDraw() string {
+	switch g.Status {
+	case "filled":
+		return fmt.Sprintf("Drawing with block %d as soon as it is mined. Seed hash: %s",
+			g.DrawHeight, g.SeedHash)
+	case "settled":
+		return fmt.Sprintf("Drawn with block %d. Seed: %s. Check it with /verify %d.",
+			g.DrawHeight, g.Seed, g.Id)
+	default:
+		return fmt.Sprintf("Game #%d. Seed hash: %s", g.Id, g.SeedHash)
+	}
+}
+
+// refresh edits the game message to reflect its current state.
+func (g Game) refresh() {
+	baseEdit := tgbotapi.BaseEdit{InlineMessageID: g.InlineMessageId}
+	if g.InlineMessageId == "" {
+		if g.MessageId == 0 {
+			// never posted
+			return
+		}
+		baseEdit.ChatID = g.ChatId
+		baseEdit.MessageID = g.MessageId
+	}
+
+	if g.Status == "open" {
+		keyboard := g.keyboard()
+		baseEdit.ReplyMarkup = &keyboard
+	}
+
+	bot.Send(tgbotapi.EditMessageTextConfig{BaseEdit: baseEdit, Text: g.render()})
+}
+
+// joinGame adds a participant atomically and marks the game as filled when
+// it was the last spot. the stake is held in the same serializable
+// transaction, so when people join at the same time the losers are retried.
+func joinGame(gameId int, joiner User) (g Game, errMsg string, err error) {
+	// asking telegram takes a while, do it before the transaction
+	g, err = loadGame(gameId)
+	if err == sql.ErrNoRows {
+		return g, "This game is over.", err
+	} else if err != nil {
+		return g, "Database error.", err
+	}
+	if g.MembersOnly && g.ChatId != 0 {
+		member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{
+			ChatID: g.ChatId,
+			UserID: joiner.TelegramId,
+		})
+		if err != nil || member.HasLeft() || member.WasKicked() {
+			return g, "Only members of this group can join.", errors.New("not a member")
+		}
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		g, errMsg, err = tryJoinGame(gameId, joiner)
+		if pqerr, ok := err.(*pq.Error); !ok || pqerr.Code != "40001" {
+			return
+		}
+	}
+	return
+}
+
+func tryJoinGame(gameId int, joiner User) (g Game, errMsg string, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return g, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&g, `
+SELECT `+GAMEFIELDS+` FROM telegram.game
+WHERE id = $1 AND status = 'open' AND expires_at > now()
+    `, gameId)
+	if err == sql.ErrNoRows {
+		return g, "This game is over.", err
+	} else if err != nil {
+		return g, "Database error.", err
+	}
+
+	if (g.Kind == "giveaway" || g.Kind == "giveflip") && joiner.Id == g.CreatorId {
+		return g, "Can't join your own " + g.Kind + ".", errors.New("creator joining")
+	}
+	if g.Kind == "giveaway" && g.ReceiverId != 0 && joiner.Id != g.ReceiverId {
+		target, _ := loadUser(g.ReceiverId, 0)
+		return g, "This giveaway is for " + target.AtName() + " only.", errors.New("not the target")
+	}
+
+	errMsg, err = g.addParticipant(txn, joiner)
+	if err != nil {
+		return
+	}
+
+	var count int
+	err = txn.Get(&count, `
+SELECT count(*) FROM telegram.game_participant WHERE game_id = $1
+    `, g.Id)
+	if err != nil {
+		return g, "Database error.", err
+	}
+
+	// giveaways pay each claimer right away
+	var claimed InternalTransfer
+	if g.Kind == "giveaway" {
+		claimed, errMsg, err = g.payClaimer(txn, joiner, g.share(count))
+		if err != nil {
+			return
+		}
+	}
+
+	if count >= g.NParticipants {
+		g.Status = "filled"
+		if g.hasDraw() {
+			// the winner comes from the next block, which nobody knows yet
+			var height int
+			height, err = currentBlockHeight()
+			if err != nil {
+				return g, "Failed to reach the Bitcoin network.", err
+			}
+			g.DrawHeight = height + 1
+		}
+
+		var vheight interface{}
+		if g.DrawHeight != 0 {
+			vheight = g.DrawHeight
+		}
+
+		_, err = txn.Exec(`
+UPDATE telegram.game SET status = 'filled', draw_height = $2 WHERE id = $1
+    `, g.Id, vheight)
+		if err != nil {
+			return g, "Database error.", err
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return g, "Database error.", err
+	}
+
+	if g.Kind == "giveaway" {
+		publish(claimed)
+	}
+
+	return g, "", nil
+}
+
+func (g Game) payClaimer(txn *sqlx.Tx, claimer User, sats int) (
+	event InternalTransfer, errMsg string, err error,
+) {
+	creator, _ := loadUser(g.CreatorId, 0)
+
+	var hash string
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, trigger_message, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING payment_hash
+    `, creator.Id, claimer.Id, sats*1000, g.Kind, g.MessageId, nullChat(g.ChatId))
+	if err != nil {
+		return event, "Database error.", err
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, creator.Id)
+	if err != nil {
+		return event, "Database error.", err
+	}
+	if balance < 0 {
+		return event, creator.AtName() + " doesn't have enough balance for this giveaway anymore.",
+			errors.New("insufficient balance")
+	}
+
+	return InternalTransfer{
+		From:           creator,
+		To:             claimer,
+		Msats:          sats * 1000,
+		Hash:           hash,
+		Description:    g.Kind,
+		ReceiverNotice: fmt.Sprintf("%s has sent you %d sat.", creator.AtName(), sats),
+	}, "", nil
+}
+
+// settleGame moves the money of a filled game and marks it as settled, in
+// the same transaction. games with stakes can't fail here as the money is
+// already held, giveflips may fail if the creator has spent their balance,
+// in which case the game is canceled. giveaways were paid on each claim and
+// are just marked as settled. games with a draw are
+// left alone until their block is mined.
+func settleGame(g Game) (err error) {
+	participants := g.participants()
+	if len(participants) == 0 {
+		return errors.New("no participants")
+	}
+
+	var winner User
+	var blockHash string
+	switch g.Kind {
+	case "giveaway":
+		winner = participants[0]
+	case "giveflip", "coinflip":
+		blockHash, err = blockHashAt(g.DrawHeight)
+		if err != nil || blockHash == "" {
+			if time.Since(g.ExpiresAt) > time.Hour*24 {
+				// something is wrong with our bitcoin backend, give up
+				log.Warn().Err(err).Int("game", g.Id).Int("height", g.DrawHeight).
+					Msg("draw block not found for too long")
+				closeGame(g.Id, 0, "filled", "canceled")
+				return errors.New("draw block not found")
+			}
+
+			// not mined yet, settleFilledGames will try again
+			return nil
+		}
+
+		ids := make([]int, len(participants))
+		for i, p := range participants {
+			ids[i] = p.Id
+		}
+		winner, _ = loadUser(drawWinner(g.Seed, blockHash, ids), 0)
+	case "fundraise":
+		winner, _ = loadUser(g.ReceiverId, 0)
+	}
+
+	var vblock interface{}
+	if blockHash != "" {
+		vblock = blockHash
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&g, `
+UPDATE telegram.game
+SET status = 'settled', winner_id = $2, draw_block = $3, settled_at = now()
+WHERE id = $1 AND status = 'filled'
+RETURNING `+GAMEFIELDS,
+		g.Id, winner.Id, vblock)
+	if err != nil {
+		// already settled
+		return
+	}
+
+	creator, _ := loadUser(g.CreatorId, 0)
+	var events []interface{}
+
+	switch g.Kind {
+	case "giveaway":
+		// the claimers were already paid on joinGame
+	case "giveflip":
+		var hash string
+		err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, trigger_message, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING payment_hash
+        `, creator.Id, winner.Id, g.Amount*1000, g.Kind, g.MessageId, nullChat(g.ChatId))
+		if err != nil {
+			break
+		}
+
+		var balance int64
+		err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+        `, creator.Id)
+		if err != nil {
+			break
+		}
+		if balance < 0 {
+			err = errors.New("insufficient balance")
+			break
+		}
+
+		notice := fmt.Sprintf("%s has sent you %d sat on a /giveflip.", creator.AtName(), g.Amount)
+		events = append(events, InternalTransfer{
+			From:           creator,
+			To:             winner,
+			Msats:          g.Amount * 1000,
+			Hash:           hash,
+			Description:    g.Kind,
+			ReceiverNotice: notice,
+		})
+	case "coinflip", "fundraise":
+		var stakes []GameStake
+		stakes, err = g.stakes(txn)
+		if err != nil {
+			break
+		}
+
+		pooled := PooledTransfer{To: winner}
+		var giverNames []string
+		for _, stake := range stakes {
+			if !stake.HoldId.Valid {
+				continue
+			}
+			if stake.AccountId == winner.Id {
+				// the coinflip winner just gets their own stake back
+				_, err = releaseHold(txn, stake.HoldId.String, "won")
+				if err != nil {
+					break
+				}
+				continue
+			}
+
+			var hold Hold
+			hold, err = captureHold(txn, stake.HoldId.String, winner.Id, g.Kind+" settled")
+			if err != nil {
+				break
+			}
+			_, err = txn.Exec(`
+UPDATE lightning.transaction SET chat_id = $2 WHERE hold_id = $1
+            `, stake.HoldId.String, nullChat(g.ChatId))
+			if err != nil {
+				break
+			}
+
+			giver, _ := loadUser(stake.AccountId, 0)
+			giverNames = append(giverNames, giver.AtName())
+
+			senderNotice := fmt.Sprintf("You've lost %d in a coinflip. The winner was %s.",
+				g.Amount, winner.AtName())
+			if g.Kind == "fundraise" {
+				senderNotice = fmt.Sprintf("You've given %d in a fundraise to %s.",
+					g.Amount, winner.AtName())
+			}
+			pooled.Transfers = append(pooled.Transfers, InternalTransfer{
+				From:         giver,
+				To:           winner,
+				Msats:        hold.Msats,
+				Hash:         hold.Hash,
+				Description:  hold.Description,
+				SenderNotice: senderNotice,
+			})
+		}
+		if err != nil {
+			break
+		}
+
+		pooled.ReceiverNotice = fmt.Sprintf(
+			"You're the winner of a coinflip for a prize of %d sat. The losers were: %s",
+			g.Amount*len(stakes), strings.Join(giverNames, " "))
+		if g.Kind == "fundraise" {
+			pooled.ReceiverNotice = fmt.Sprintf("You've received %d sat of a fundraise from %s",
+				g.Amount*len(pooled.Transfers), strings.Join(giverNames, " "))
+		}
+		events = append(events, pooled)
+	}
+
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		txn.Rollback()
+		log.Warn().Err(err).Int("game", g.Id).Str("kind", g.Kind).Msg("failed to settle game")
+		creator.notify(fmt.Sprintf("Your %s of %d sat couldn't be completed and was canceled.",
+			g.Kind, g.Amount))
+		closeGame(g.Id, 0, "filled", "canceled")
+		return
+	}
+
+	for _, event := range events {
+		publish(event)
+	}
+	g.refresh()
+
+	if g.MessageId != 0 {
+		switch g.Kind {
+		case "coinflip":
+			notifyAsReply(g.ChatId, "Coinflip winner: "+winner.AtName(), g.MessageId)
+		case "fundraise":
+			notifyAsReply(g.ChatId, "Fundraising for "+winner.AtName()+" completed!", g.MessageId)
+		}
+	}
+	return
+}
+
+// closeGame moves a game from the "from" status to "canceled" or "expired"
+// and gives back all the stakes. creatorId, if not 0, must match the creator.
+func closeGame(gameId int, creatorId int, from string, status string) (g Game, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&g, `
+UPDATE telegram.game SET status = $4
+WHERE id = $1 AND ($2 = 0 OR creator_id = $2) AND status = $3
+RETURNING `+GAMEFIELDS,
+		gameId, creatorId, from, status)
+	if err != nil {
+		return
+	}
+
+	stakes, err := g.stakes(txn)
+	if err != nil {
+		return
+	}
+
+	var refunded []int
+	for _, stake := range stakes {
+		if !stake.HoldId.Valid {
+			continue
+		}
+		_, err = releaseHold(txn, stake.HoldId.String, status)
+		if err != nil {
+			return
+		}
+		refunded = append(refunded, stake.AccountId)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return
+	}
+
+	for _, id := range refunded {
+		if id == creatorId {
+			continue
+		}
+		participant, _ := loadUser(id, 0)
+		participant.notify(fmt.Sprintf("The %s #%d was %s, your %d sat are back in your balance.",
+			g.Kind, g.Id, status, g.Amount))
+	}
+
+	g.refresh()
+	return
+}
+
+func cancelGame(gameId int, u User) (g Game, err error) {
+	return closeGame(gameId, u.Id, "open", "canceled")
+}
+
+func expireGames() {
+	var ids []int
+	err := pg.Select(&ids, `
+SELECT id FROM telegram.game WHERE status = 'open' AND expires_at < now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load expired games")
+		return
+	}
+
+	for _, id := range ids {
+		_, err := closeGame(id, 0, "open", "expired")
+		if err != nil {
+			log.Warn().Err(err).Int("game", id).Msg("failed to expire game")
+		}
+	}
+}
+
+// settleFilledGames settles games that were filled but not settled, like
+// when the bot was restarted in between.
+func settleFilledGames() {
+	var games []Game
+	err := pg.Select(&games, `
+SELECT `+GAMEFIELDS+` FROM telegram.game WHERE status = 'filled'
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load filled games")
+		return
+	}
+
+	for _, g := range games {
+		settleGame(g)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"strings"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
@@ -28,6 +27,8 @@ func handle(upd tgbotapi.Update) {
 		handleCallback(upd.CallbackQuery)
 	} else if upd.InlineQuery != nil {
 		handleInlineQuery(upd.InlineQuery)
+	} else if upd.ChosenInlineResult != nil {
+		handleChosenInlineResult(upd.ChosenInlineResult)
 	} else if upd.EditedMessage != nil {
 		handleEditedMessage(upd.EditedMessage)
 	}
@@ -65,7 +66,7 @@ func handleInvoicePaid(payindex, msats int64, desc, hash, label string) {
 	} else {
 		// could be a ticket invoice
 		if strings.HasPrefix(label, "newmember:") {
-			receiver, err = chatOwnerFromTicketLabel(label)
+			receiver, err = ticketReceiverFromLabel(label)
 			if err != nil {
 				return
 			}
@@ -93,5 +94,26 @@ func handleInvoicePaid(payindex, msats int64, desc, hash, label string) {
 		return
 	}
 
-	receiver.notifyAsReply(fmt.Sprintf("Payment received: %d. /tx%s.", msats/1000, hash[:5]), messageId)
+	err = markInvoicePaid(hash, msats)
+	if err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("failed to mark invoice as paid.")
+	}
+
+	publish(InvoicePaid{
+		Receiver:    receiver,
+		MessageId:   messageId,
+		Msats:       msats,
+		Description: desc,
+		Hash:        hash,
+		Label:       label,
+	})
+
+	if strings.HasPrefix(label, "newmember:") {
+		publish(TicketPaid{
+			Owner: receiver,
+			Label: label,
+			Msats: msats,
+			Hash:  hash,
+		})
+	}
 }
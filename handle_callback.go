@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -75,508 +74,363 @@ func handleCallback(cb *tgbotapi.CallbackQuery) {
 		}
 		removeKeyboardButtons(cb)
 		return
-	case strings.HasPrefix(cb.Data, "give="):
-		params := strings.Split(cb.Data[5:], "-")
-		if len(params) != 3 {
+	case strings.HasPrefix(cb.Data, "ticket=approve-"):
+		if cb.Message == nil {
 			goto answerEmpty
 		}
-
-		buttonData := rds.Get("giveaway:" + params[2]).Val()
-		if buttonData != cb.Data {
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "Giveaway expired.")
-			goto answerEmpty
-		}
-		if err = rds.Del("giveaway:" + params[2]).Err(); err != nil {
-			log.Warn().Err(err).Str("id", params[2]).
-				Msg("error deleting giveaway check from redis")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "Giveaway error.")
-			goto answerEmpty
+		if !isChatAdmin(cb.Message.Chat.ID, cb.From.ID) {
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "Only admins can approve."))
+			return
 		}
 
-		fromid, err1 := strconv.Atoi(params[0])
-		sats, err2 := strconv.Atoi(params[1])
-		if err1 != nil || err2 != nil {
-			goto answerEmpty
+		label := fmt.Sprintf("newmember:%s:%d", cb.Data[15:], cb.Message.Chat.ID)
+		if err := ticketApproved(label, u); err != nil {
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "Not waiting for a ticket anymore."))
+			return
 		}
-
-		u, err := loadUser(fromid, 0)
-		if err != nil {
-			log.Warn().Err(err).
-				Int("id", fromid).
-				Msg("failed to load user")
+		goto answerEmpty
+	case strings.HasPrefix(cb.Data, "treasury="):
+		params := strings.Split(cb.Data[9:], "-")
+		if len(params) != 2 || cb.Message == nil {
 			goto answerEmpty
 		}
-
-		claimer, t, err := ensureUser(cb.From.ID, cb.From.UserName)
+		proposalId, err := strconv.Atoi(params[1])
 		if err != nil {
-			log.Warn().Err(err).Int("case", t).
-				Str("username", cb.From.UserName).Int("tgid", cb.From.ID).
-				Msg("failed to ensure claimer user on giveaway.")
 			goto answerEmpty
 		}
 
-		errMsg, err := u.sendInternally(messageId, claimer, false, sats*1000, "giveaway", nil)
-		if err != nil {
-			log.Warn().Err(err).Msg("failed to give away")
-			claimer.notify("Failed to claim giveaway: " + errMsg)
-			goto answerEmpty
+		if !isChatAdmin(cb.Message.Chat.ID, cb.From.ID) {
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "Only admins can decide."))
+			return
 		}
-		bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "Payment sent."))
-		removeKeyboardButtons(cb)
-		claimer.notify(fmt.Sprintf("%s has sent you %d sat.", u.AtName(), sats))
 
-		var howtoclaimmessage = ""
-		if claimer.ChatId == 0 {
-			howtoclaimmessage = " To manage your funds, start a conversation with @" + s.ServiceId + "."
+		switch params[0] {
+		case "approve":
+			_, errMsg, err := approveTreasuryProposal(cb.Message.Chat.ID, proposalId, u)
+			if err != nil {
+				log.Debug().Err(err).Int("proposal", proposalId).Str("user", u.Username).
+					Msg("failed to approve treasury proposal")
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
+			}
+		case "reject":
+			_, err := rejectTreasuryProposal(cb.Message.Chat.ID, proposalId)
+			if err != nil {
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "This proposal is closed."))
+				return
+			}
 		}
+		goto answerEmpty
+	case strings.HasPrefix(cb.Data, "give="), strings.HasPrefix(cb.Data, "flip="),
+		strings.HasPrefix(cb.Data, "gifl="), strings.HasPrefix(cb.Data, "raise="):
+		// buttons of games from before they were kept in the database
+		kind := map[string]string{
+			"give":  "giveaway",
+			"flip":  "coinflip",
+			"gifl":  "giveflip",
+			"raise": "fundraise",
+		}[strings.SplitN(cb.Data, "=", 2)[0]]
+		params := strings.Split(cb.Data, "-")
+		rds.Del(kind + ":" + params[len(params)-1])
 
-		appendTextToMessage(cb,
-			fmt.Sprintf(
-				"%d sat given from %s to %s.", sats, u.AtName(), claimer.AtName(),
-			)+howtoclaimmessage,
-		)
+		removeKeyboardButtons(cb)
+		appendTextToMessage(cb, "\n\nThis "+kind+" has expired.")
+		bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "This "+kind+" has expired."))
 		return
-	case strings.HasPrefix(cb.Data, "flip="):
-		// join a new participant in a coinflip lottery
-		// if the total of participants is reached run the coinflip
-		params := strings.Split(cb.Data[5:], "-")
-		if len(params) != 3 {
-			goto answerEmpty
+	case strings.HasPrefix(cb.Data, "game="), strings.HasPrefix(cb.Data, "newgame="):
+		var action string
+		var gameId int
+		if strings.HasPrefix(cb.Data, "newgame=") {
+			// offered on an inline query, clicked before it was created
+			params := strings.SplitN(cb.Data[8:], "-", 2)
+			if len(params) != 2 || cb.InlineMessageID == "" {
+				goto answerEmpty
+			}
+			g, errMsg, err := inlineGame(cb.InlineMessageID, params[1])
+			if err != nil {
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
+			}
+			action, gameId = params[0], g.Id
+		} else {
+			params := strings.Split(cb.Data[5:], "-")
+			if len(params) != 2 {
+				goto answerEmpty
+			}
+			id, err := strconv.Atoi(params[1])
+			if err != nil {
+				goto answerEmpty
+			}
+			action, gameId = params[0], id
 		}
 
-		coinflipid := params[2]
-		rkey := "coinflip:" + coinflipid
+		switch action {
+		case "join":
+			g, errMsg, err := joinGame(gameId, u)
+			if err != nil {
+				log.Debug().Err(err).Int("game", gameId).Str("user", u.Username).
+					Msg("failed to join game")
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
+			}
 
-		nregistered := int(rds.SCard(rkey).Val())
-		if nregistered == 0 {
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nCoinflip expired.")
-			goto answerEmpty
+			g.refresh()
+			if g.Status == "filled" {
+				settleGame(g)
+			}
+		case "cancel":
+			_, err := cancelGame(gameId, u)
+			if err != nil {
+				goto answerEmpty
+			}
 		}
-
-		nparticipants, err1 := strconv.Atoi(params[0])
-		sats, err2 := strconv.Atoi(params[1])
-		if err1 != nil || err2 != nil {
-			log.Warn().Err(err1).Err(err2).Msg("coinflip error")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nCoinflip error.")
-			goto answerEmpty
+	case strings.HasPrefix(cb.Data, "remunc="):
+		// remove unclaimed transaction
+		// when you tip an invalid account or an account that has never talked with the bot
+		hash := cb.Data[7:]
+		_, err := pg.Exec(`
+DELETE FROM lightning.transaction AS tx
+WHERE substring(payment_hash from 0 for $2) = $1
+  AND is_unclaimed(tx)
+        `, hash, len(hash)+1)
+		if err != nil {
+			log.Error().Err(err).Str("hash", hash).Msg("failed to remove pending payment")
+			appendTextToMessage(cb, "Error.")
+			return
 		}
-
-		joiner, t, err := ensureUser(cb.From.ID, cb.From.UserName)
+		appendTextToMessage(cb, "Transaction canceled.")
+	case strings.HasPrefix(cb.Data, "reveal="):
+		// locate hidden message with the key given in the callback data,
+		// perform payment between users,
+		// reveal message.
+		hiddenkey := cb.Data[7:]
+		content, errMsg, err := revealHiddenMessage(u, messageId, hiddenkey)
 		if err != nil {
-			log.Warn().Err(err).Int("case", t).
-				Str("username", cb.From.UserName).Int("tgid", cb.From.ID).
-				Msg("failed to ensure joiner user on coinflip.")
+			log.Warn().Err(err).Str("key", hiddenkey).Msg("error revealing hidden message")
 			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nCoinflip error.")
+			appendTextToMessage(cb, errMsg)
 			goto answerEmpty
 		}
 
-		if !joiner.checkBalanceFor(sats, "coinflip") {
-			goto answerEmpty
+		// actually reveal
+		if messageId != 0 {
+			removeKeyboardButtons(cb)
+			u.notifyAsReply(content, messageId)
+		} else {
+			baseEdit := getBaseEdit(cb)
+			bot.Send(tgbotapi.EditMessageTextConfig{
+				BaseEdit: baseEdit,
+				Text:     content,
+			})
 		}
-
-		if isMember, err := rds.SIsMember(rkey, joiner.Id).Result(); err != nil || isMember {
-			// can't join twice
+	case strings.HasPrefix(cb.Data, "preq="):
+		parts := strings.Split(cb.Data[5:], "-")
+		if len(parts) != 2 {
 			goto answerEmpty
 		}
-
-		if err := rds.SAdd("coinflip:"+coinflipid, joiner.Id).Err(); err != nil {
-			log.Warn().Err(err).Str("coinflip", coinflipid).Msg("error adding participant to coinflip.")
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
 			goto answerEmpty
 		}
 
-		if nregistered+1 < nparticipants {
-			// append @user to the coinflip message (without removing the keyboard)
-			baseEdit := getBaseEdit(cb)
-			keyboard := coinflipKeyboard(coinflipid, nparticipants, sats)
-			baseEdit.ReplyMarkup = &keyboard
-			edit := tgbotapi.EditMessageTextConfig{BaseEdit: baseEdit}
-			if cb.Message != nil {
-				edit.Text = cb.Message.Text + " " + joiner.AtName()
-			} else {
-				edit.Text = fmt.Sprintf("Pay %d and get a chance to win %d! %d out of %d spots left!",
-					sats, sats*nparticipants, nparticipants-nregistered, nparticipants)
-			}
-			bot.Send(edit)
-		} else {
-			// run the lottery
-			// even if for some bug we registered more participants than we should
-			// we run the lottery with them all
-			sparticipants, err := rds.SMembers(rkey).Result()
-			go rds.Del(rkey)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed to get coinflip participants")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nCoinflip error.")
-				goto answerEmpty
-			}
-			swinnerId := sparticipants[rand.Intn(len(sparticipants))]
-
-			// winner id
-			winnerId, err := strconv.Atoi(swinnerId)
+		switch parts[0] {
+		case "pay":
+			req, errMsg, err := u.payPaymentRequest(id)
 			if err != nil {
-				log.Warn().Err(err).Str("winnerId", swinnerId).Msg("winner id is not an int")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nCoinflip error.")
-				goto answerEmpty
-			}
-
-			// all participants
-			participants := make([]int, nregistered+1)
-			for i, spart := range sparticipants {
-				part, err := strconv.Atoi(spart)
-				if err != nil {
-					log.Warn().Err(err).Str("part", spart).Msg("participant id is not an int")
-					removeKeyboardButtons(cb)
-					appendTextToMessage(cb, "\n\nCoinflip error.")
-					goto answerEmpty
-				}
-				participants[i] = part
+				log.Warn().Err(err).Int("request", id).Str("user", u.Username).
+					Msg("failed to pay payment request")
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
 			}
 
-			winner, err := fromManyToOne(sats, winnerId, participants, "coinflip",
-				"You're the winner of a coinflip for a prize of %[1]d sat. The losers were: %[2]s",
-				"You've lost %[1]d in a coinflip. The winner was %[2]s.")
+			removeKeyboardButtons(cb)
+			appendTextToMessage(cb, fmt.Sprintf("Paid %d sat.", req.Amount))
+		case "decline":
+			_, err := u.declinePaymentRequest(id)
 			if err != nil {
-				log.Warn().Err(err).Msg("error processing coinflip transactions")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nCoinflip error.")
-				goto answerEmpty
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "This request is not open anymore."))
+				return
 			}
 
 			removeKeyboardButtons(cb)
-			if cb.Message != nil {
-				appendTextToMessage(cb, joiner.AtName()+"\nWinner: "+winner.AtName())
-				notifyAsReply(
-					cb.Message.Chat.ID,
-					"Coinflip winner: "+winner.AtName(),
-					cb.Message.MessageID,
-				)
-			} else {
-				appendTextToMessage(cb, "Winner: "+winner.AtName())
-			}
+			appendTextToMessage(cb, "Declined.")
 		}
-	case strings.HasPrefix(cb.Data, "gifl="):
-		// join a new participant in a giveflip lottery
-		// if the total of participants is reached run the giveflip
-		params := strings.Split(cb.Data[5:], "-")
-		if len(params) != 4 {
+	case strings.HasPrefix(cb.Data, "split="):
+		splitId, err := strconv.Atoi(cb.Data[6:])
+		if err != nil {
 			goto answerEmpty
 		}
 
-		giverId, err0 := strconv.Atoi(params[0])
-		nparticipants, err1 := strconv.Atoi(params[1])
-		sats, err2 := strconv.Atoi(params[2])
-		if err0 != nil || err1 != nil || err2 != nil {
-			log.Warn().Err(err0).Err(err1).Err(err2).Msg("giveflip error")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nGiveflip error.")
+		_, errMsg, err := u.paySplitShare(splitId)
+		if err != nil {
+			log.Debug().Err(err).Int("split", splitId).Str("user", u.Username).
+				Msg("failed to pay split share")
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+			return
+		}
+	case strings.HasPrefix(cb.Data, "escrow="):
+		parts := strings.Split(cb.Data[7:], "-")
+		if len(parts) != 2 {
 			goto answerEmpty
 		}
-
-		giveflipid := params[3]
-		rkey := "giveflip:" + giveflipid
-
-		nregistered := int(rds.SCard(rkey).Val())
-
-		joiner, t, err := ensureUser(cb.From.ID, cb.From.UserName)
+		id, err := strconv.Atoi(parts[1])
 		if err != nil {
-			log.Warn().Err(err).Int("case", t).
-				Str("username", cb.From.UserName).Int("tgid", cb.From.ID).
-				Msg("failed to ensure joiner user on giveflip.")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nGiveflip error.")
 			goto answerEmpty
 		}
 
-		if joiner.Id == giverId {
-			// giver can't join
-			goto answerEmpty
+		_, errMsg, err := resolveEscrow(id, &u, parts[0] == "release")
+		if err != nil {
+			log.Debug().Err(err).Int("escrow", id).Str("user", u.Username).
+				Msg("failed to resolve escrow")
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+			return
 		}
-
-		if isMember, err := rds.SIsMember(rkey, joiner.Id).Result(); err != nil || isMember {
-			// can't join twice
+	case strings.HasPrefix(cb.Data, "inbox="):
+		parts := strings.Split(cb.Data[6:], "-")
+		if len(parts) != 2 {
 			goto answerEmpty
 		}
-
-		if err := rds.SAdd("giveflip:"+giveflipid, joiner.Id).Err(); err != nil {
-			log.Warn().Err(err).Str("giveflip", giveflipid).Msg("error adding participant to giveflip.")
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
 			goto answerEmpty
 		}
-		rds.Expire("giveflip:"+giveflipid, s.GiveAwayTimeout)
 
-		if nregistered+1 < nparticipants {
-			// append @user to the giveflip message (without removing the keyboard)
-			baseEdit := getBaseEdit(cb)
-			keyboard := giveflipKeyboard(giveflipid, giverId, nparticipants, sats)
-			baseEdit.ReplyMarkup = &keyboard
-			edit := tgbotapi.EditMessageTextConfig{BaseEdit: baseEdit}
-			if cb.Message != nil {
-				edit.Text = cb.Message.Text + " " + joiner.AtName() + "?"
-			} else {
-				edit.Text = fmt.Sprintf(
-					"Join and get a chance to win %d! %d out of %d spots left!",
-					sats, nparticipants-nregistered, nparticipants)
-			}
-			bot.Send(edit)
-		} else {
-			// even if for some bug we registered more participants than we should
-			// we run the lottery with them all
-			sparticipants, err := rds.SMembers(rkey).Result()
-			go rds.Del(rkey)
+		switch parts[0] {
+		case "reply":
+			errMsg, err := u.promptInboxReply(id)
 			if err != nil {
-				log.Warn().Err(err).Msg("failed to get giveflip participants")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nGiveflip error.")
-				goto answerEmpty
-			}
-			swinnerId := sparticipants[rand.Intn(len(sparticipants))]
-
-			// winner
-			winnerId, err := strconv.Atoi(swinnerId)
-			if err != nil {
-				log.Warn().Err(err).Str("winnerId", swinnerId).Msg("winner id is not an int")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nGiveflip error.")
-				goto answerEmpty
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
 			}
-			winner, err := loadUser(winnerId, 0)
+		case "refund":
+			msg, errMsg, err := u.refundInboxMessage(id)
 			if err != nil {
-				log.Warn().Err(err).Int("winnerId", winnerId).Msg("failed to load winner on giveflip")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nGiveflip error.")
-				goto answerEmpty
+				log.Debug().Err(err).Int("inbox", id).Str("user", u.Username).
+					Msg("failed to refund inbox message")
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
 			}
-
-			// giver
-			giver, err := loadUser(giverId, 0)
-			if err != nil {
-				log.Warn().Err(err).Int("giverId", giverId).Msg("failed to load giver on giveflip")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nGiveflip error.")
+			appendTextToMessage(cb, fmt.Sprintf("\n\nRefunded %d sat.", msg.Amount))
+		case "block":
+			msg, err := loadInboxMessage(id, u.Id)
+			if err != nil || msg.RecipientId != u.Id {
 				goto answerEmpty
 			}
-
-			// get loser names
-			var loserNames []string
-			for _, spart := range sparticipants {
-				partId, _ := strconv.Atoi(spart)
-				if partId == winnerId {
-					continue
-				}
-
-				loser, _ := loadUser(partId, 0)
-				loserNames = append(loserNames, loser.AtName())
-			}
-
-			errMsg, err := giver.sendInternally(messageId, winner, false, sats*1000, "giveflip", nil)
+			err = u.blockInboxSender(msg.SenderId)
 			if err != nil {
-				log.Warn().Err(err).Msg("failed to give flip")
-				winner.notify("Failed to claim complete giveflip lottery: " + errMsg)
+				log.Warn().Err(err).Str("user", u.Username).Msg("failed to block inbox sender")
 				goto answerEmpty
 			}
-			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "Payment sent."))
 			removeKeyboardButtons(cb)
-			winner.notify(fmt.Sprintf("%s has sent you %d sat on a /giveflip.", giver.AtName(), sats))
-
-			var howtoclaimmessage = ""
-			if winner.ChatId == 0 {
-				howtoclaimmessage = " To manage your funds, start a conversation with @" + s.ServiceId + "."
-			}
-
-			bot.Send(tgbotapi.EditMessageTextConfig{
-				BaseEdit: getBaseEdit(cb),
-				Text: fmt.Sprintf("%s got %d from %s. %s didn't get anything.",
-					winner.AtName(), sats, giver.AtName(), listAnd(loserNames)) + howtoclaimmessage,
-			})
+			appendTextToMessage(cb, "\n\nSender blocked, use /inbox unblock to undo.")
 		}
-
-		return
-	case strings.HasPrefix(cb.Data, "raise="):
-		// join a new giver in a fundraising event
-		// if the total of givers is reached commit the fundraise
-		params := strings.Split(cb.Data[6:], "-")
-		if len(params) != 4 {
+	case strings.HasPrefix(cb.Data, "ask="):
+		parts := strings.Split(cb.Data[4:], "-")
+		if len(parts) != 2 {
 			goto answerEmpty
 		}
-
-		fundraiseid := params[3]
-		rkey := "fundraise:" + fundraiseid
-
-		nregistered := int(rds.SCard(rkey).Val())
-		if nregistered == 0 {
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nFundraising expired.")
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
 			goto answerEmpty
 		}
 
-		receiverId, err1 := strconv.Atoi(params[0])
-		ngivers, err2 := strconv.Atoi(params[1])
-		sats, err3 := strconv.Atoi(params[2])
-		if err1 != nil || err2 != nil || err3 != nil {
+		switch parts[0] {
+		case "refund":
+			_, errMsg, err := refundQuestion(id, &u)
+			if err != nil {
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+				return
+			}
+			appendTextToMessage(cb, "\n\nDeclined and refunded.")
+		case "publish":
+			hiddenid, err := u.publishQuestion(id)
+			if err != nil {
+				log.Warn().Err(err).Int("question", id).Msg("failed to publish question")
+				goto answerEmpty
+			}
 			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nFundraising error.")
+			u.notify(fmt.Sprintf(
+				"Published as hidden message <code>%s</code>. Share it in a group with <code>/reveal %s</code> or with the inline query <code>reveal %s</code>.",
+				hiddenid, hiddenid, hiddenid))
+		}
+	case strings.HasPrefix(cb.Data, "bid="):
+		params := strings.Split(cb.Data[4:], "-")
+		if len(params) != 2 {
 			goto answerEmpty
 		}
-
-		joiner, t, err := ensureUser(cb.From.ID, cb.From.UserName)
-		if err != nil {
-			log.Warn().Err(err).Int("case", t).
-				Str("username", cb.From.UserName).Int("tgid", cb.From.ID).
-				Msg("failed to ensure joiner user on fundraise.")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "\n\nFundraising error.")
+		auctionId, err1 := strconv.Atoi(params[0])
+		sats, err2 := strconv.Atoi(params[1])
+		if err1 != nil || err2 != nil {
 			goto answerEmpty
 		}
 
-		if !joiner.checkBalanceFor(sats, "fundraise") {
-			goto answerEmpty
+		_, errMsg, err := u.bid(auctionId, sats)
+		if err != nil {
+			log.Debug().Err(err).Int("auction", auctionId).Str("user", u.Username).
+				Msg("failed to bid")
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+			return
 		}
 
-		if isMember, err := rds.SIsMember(rkey, joiner.Id).Result(); err != nil || isMember {
-			// can't join twice
+		bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, fmt.Sprintf("You bid %d sat.", sats)))
+		return
+	case strings.HasPrefix(cb.Data, "raffle="):
+		params := strings.Split(cb.Data[7:], "-")
+		if len(params) != 2 {
 			goto answerEmpty
 		}
-
-		if err := rds.SAdd("fundraise:"+fundraiseid, joiner.Id).Err(); err != nil {
-			log.Warn().Err(err).Str("fundraise", fundraiseid).Msg("error adding giver to fundraise.")
+		raffleId, err1 := strconv.Atoi(params[0])
+		n, err2 := strconv.Atoi(params[1])
+		if err1 != nil || err2 != nil {
 			goto answerEmpty
 		}
 
-		if nregistered+1 < ngivers {
-			// append @user to the fundraise message (without removing the keyboard)
-			baseEdit := getBaseEdit(cb)
-			keyboard := fundraiseKeyboard(fundraiseid, receiverId, ngivers, sats)
-			baseEdit.ReplyMarkup = &keyboard
-			edit := tgbotapi.EditMessageTextConfig{BaseEdit: baseEdit}
-			if cb.Message != nil {
-				edit.Text = cb.Message.Text + " " + joiner.AtName()
-			} else {
-				edit.Text = fmt.Sprintf("Pay %d and get a chance to win %d! %d out of %d spots left!",
-					sats, sats*ngivers, ngivers-nregistered, ngivers)
-			}
-			bot.Send(edit)
-		} else {
-			// commit the fundraise. this is the same as the coinflip, just without randomness.
-			sgivers, err := rds.SMembers(rkey).Result()
-			go rds.Del(rkey)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed to get fundraise givers")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nFundraising error.")
-				goto answerEmpty
-			}
-
-			// all givers
-			givers := make([]int, nregistered+1)
-			for i, spart := range sgivers {
-				part, err := strconv.Atoi(spart)
-				if err != nil {
-					log.Warn().Err(err).Str("part", spart).Msg("giver id is not an int")
-					removeKeyboardButtons(cb)
-					appendTextToMessage(cb, "\n\nFundraising error.")
-					goto answerEmpty
-				}
-				givers[i] = part
-			}
-
-			receiver, err := fromManyToOne(sats, receiverId, givers, "fundraise",
-				"You've received %[1]d sat of a fundraise from %[2]s",
-				"You've given %[1]d in a fundraise to %[2]s.")
-			if err != nil {
-				log.Warn().Err(err).Msg("error processing fundraise transactions")
-				removeKeyboardButtons(cb)
-				appendTextToMessage(cb, "\n\nFundraise error.")
-				goto answerEmpty
-			}
-
-			removeKeyboardButtons(cb)
-			if cb.Message != nil {
-				appendTextToMessage(cb, joiner.AtName()+"\nCompleted!")
-				notifyAsReply(cb.Message.Chat.ID,
-					"Fundraising for "+receiver.AtName()+" completed!", cb.Message.MessageID)
-			} else {
-				appendTextToMessage(cb, "Fundraising for "+receiver.AtName()+" completed!")
-			}
-		}
-	case strings.HasPrefix(cb.Data, "remunc="):
-		// remove unclaimed transaction
-		// when you tip an invalid account or an account that has never talked with the bot
-		hash := cb.Data[7:]
-		_, err := pg.Exec(`
-DELETE FROM lightning.transaction AS tx
-WHERE substring(payment_hash from 0 for $2) = $1
-  AND is_unclaimed(tx)
-        `, hash, len(hash)+1)
+		_, errMsg, err := u.buyRaffleTickets(raffleId, n)
 		if err != nil {
-			log.Error().Err(err).Str("hash", hash).Msg("failed to remove pending payment")
-			appendTextToMessage(cb, "Error.")
-			return
-		}
-		appendTextToMessage(cb, "Transaction canceled.")
-	case strings.HasPrefix(cb.Data, "reveal="):
-		// locate hidden message with the key given in the callback data,
-		// perform payment between users,
-		// reveal message.
-		hiddenkey := cb.Data[7:]
-		sourceUserId, hiddenid, content, _, satoshis, err := getHiddenMessage(hiddenkey)
-		if err != nil {
-			log.Error().Err(err).Str("key", hiddenkey).Msg("error locating hidden message")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "Hidden message not found.")
-			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, "Error locating this hidden message."))
+			log.Debug().Err(err).Int("raffle", raffleId).Str("user", u.Username).
+				Msg("failed to buy raffle tickets")
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
 			return
 		}
 
-		sourceuser, err := loadUser(sourceUserId, 0)
-		if err != nil {
-			log.Warn().Err(err).
-				Int("id", sourceUserId).
-				Msg("failed to load source user on reveal")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "Error.")
+		bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, fmt.Sprintf("You bought %d tickets.", n)))
+		return
+	case strings.HasPrefix(cb.Data, "cfund="):
+		params := strings.Split(cb.Data[6:], "-")
+		if len(params) != 2 {
+			goto answerEmpty
+		}
+		crowdfundId, err1 := strconv.Atoi(params[0])
+		sats, err2 := strconv.Atoi(params[1])
+		if err1 != nil || err2 != nil {
 			goto answerEmpty
 		}
 
-		revealer, t, err := ensureUser(cb.From.ID, cb.From.UserName)
+		_, errMsg, err := u.contribute(crowdfundId, sats)
 		if err != nil {
-			log.Warn().Err(err).Int("case", t).
-				Str("username", cb.From.UserName).Int("tgid", cb.From.ID).
-				Msg("failed to ensure revealer user on reveal")
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "Error.")
-			goto answerEmpty
+			log.Debug().Err(err).Int("crowdfund", crowdfundId).Str("user", u.Username).
+				Msg("failed to contribute")
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, errMsg))
+			return
 		}
 
-		errMsg, err := u.sendInternally(messageId, sourceuser, false, satoshis*1000, "reveal", nil)
+		bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, fmt.Sprintf("You contributed %d sat.", sats)))
+		return
+	case strings.HasPrefix(cb.Data, "unsch="):
+		id, err := strconv.Atoi(cb.Data[6:])
 		if err != nil {
-			removeKeyboardButtons(cb)
-			appendTextToMessage(cb, "Failed to reveal: "+errMsg)
 			goto answerEmpty
 		}
 
-		// actually reveal
-		if messageId != 0 {
-			removeKeyboardButtons(cb)
-			revealer.notifyAsReply(content, messageId)
-		} else {
-			baseEdit := getBaseEdit(cb)
-			bot.Send(tgbotapi.EditMessageTextConfig{
-				BaseEdit: baseEdit,
-				Text:     content,
-			})
+		err = u.cancelSchedule(id)
+		if err != nil {
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, err.Error()))
+			return
 		}
 
-		// notify both parties
-		revealer.notify(fmt.Sprintf("%d sat paid to reveal the message <code>%s</code>.", satoshis, hiddenid))
-		sourceuser.notify(
-			fmt.Sprintf("Hidden message <code>%s</code> revealed by %s. You've got %d sat.",
-				hiddenid, revealer.AtName(), satoshis),
-		)
+		appendTextToMessage(cb, fmt.Sprintf("\n#%d canceled.", id))
+		bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, fmt.Sprintf("Schedule #%d canceled.", id)))
+		return
 	case strings.HasPrefix(cb.Data, "check="):
 		// recheck transaction when for some reason it wasn't checked and
 		// either confirmed or deleted automatically
@@ -9,7 +9,6 @@ import (
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/kballard/go-shellquote"
-	"github.com/lucsky/cuid"
 )
 
 func handleInlineQuery(q *tgbotapi.InlineQuery) {
@@ -82,13 +81,18 @@ func handleInlineQuery(q *tgbotapi.InlineQuery) {
 			break
 		}
 
+		var offer string
+		var keyboard tgbotapi.InlineKeyboardMarkup
+		data := inlineGameData("giveaway", u, sats, 1)
+		if offer, keyboard, err = inlineGameOffer(data); err != nil {
+			goto answerEmpty
+		}
+
 		result := tgbotapi.NewInlineQueryResultArticle(
-			fmt.Sprintf("give-%d-%d", u.Id, sats),
+			"newgame="+data,
 			fmt.Sprintf("Giving %d away", sats),
-			fmt.Sprintf("%s is giving %d sat away!", u.AtName(), sats),
+			offer,
 		)
-
-		keyboard := giveawayKeyboard(u.Id, sats)
 		result.ReplyMarkup = &keyboard
 
 		resp, err = bot.AnswerInlineQuery(tgbotapi.InlineConfig{
@@ -116,17 +120,22 @@ func handleInlineQuery(q *tgbotapi.InlineQuery) {
 			}
 		}
 
+		if nparticipants < 2 || nparticipants > 100 {
+			goto answerEmpty
+		}
+
+		var offer string
+		var keyboard tgbotapi.InlineKeyboardMarkup
+		data := inlineGameData("coinflip", u, sats, nparticipants)
+		if offer, keyboard, err = inlineGameOffer(data); err != nil {
+			goto answerEmpty
+		}
+
 		result := tgbotapi.NewInlineQueryResultArticle(
-			fmt.Sprintf("flip-%d-%d-%d", u.Id, sats, nparticipants),
+			"newgame="+data,
 			fmt.Sprintf("Lottery with entry fee of %d sat for %d participants", sats, nparticipants),
-			fmt.Sprintf("Pay %d and get a chance to win %d! %d out of %d spots left!",
-				sats, sats*nparticipants, nparticipants-1, nparticipants),
+			offer,
 		)
-
-		coinflipid := cuid.Slug()
-		rds.SAdd("coinflip:"+coinflipid, u.Id)
-		rds.Expire("coinflip:"+coinflipid, s.GiveAwayTimeout)
-		keyboard := coinflipKeyboard(coinflipid, nparticipants, sats)
 		result.ReplyMarkup = &keyboard
 
 		resp, err = bot.AnswerInlineQuery(tgbotapi.InlineConfig{
@@ -152,15 +161,22 @@ func handleInlineQuery(q *tgbotapi.InlineQuery) {
 			nparticipants = n
 		}
 
+		if nparticipants < 2 || nparticipants > 100 {
+			goto answerEmpty
+		}
+
+		var offer string
+		var keyboard tgbotapi.InlineKeyboardMarkup
+		data := inlineGameData("giveflip", u, sats, nparticipants)
+		if offer, keyboard, err = inlineGameOffer(data); err != nil {
+			goto answerEmpty
+		}
+
 		result := tgbotapi.NewInlineQueryResultArticle(
-			fmt.Sprintf("gifl-%d-%d-%d", u.Id, sats, nparticipants),
+			"newgame="+data,
 			fmt.Sprintf("Give out %d sat for one out of %d participants", sats, nparticipants),
-			fmt.Sprintf("Join and get a chance to win %d! %d out of %d spots left!",
-				sats, nparticipants, nparticipants),
+			offer,
 		)
-
-		giveflipid := cuid.Slug()
-		keyboard := giveflipKeyboard(giveflipid, u.Id, nparticipants, sats)
 		result.ReplyMarkup = &keyboard
 
 		resp, err = bot.AnswerInlineQuery(tgbotapi.InlineConfig{
@@ -216,3 +232,12 @@ answerEmpty:
 		Results:       []interface{}{},
 	})
 }
+
+func handleChosenInlineResult(r *tgbotapi.ChosenInlineResult) {
+	if strings.HasPrefix(r.ResultID, "newgame=") && r.InlineMessageID != "" {
+		_, _, err := inlineGame(r.InlineMessageID, r.ResultID[8:])
+		if err != nil {
+			log.Debug().Err(err).Str("result", r.ResultID).Msg("failed to create inline game")
+		}
+	}
+}
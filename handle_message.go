@@ -10,7 +10,6 @@ import (
 	"github.com/docopt/docopt-go"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/hoisie/mustache"
-	"github.com/lucsky/cuid"
 )
 
 func handleMessage(message *tgbotapi.Message) {
@@ -23,16 +22,28 @@ func handleMessage(message *tgbotapi.Message) {
 		return
 	}
 
+	if message.Chat.Type != "private" && !message.From.IsBot {
+		recordActivity(message.Chat.ID, u)
+	}
+
+	// replies to messages that expect an answer from the user, these may
+	// come from groups and don't have commands
+	if kind, id, ok := getReplyRoute(message); ok && !startsWithCommand(message) {
+		if message.Chat.Type == "private" {
+			u.setChat(message.Chat.ID)
+		}
+		handleReplyRoute(u, kind, id, message)
+		return
+	}
+
 	if message.Chat.Type == "private" {
 		// after ensuring the user we should always enable him to
 		// receive payment notifications and so on, as not all people will
 		// remember to call /start
 		u.setChat(message.Chat.ID)
-	} else if message.Entities == nil || len(*message.Entities) == 0 ||
+	} else if !startsWithCommand(message) {
 		// unless in the private chat, only messages starting with
 		// bot commands will work
-		(*message.Entities)[0].Type != "bot_command" ||
-		(*message.Entities)[0].Offset != 0 {
 		return
 	}
 
@@ -74,7 +85,8 @@ func handleMessage(message *tgbotapi.Message) {
 <b>Hash</b>: {{Hash}}{{/TelegramPeer.Valid}}{{#Preimage.Valid}} 
 <b>Preimage</b>: {{Preimage.String}}{{/Preimage.Valid}}
 <b>Amount</b>: {{Satoshis}} sat
-{{^IsReceive}}<b>Fee paid</b>: {{FeeSatoshis}}{{/IsReceive}}
+{{#HoldInfo}}<b>Hold</b>: {{{HoldInfo}}}
+{{/HoldInfo}}{{^IsReceive}}<b>Fee paid</b>: {{FeeSatoshis}}{{/IsReceive}}
         `, txn) + "\n" + renderLogInfo(hashfirstchars)
 		id := u.notifyAsReply(txnreply, txn.TriggerMessage).MessageID
 
@@ -186,7 +198,18 @@ parsed:
 			preimage, _ = param.(string)
 		}
 
-		bolt11, _, qrpath, err := u.makeInvoice(sats, desc, "", nil, message.MessageID, preimage, false)
+		// in groups with a treasury the money goes to it
+		receiver := u
+		if message.Chat.Type != "private" {
+			if treasury, err := getTreasury(message.Chat.ID); err == nil {
+				receiver = treasury
+				if desc == "" {
+					desc = "treasury of " + message.Chat.Title
+				}
+			}
+		}
+
+		bolt11, _, qrpath, err := receiver.makeInvoice(sats, desc, "", nil, message.MessageID, preimage, false)
 		if err != nil {
 			log.Warn().Err(err).Msg("failed to generate invoice")
 			notify(message.Chat.ID, messageFromError(err, "Failed to generate invoice"))
@@ -197,6 +220,209 @@ parsed:
 		notifyWithPicture(message.Chat.ID, qrpath, bolt11)
 
 		break
+	case opts["treasury"].(bool):
+		// this must come before "send", as it is also a subcommand here
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Treasuries belong to groups.", message.MessageID)
+			break
+		}
+
+		switch {
+		case opts["send"].(bool):
+			if !isChatAdmin(message.Chat.ID, message.From.ID) {
+				notifyAsReply(message.Chat.ID, "Only admins can propose spending.", message.MessageID)
+				break
+			}
+
+			sats, err := opts.Int("<satoshis>")
+			if err != nil || sats <= 0 {
+				notifyAsReply(message.Chat.ID, "Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+				break
+			}
+
+			receiver, _, err := parseUsername(message, opts["<receiver>"])
+			if err != nil || receiver == nil {
+				notifyAsReply(message.Chat.ID, "Invalid receiver.", message.MessageID)
+				break
+			}
+
+			memo, _ := opts["--memo"].(string)
+			_, errMsg, err := u.proposeTreasurySend(message.Chat.ID, *receiver, sats, memo)
+			if err != nil {
+				log.Debug().Err(err).Int64("chat", message.Chat.ID).Msg("failed to propose treasury send")
+				notifyAsReply(message.Chat.ID, "Proposal not made: "+errMsg, message.MessageID)
+			}
+		case opts["approvals"].(bool):
+			if !isChatAdmin(message.Chat.ID, message.From.ID) {
+				notifyAsReply(message.Chat.ID, "Only admins can change this.", message.MessageID)
+				break
+			}
+
+			n, err := opts.Int("<approvals>")
+			if err != nil || n < 1 {
+				notifyAsReply(message.Chat.ID, "Invalid number of approvals.", message.MessageID)
+				break
+			}
+
+			err = setTreasuryApprovals(message.Chat.ID, n)
+			if err != nil {
+				log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to set treasury approvals")
+				break
+			}
+			notifyAsReply(message.Chat.ID, fmt.Sprintf(
+				"Spending from the treasury now needs %d admin approvals (or all admins, if there are fewer).", n),
+				message.MessageID)
+		default:
+			treasury, err := getTreasury(message.Chat.ID)
+			if err != nil {
+				if !isChatAdmin(message.Chat.ID, message.From.ID) {
+					notifyAsReply(message.Chat.ID, "This group has no treasury. An admin can open one with /treasury.", message.MessageID)
+					break
+				}
+
+				treasury, err = ensureTreasury(message.Chat.ID)
+				if err != nil {
+					log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to create treasury")
+					break
+				}
+				notifyAsReply(message.Chat.ID, "🏛 Treasury opened. From now on /receive in this group pays into it, and admins spend from it with /treasury send.", message.MessageID)
+			}
+
+			info, err := treasury.getInfo()
+			if err != nil {
+				log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to get treasury info")
+				break
+			}
+			txns, err := treasury.listTransactions(10, 0, 16, "", Both)
+			if err != nil {
+				log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to list treasury transactions")
+				break
+			}
+
+			notifyAsReply(message.Chat.ID, mustache.Render(`🏛 <b>Treasury</b>
+<b>Balance</b>: {{balance}} sat
+<b>Approvals needed to spend</b>: {{approvals}}
+
+<b>Latest transactions</b>
+{{#txns}}
+<code>{{StatusSmall}}</code> <code>{{PaddedSatoshis}}</code> {{Icon}} {{PeerActionDescription}} <i>{{Description}}</i> <i>{{TimeFormatSmall}}</i>
+{{/txns}}
+{{^txns}}None yet.{{/txns}}
+            `, map[string]interface{}{
+				"balance":   fmt.Sprintf("%.3f", info.Balance),
+				"approvals": getTreasuryApprovals(message.Chat.ID),
+				"txns":      txns,
+			}), message.MessageID)
+		}
+	case opts["schedule"].(bool):
+		// this must come before "send" and "pay", as they are also subcommands here
+		var sch Schedule
+
+		switch {
+		case opts["send"].(bool):
+			sats, err := opts.Int("<satoshis>")
+			if err != nil || sats <= 0 {
+				u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+				break
+			}
+
+			target, _, err := parseUsername(message, opts["<user>"])
+			if err != nil || target == nil {
+				u.notifyAsReply("Invalid receiver.", message.MessageID)
+				break
+			}
+
+			interval, err := parseInterval(opts["<interval>"].(string))
+			if err != nil {
+				u.notifyAsReply(err.Error(), message.MessageID)
+				break
+			}
+
+			first := time.Now().UTC()
+			if start, ok := opts["<start>"].(string); ok {
+				first, err = parseScheduleTime(start)
+				if err != nil {
+					u.notifyAsReply(err.Error(), message.MessageID)
+					break
+				}
+			}
+
+			var until *time.Time
+			if date, ok := opts["<date>"].(string); ok {
+				t, err := parseScheduleTime(date)
+				if err != nil {
+					u.notifyAsReply(err.Error(), message.MessageID)
+					break
+				}
+				until = &t
+			}
+
+			times := 0
+			if _, ok := opts["<times>"].(string); ok {
+				times, err = opts.Int("<times>")
+				if err != nil || times <= 0 {
+					u.notifyAsReply("Invalid number of times.", message.MessageID)
+					break
+				}
+			}
+
+			sch, err = u.scheduleSend(*target, sats, first, interval, until, times)
+			if err != nil {
+				u.notifyAsReply("Failed to schedule: "+err.Error(), message.MessageID)
+				break
+			}
+		case opts["pay"].(bool):
+			sats := 0
+			if _, ok := opts["<satoshis>"].(string); ok {
+				var err error
+				sats, err = opts.Int("<satoshis>")
+				if err != nil || sats <= 0 {
+					u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+					break
+				}
+			}
+
+			at, err := parseScheduleTime(opts["<time>"].(string))
+			if err != nil {
+				u.notifyAsReply(err.Error(), message.MessageID)
+				break
+			}
+
+			sch, err = u.schedulePay(strings.TrimPrefix(opts["<target>"].(string), "lightning:"), sats, at)
+			if err != nil {
+				u.notifyAsReply("Failed to schedule: "+err.Error(), message.MessageID)
+				break
+			}
+		}
+
+		if sch.Id == 0 {
+			// an error was already reported
+			break
+		}
+
+		sch, _ = u.getSchedule(sch.Id)
+		u.notifyAsReply(fmt.Sprintf("Scheduled #%d: %s.", sch.Id, sch.Description()), message.MessageID)
+	case opts["schedules"].(bool):
+		schedules, err := u.listSchedules()
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to list schedules")
+			break
+		}
+
+		text := mustache.Render(`<b>Scheduled payments</b>
+{{#schedules}}
+#{{Id}}: {{Description}}{{#LastError.Valid}} (last run failed: <i>{{LastError.String}}</i>){{/LastError.Valid}}
+{{/schedules}}{{^schedules}}
+None. /help schedule
+{{/schedules}}
+        `, map[string]interface{}{"schedules": schedules})
+
+		chattable := tgbotapi.NewMessage(u.ChatId, text)
+		chattable.ParseMode = "HTML"
+		if len(schedules) > 0 {
+			chattable.BaseChat.ReplyMarkup = schedulesKeyboard(schedules)
+		}
+		bot.Send(chattable)
 	case opts["send"].(bool), opts["tip"].(bool):
 		// default notify function to use depending on many things
 		defaultNotify := func(m string) { u.notify(m) }
@@ -212,6 +438,8 @@ parsed:
 			todisplayname string
 			receiver      *User
 			usernameval   interface{}
+			memo          string
+			replyTip      bool
 		)
 
 		// get quantity
@@ -222,19 +450,25 @@ parsed:
 			if val, ok := opts["<satoshis>"].(string); ok && val[0] == '@' {
 				// it seems to be
 				usernameval = val
-				if asats, ok := opts["<receiver>"].([]string); ok && len(asats) == 1 {
+				if asats, ok := opts["<receiver>"].([]string); ok && len(asats) >= 1 {
 					sats, _ = strconv.Atoi(asats[0])
+					memo = strings.Join(asats[1:], " ")
 					goto gotusername
 				}
 			}
 
 			defaultNotify("Invalid amount: " + opts["<satoshis>"].(string))
 			break
-		} else {
-			usernameval = opts["<receiver>"]
+		} else if words, ok := opts["<receiver>"].([]string); ok {
+			usernameval, memo = splitReceiverAndMemo(message, words)
 		}
 
 	gotusername:
+		if m, ok := opts["--memo"].(string); ok && m != "" {
+			memo = m
+		}
+		memo = strings.TrimSpace(memo)
+
 		anonymous := false
 		if opts["anonymously"].(bool) || opts["--anonymous"].(bool) || opts["sendanonymously"].(bool) {
 			anonymous = true
@@ -251,6 +485,7 @@ parsed:
 
 		// no username, this may be a reply-tip
 		if message.ReplyToMessage != nil {
+			replyTip = true
 			log.Debug().Msg("it's a reply-tip")
 			reply := message.ReplyToMessage
 
@@ -286,12 +521,18 @@ parsed:
 			break
 		}
 
+		var desc interface{}
+		if memo != "" {
+			desc = memo
+		}
+
 		errMsg, err := u.sendInternally(
 			message.MessageID,
+			message.Chat.ID,
 			*receiver,
 			anonymous,
 			sats*1000,
-			nil,
+			desc,
 			nil,
 		)
 		if err != nil {
@@ -304,10 +545,15 @@ parsed:
 		}
 
 		if receiver.ChatId != 0 {
+			memonote := ""
+			if memo != "" {
+				memonote = ": <i>" + escapeHTML(memo) + "</i>"
+			}
+
 			if anonymous {
-				receiver.notify(fmt.Sprintf("Someone has sent you %d sat.", sats))
+				receiver.notify(fmt.Sprintf("Someone has sent you %d sat%s.", sats, memonote))
 			} else {
-				receiver.notify(fmt.Sprintf("%s has sent you %d sat.", u.AtName(), sats))
+				receiver.notify(fmt.Sprintf("%s has sent you %d sat%s.", u.AtName(), sats, memonote))
 			}
 		}
 
@@ -326,8 +572,254 @@ parsed:
 			break
 		}
 
+		if replyTip && isSpammy(message.Chat.ID) {
+			// the tally reply under the tipped message replaces the usual
+			// confirmation in spammy groups
+			tallyTip(message.Chat.ID, message.ReplyToMessage.MessageID, u, sats)
+			break
+		}
+
 		defaultNotify(fmt.Sprintf("%d sat sent to %s.", sats, todisplayname))
 		break
+	case opts["request"].(bool):
+		sats, err := opts.Int("<satoshis>")
+		if err != nil || sats <= 0 {
+			u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		var payer *User
+		words, _ := opts["<payer>"].([]string)
+		payerwords, memo := splitReceiverAndMemo(message, words)
+		if m, ok := opts["--memo"].(string); ok && m != "" {
+			memo = m
+		}
+
+		payer, _, err = parseUsername(message, payerwords)
+		if err != nil {
+			log.Warn().Interface("val", payerwords).Err(err).Msg("failed to parse username")
+			break
+		}
+		if payer == nil && message.ReplyToMessage != nil {
+			reply := message.ReplyToMessage
+			rec, t, err := ensureUser(reply.From.ID, reply.From.UserName)
+			if err != nil {
+				log.Warn().Err(err).Int("case", t).
+					Str("username", reply.From.UserName).
+					Int("id", reply.From.ID).
+					Msg("failed to ensure user on reply-request")
+				break
+			}
+			payer = &rec
+		}
+		if payer == nil {
+			u.notifyAsReply("Who should pay? Mention them or reply to one of their messages.", message.MessageID)
+			break
+		}
+
+		req, err := u.requestPayment(*payer, sats, strings.TrimSpace(memo))
+		if err != nil {
+			u.notifyAsReply("Failed to request payment: "+err.Error(), message.MessageID)
+			break
+		}
+
+		notify := func(m string) { u.notifyAsReply(m, message.MessageID) }
+		if message.Chat.Type != "private" {
+			notify = func(m string) { notifyAsReply(message.Chat.ID, m, message.MessageID) }
+		}
+		notify(fmt.Sprintf("Requested %d sat from %s%s. The request expires in %s.",
+			sats, payer.AtName(), req.MemoNote(), req.ExpiresIn()))
+	case opts["split"].(bool):
+		total, err := opts.Int("<satoshis>")
+		if err != nil || total <= 0 {
+			u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		words, _ := opts["<participants>"].([]string)
+		participants, memo, err := parseSplitParticipants(message, words)
+		if err != nil {
+			log.Warn().Err(err).Strs("words", words).Msg("failed to parse split participants")
+			u.notifyAsReply("Failed to save participants. This is probably a bug.", message.MessageID)
+			break
+		}
+		if m, ok := opts["--memo"].(string); ok && m != "" {
+			memo = m
+		}
+
+		_, err = u.startSplit(message.Chat.ID, total, participants, memo)
+		if err != nil {
+			u.notifyAsReply("Failed to split: "+err.Error(), message.MessageID)
+			break
+		}
+	case opts["escrow"].(bool):
+		sats, err := opts.Int("<satoshis>")
+		if err != nil || sats <= 0 {
+			u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		words, _ := opts["<seller>"].([]string)
+		sellerwords, memo := splitReceiverAndMemo(message, words)
+		if m, ok := opts["--memo"].(string); ok && m != "" {
+			memo = m
+		}
+
+		seller, _, err := parseUsername(message, sellerwords)
+		if err != nil || seller == nil {
+			u.notifyAsReply("Who is the seller? Mention them after the amount.", message.MessageID)
+			break
+		}
+
+		var arbiter *User
+		if a, ok := opts["--arbiter"].(string); ok && a != "" {
+			if !strings.HasPrefix(a, "@") {
+				u.notifyAsReply("The arbiter must be given as @username.", message.MessageID)
+				break
+			}
+			arb, err := ensureUsername(a[1:])
+			if err != nil {
+				log.Warn().Err(err).Str("username", a).Msg("failed to ensure escrow arbiter")
+				break
+			}
+			arbiter = &arb
+		}
+
+		timeout := DEFAULT_ESCROW_TIMEOUT
+		if t, ok := opts["--timeout"].(string); ok && t != "" {
+			timeout, err = parseInterval(t)
+			if err != nil {
+				u.notifyAsReply("Invalid timeout: "+t, message.MessageID)
+				break
+			}
+		}
+
+		escrow, errMsg, err := u.openEscrow(*seller, arbiter, sats,
+			strings.TrimSpace(memo), timeout, message.MessageID)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to open escrow")
+			u.notifyAsReply("Failed to open escrow: "+errMsg, message.MessageID)
+			break
+		}
+
+		if message.Chat.Type != "private" {
+			notifyAsReply(message.Chat.ID, fmt.Sprintf(
+				"Escrow #%d: %d sat locked by %s to pay %s%s.",
+				escrow.Id, sats, u.AtName(), seller.AtName(), escrow.MemoNote()), message.MessageID)
+		}
+	case opts["requests"].(bool):
+		incoming, outgoing, err := u.listPaymentRequests()
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to list payment requests")
+			break
+		}
+
+		u.notify(mustache.Render(`<b>Requests to you</b>
+{{#incoming}}
+<code>{{Amount}}</code> sat from @{{Peer}}{{{MemoNote}}}, expires in {{ExpiresIn}}
+{{/incoming}}{{^incoming}}
+None.
+{{/incoming}}
+
+<b>Your requests</b>
+{{#outgoing}}
+<code>{{Amount}}</code> sat to @{{Peer}}{{{MemoNote}}}, expires in {{ExpiresIn}}
+{{/outgoing}}{{^outgoing}}
+None.
+{{/outgoing}}
+        `, map[string]interface{}{"incoming": incoming, "outgoing": outgoing}))
+	case opts["rain"].(bool):
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Rain only works in groups.", message.MessageID)
+			break
+		}
+
+		sats, err := opts.Int("<satoshis>")
+		if err != nil || sats <= 0 {
+			notifyAsReply(message.Chat.ID, "Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		n := DEFAULT_RAIN_MEMBERS
+		if _, ok := opts["<num_participants>"].(string); ok {
+			n, err = opts.Int("<num_participants>")
+			if err != nil {
+				notifyAsReply(message.Chat.ID, "Invalid number of people: "+opts["<num_participants>"].(string), message.MessageID)
+				break
+			}
+		}
+
+		recipients, share, errMsg, err := u.rain(message.Chat.ID, message.Chat.Title, sats, n, message.MessageID)
+		if err != nil {
+			log.Debug().Err(err).Str("user", u.Username).Int64("chat", message.Chat.ID).Msg("failed to rain")
+			notifyAsReply(message.Chat.ID, "No rain: "+errMsg, message.MessageID)
+			break
+		}
+
+		names := make([]string, len(recipients))
+		for i, recipient := range recipients {
+			names[i] = recipient.AtName()
+		}
+		notifyAsReply(message.Chat.ID, fmt.Sprintf("🌧 %s made it rain %d sat on %s, %d sat each.",
+			u.AtName(), share*len(recipients), listAnd(names), share), message.MessageID)
+	case opts["stats"].(bool):
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Stats are only available in groups.", message.MessageID)
+			break
+		}
+
+		text, err := renderGroupStats(message.Chat.ID)
+		if err != nil {
+			log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to get group stats")
+			break
+		}
+		notifyAsReply(message.Chat.ID, text, message.MessageID)
+	case opts["leaderboard"].(bool):
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Leaderboards are only available in groups.", message.MessageID)
+			break
+		}
+
+		if opts["hide"].(bool) || opts["unhide"].(bool) {
+			if !isAdmin(message) {
+				notifyAsReply(message.Chat.ID, "Only admins can do that.", message.MessageID)
+				break
+			}
+
+			target, _, err := parseUsername(message, opts["<user>"])
+			if err != nil || target == nil {
+				notifyAsReply(message.Chat.ID, "Who?", message.MessageID)
+				break
+			}
+
+			hide := opts["hide"].(bool)
+			err = setLeaderboardHidden(message.Chat.ID, *target, hide)
+			if err != nil {
+				log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to hide from leaderboard")
+				break
+			}
+
+			if hide {
+				notifyAsReply(message.Chat.ID, target.AtName()+" won't appear on the boards.", message.MessageID)
+			} else {
+				notifyAsReply(message.Chat.ID, target.AtName()+" is back on the boards.", message.MessageID)
+			}
+			break
+		}
+
+		period := "week"
+		if opts["month"].(bool) {
+			period = "month"
+		} else if opts["all"].(bool) {
+			period = "all"
+		}
+
+		text, err := renderLeaderboard(message.Chat.ID, period)
+		if err != nil {
+			log.Warn().Err(err).Int64("chat", message.Chat.ID).Msg("failed to get leaderboard")
+			break
+		}
+		notifyAsReply(message.Chat.ID, text, message.MessageID)
 	case opts["giveaway"].(bool):
 		sats, err := opts.Int("<satoshis>")
 		if err != nil || sats == 0 {
@@ -338,12 +830,42 @@ parsed:
 			break
 		}
 
-		chattable := tgbotapi.NewMessage(
-			message.Chat.ID,
-			fmt.Sprintf("%s is giving %d sat away!", u.AtName(), sats),
-		)
-		chattable.BaseChat.ReplyMarkup = giveawayKeyboard(u.Id, sats)
-		bot.Send(chattable)
+		nclaimers := 1
+		if n, err := opts.Int("--claimers"); err == nil {
+			if n < 1 || n > 100 || n > sats {
+				u.notify("Invalid number of claimers: " + strconv.Itoa(n))
+				break
+			}
+			nclaimers = n
+		}
+
+		var targetId int
+		if names, ok := opts["<receiver>"].([]string); ok && len(names) > 0 {
+			target, _, err := parseUsername(message, names)
+			if err != nil || target == nil {
+				u.notify("Failed to parse receiver name.")
+				break
+			}
+			if target.Id == u.Id {
+				u.notify("Can't give away to yourself.")
+				break
+			}
+			targetId = target.Id
+			nclaimers = 1
+		}
+
+		membersOnly := opts["--members-only"].(bool)
+		if membersOnly && message.Chat.Type == "private" {
+			u.notify("--members-only only makes sense in groups.")
+			break
+		}
+
+		g, _, err := createGame("giveaway", u, targetId, sats, nclaimers, false, membersOnly)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to create giveaway")
+			break
+		}
+		g.sendGame(message.Chat.ID)
 		break
 	case opts["giveflip"].(bool):
 		sats, err := opts.Int("<satoshis>")
@@ -365,13 +887,12 @@ parsed:
 			}
 		}
 
-		chattable := tgbotapi.NewMessage(
-			message.Chat.ID,
-			fmt.Sprintf("%s is giving %d sat away to a lucky person out of %d!", u.AtName(), sats, nparticipants),
-		)
-		giveflipid := cuid.Slug()
-		chattable.BaseChat.ReplyMarkup = giveflipKeyboard(giveflipid, u.Id, nparticipants, sats)
-		bot.Send(chattable)
+		g, _, err := createGame("giveflip", u, 0, sats, nparticipants, false, false)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to create giveflip")
+			break
+		}
+		g.sendGame(message.Chat.ID)
 		break
 	case opts["coinflip"].(bool), opts["lottery"].(bool):
 		// open a lottery between a number of users in a group
@@ -380,9 +901,6 @@ parsed:
 			u.notify("Invalid amount: " + opts["<satoshis>"].(string))
 			break
 		}
-		if !u.checkBalanceFor(sats, "coinflip") {
-			break
-		}
 
 		nparticipants := 2
 		if n, err := opts.Int("<num_participants>"); err == nil {
@@ -394,31 +912,20 @@ parsed:
 			}
 		}
 
-		chattable := tgbotapi.NewMessage(
-			message.Chat.ID,
-			fmt.Sprintf(`A lottery round is starting!
-
-Entry fee: %d sat
-Total participants: %d
-Prize: %d
-Registered: %s`, sats, nparticipants, sats*nparticipants, u.AtName()),
-		)
-
-		coinflipid := cuid.Slug()
-		rds.SAdd("coinflip:"+coinflipid, u.Id)
-		rds.Expire("coinflip:"+coinflipid, s.GiveAwayTimeout)
-		chattable.BaseChat.ReplyMarkup = coinflipKeyboard(coinflipid, nparticipants, sats)
-		bot.Send(chattable)
-	case opts["fundraise"].(bool), opts["crowdfund"].(bool):
+		g, errMsg, err := createGame("coinflip", u, 0, sats, nparticipants, true, false)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to create coinflip")
+			u.notifyAsReply("Failed to create the coinflip: "+errMsg, message.MessageID)
+			break
+		}
+		g.sendGame(message.Chat.ID)
+	case opts["fundraise"].(bool):
 		// many people join, we get all the money and transfer to the target
 		sats, err := opts.Int("<satoshis>")
 		if err != nil || sats == 0 {
 			u.notify("Invalid amount: " + opts["<satoshis>"].(string))
 			break
 		}
-		if !u.checkBalanceFor(sats, "fundraise") {
-			break
-		}
 
 		nparticipants, err := opts.Int("<num_participants>")
 		if err != nil || nparticipants < 2 || nparticipants > 100 {
@@ -426,28 +933,224 @@ Registered: %s`, sats, nparticipants, sats*nparticipants, u.AtName()),
 			break
 		}
 
-		receiver, receiverdisplayname, err := parseUsername(message, opts["<receiver>"])
-		if err != nil {
+		receiver, _, err := parseUsername(message, opts["<receiver>"])
+		if err != nil || receiver == nil {
 			log.Warn().Err(err).Msg("parsing fundraise receiver")
 			u.notify("Failed to parse receiver name.")
 			break
 		}
 
-		chattable := tgbotapi.NewMessage(
-			message.Chat.ID,
-			fmt.Sprintf(`A fundraising to %s was started!
+		g, errMsg, err := createGame("fundraise", u, receiver.Id, sats, nparticipants, true, false)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to create fundraise")
+			u.notifyAsReply("Failed to create the fundraise: "+errMsg, message.MessageID)
+			break
+		}
+		g.sendGame(message.Chat.ID)
+	case opts["verify"].(bool):
+		gameId, err := opts.Int("<game>")
+		if err != nil {
+			u.notifyAsReply("Invalid game: "+opts["<game>"].(string), message.MessageID)
+			break
+		}
 
-Contributors needed for completion: %d
-Each pays: %d sat
-Final amount: %d
-Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipants, u.AtName()),
-		)
+		text, err := verifyGame(gameId)
+		if err != nil {
+			notifyAsReply(message.Chat.ID, fmt.Sprintf("Game #%d not found.", gameId), message.MessageID)
+			break
+		}
+		notifyAsReply(message.Chat.ID, text, message.MessageID)
+	case opts["crowdfund"].(bool):
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Crowdfunds can only be started in groups.", message.MessageID)
+			break
+		}
 
-		fundraiseid := cuid.Slug()
-		rds.SAdd("fundraise:"+fundraiseid, u.Id)
-		rds.Expire("fundraise:"+fundraiseid, s.GiveAwayTimeout)
-		chattable.BaseChat.ReplyMarkup = fundraiseKeyboard(fundraiseid, receiver.Id, nparticipants, sats)
-		bot.Send(chattable)
+		goal, err := opts.Int("<satoshis>")
+		if err != nil || goal <= 0 {
+			notifyAsReply(message.Chat.ID, "Invalid goal: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		duration, err := parseInterval(opts["<deadline>"].(string))
+		if err != nil {
+			notifyAsReply(message.Chat.ID, "Invalid deadline: "+opts["<deadline>"].(string), message.MessageID)
+			break
+		}
+
+		receiver, _, err := parseUsername(message, opts["<user>"])
+		if err != nil || receiver == nil {
+			notifyAsReply(message.Chat.ID, "Who should get the funds? Mention them after the deadline.", message.MessageID)
+			break
+		}
+
+		title := strings.Join(opts["<message>"].([]string), " ")
+		_, err = u.startCrowdfund(message.Chat.ID, goal, duration, *receiver, title)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to start crowdfund")
+			notifyAsReply(message.Chat.ID, "Failed to start crowdfund: "+err.Error(), message.MessageID)
+			break
+		}
+	case opts["inbox"].(bool):
+		switch {
+		case opts["price"].(bool):
+			sats, err := opts.Int("<satoshis>")
+			if err != nil || sats <= 0 {
+				u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+				break
+			}
+
+			err = u.setInboxPrice(sats)
+			if err != nil {
+				log.Warn().Err(err).Str("user", u.Username).Msg("failed to set inbox price")
+				u.notifyAsReply("Failed to save your inbox price.", message.MessageID)
+				break
+			}
+			u.notifyAsReply(fmt.Sprintf(
+				"Your inbox is open. Messages sent with <code>/dm %s</code> will cost %d sat.",
+				u.AtName(), sats), message.MessageID)
+		case opts["off"].(bool):
+			err := u.setInboxPrice(0)
+			if err != nil {
+				log.Warn().Err(err).Str("user", u.Username).Msg("failed to close inbox")
+				break
+			}
+			u.notifyAsReply("Your inbox is closed.", message.MessageID)
+		case opts["unblock"].(bool):
+			blocked, _, err := parseUsername(message, opts["<user>"])
+			if err != nil || blocked == nil {
+				u.notifyAsReply("Who should be unblocked?", message.MessageID)
+				break
+			}
+
+			err = u.unblockInboxSender(blocked.Id)
+			if err != nil {
+				log.Warn().Err(err).Str("user", u.Username).Msg("failed to unblock inbox sender")
+				break
+			}
+			u.notifyAsReply(fmt.Sprintf("%s can message you again.", blocked.AtName()), message.MessageID)
+		default:
+			settings := u.getInboxSettings()
+			if settings.Price <= 0 {
+				u.notifyAsReply("Your inbox is closed. Open it with <code>/inbox price &lt;satoshis&gt;</code>.",
+					message.MessageID)
+				break
+			}
+			u.notifyAsReply(fmt.Sprintf("Your inbox is open at %d sat per message, %d senders blocked.",
+				settings.Price, len(settings.Blocked)), message.MessageID)
+		}
+	case opts["dm"].(bool):
+		recipient, _, err := parseUsername(message, opts["<user>"])
+		if err != nil || recipient == nil {
+			u.notifyAsReply("Who should get the message? Mention them after the command.", message.MessageID)
+			break
+		}
+
+		content := strings.Join(opts["<message>"].([]string), " ")
+		errMsg, err := u.sendToInbox(*recipient, content, message.MessageID)
+		if err != nil {
+			log.Debug().Err(err).Str("user", u.Username).Int("recipient", recipient.Id).
+				Msg("failed to send to inbox")
+			u.notifyAsReply("Message not sent: "+errMsg, message.MessageID)
+			break
+		}
+		u.notifyAsReply(fmt.Sprintf("Message delivered to %s.", recipient.AtName()), message.MessageID)
+	case opts["ask"].(bool):
+		expert, _, err := parseUsername(message, opts["<user>"])
+		if err != nil || expert == nil {
+			u.notifyAsReply("Who should answer? Mention them after the command.", message.MessageID)
+			break
+		}
+
+		sats, err := opts.Int("<satoshis>")
+		if err != nil || sats <= 0 {
+			u.notifyAsReply("Invalid amount: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		deadline := DEFAULT_QUESTION_DEADLINE
+		if d, ok := opts["--deadline"].(string); ok && d != "" {
+			deadline, err = parseInterval(d)
+			if err != nil {
+				u.notifyAsReply("Invalid deadline: "+d, message.MessageID)
+				break
+			}
+		}
+
+		question := strings.Join(opts["<message>"].([]string), " ")
+		q, errMsg, err := u.ask(*expert, sats, question, deadline, message.MessageID)
+		if err != nil {
+			log.Debug().Err(err).Str("user", u.Username).Int("expert", expert.Id).
+				Msg("failed to ask question")
+			u.notifyAsReply("Question not sent: "+errMsg, message.MessageID)
+			break
+		}
+		u.notifyAsReply(fmt.Sprintf(
+			"Question #%d sent to %s. The %d sat are on hold until they answer, or back to you on %s UTC.",
+			q.Id, expert.AtName(), sats, q.Deadline.Format("2 Jan 2006 15:04")), message.MessageID)
+	case opts["auction"].(bool):
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Auctions can only be started in groups.", message.MessageID)
+			break
+		}
+
+		reserve, err := opts.Int("<satoshis>")
+		if err != nil || reserve <= 0 {
+			notifyAsReply(message.Chat.ID, "Invalid reserve: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		duration, err := parseInterval(opts["<duration>"].(string))
+		if err != nil {
+			notifyAsReply(message.Chat.ID, "Invalid duration: "+opts["<duration>"].(string), message.MessageID)
+			break
+		}
+
+		description := strings.Join(opts["<message>"].([]string), " ")
+		_, err = u.startAuction(message.Chat.ID, reserve, duration, description)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to start auction")
+			notifyAsReply(message.Chat.ID, "Failed to start auction: "+err.Error(), message.MessageID)
+			break
+		}
+	case opts["raffle"].(bool):
+		if message.Chat.Type == "private" {
+			u.notifyAsReply("Raffles can only be started in groups.", message.MessageID)
+			break
+		}
+
+		price, err := opts.Int("<satoshis>")
+		if err != nil || price <= 0 {
+			notifyAsReply(message.Chat.ID, "Invalid ticket price: "+opts["<satoshis>"].(string), message.MessageID)
+			break
+		}
+
+		duration, err := parseInterval(opts["<deadline>"].(string))
+		if err != nil {
+			notifyAsReply(message.Chat.ID, "Invalid deadline: "+opts["<deadline>"].(string), message.MessageID)
+			break
+		}
+
+		cut := 0
+		if c, ok := opts["--cut"].(string); ok && c != "" {
+			cut, err = strconv.Atoi(strings.TrimSuffix(c, "%"))
+			if err != nil {
+				notifyAsReply(message.Chat.ID, "Invalid cut: "+c, message.MessageID)
+				break
+			}
+		}
+
+		prize := ""
+		if words, ok := opts["<message>"].([]string); ok {
+			prize = strings.Join(words, " ")
+		}
+
+		_, err = u.startRaffle(message.Chat.ID, price, duration, prize, cut)
+		if err != nil {
+			log.Warn().Err(err).Str("user", u.Username).Msg("failed to start raffle")
+			notifyAsReply(message.Chat.ID, "Failed to start raffle: "+err.Error(), message.MessageID)
+			break
+		}
 	case opts["hide"].(bool):
 		var content string
 		if icontent, ok := opts["<message>"]; ok {
@@ -460,8 +1163,7 @@ Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipa
 			break
 		}
 
-		hiddenid := cuid.Slug()
-		err = rds.Set(fmt.Sprintf("hidden:%d:%s:%d", u.Id, hiddenid, sats), content, s.HiddenMessageTimeout).Err()
+		hiddenid, err := createHiddenMessage(u, sats, content)
 		if err != nil {
 			u.notify("Failed to store hidden content. Please report: " + err.Error())
 			break
@@ -471,13 +1173,12 @@ Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipa
 	case opts["reveal"].(bool):
 		hiddenid := opts["<hidden_message_id>"].(string)
 
-		found := rds.Keys("hidden:*:" + hiddenid + ":*").Val()
-		if len(found) == 0 {
+		redisKey, ok := findHiddenMessage(hiddenid)
+		if !ok {
 			u.notifyAsReply("No hidden message found with the given id.", message.MessageID)
 			break
 		}
 
-		redisKey := found[0]
 		_, _, _, preview, satoshis, err := getHiddenMessage(redisKey)
 		if err != nil {
 			u.notify("Error loading hidden message. Please report: " + err.Error())
@@ -495,7 +1196,9 @@ Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipa
 			offset = limit * (page - 1)
 		}
 
-		txns, err := u.listTransactions(limit, offset, 16, Both)
+		search, _ := opts["--search"].(string)
+
+		txns, err := u.listTransactions(limit, offset, 16, search, Both)
 		if err != nil {
 			log.Warn().Err(err).Str("user", u.Username).
 				Msg("failed to list transactions")
@@ -506,10 +1209,13 @@ Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipa
 		if offset > 0 {
 			title = fmt.Sprintf("Transactions from %d to %d", offset+1, offset+limit)
 		}
+		if search != "" {
+			title += " matching \"" + escapeHTML(search) + "\""
+		}
 
 		u.notify(mustache.Render(`<b>{{title}}</b>
 {{#txns}}
-<code>{{StatusSmall}}</code> <code>{{PaddedSatoshis}}</code> {{Icon}} {{PeerActionDescription}}{{^TelegramPeer.Valid}}<i>{{Description}}</i>{{/TelegramPeer.Valid}} <i>{{TimeFormatSmall}}</i> /tx{{HashReduced}}
+<code>{{StatusSmall}}</code> <code>{{PaddedSatoshis}}</code> {{Icon}} {{PeerActionDescription}} <i>{{Description}}</i> <i>{{TimeFormatSmall}}</i> /tx{{HashReduced}}
 {{/txns}}
         `, map[string]interface{}{"title": title, "txns": txns}))
 		break
@@ -619,6 +1325,68 @@ Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipa
 		}
 
 		u.notify(fmt.Sprintf("<code>lndhub://%d:%s@%s</code>", u.Id, password, s.ServiceURL))
+	case opts["webhook"].(bool), opts["webhooks"].(bool):
+		if message.Chat.Type != "private" {
+			break
+		}
+
+		switch {
+		case opts["add"].(bool):
+			hook, err := u.addWebhook(opts["<url>"].(string))
+			if err != nil {
+				u.notifyAsReply("Failed to add webhook: "+err.Error(), message.MessageID)
+				break
+			}
+
+			u.notifyAsReply(fmt.Sprintf(
+				"Webhook <code>%d</code> added: %s\n<b>Secret</b>: <code>%s</code>",
+				hook.Id, escapeHTML(hook.URL), hook.Secret), message.MessageID)
+		case opts["remove"].(bool):
+			id, err := opts.Int("<webhook_id>")
+			if err == nil {
+				err = u.removeWebhook(id)
+			}
+			if err != nil {
+				u.notifyAsReply("Failed to remove webhook: "+err.Error(), message.MessageID)
+				break
+			}
+
+			u.notifyAsReply("Webhook removed.", message.MessageID)
+		case opts["log"].(bool):
+			id, err := opts.Int("<webhook_id>")
+			if err != nil {
+				u.notifyAsReply("Invalid webhook id.", message.MessageID)
+				break
+			}
+
+			deliveries, err := u.listWebhookDeliveries(id, 20)
+			if err != nil {
+				log.Warn().Err(err).Str("user", u.Username).Msg("failed to list webhook deliveries")
+				break
+			}
+
+			u.notify(mustache.Render(`<b>Latest deliveries for webhook {{id}}</b>
+{{#deliveries}}
+{{#Succeeded}}✅{{/Succeeded}}{{^Succeeded}}❌{{/Succeeded}} <code>{{Event}}</code> #{{Attempt}} {{#StatusCode.Valid}}<code>{{StatusCode.Int64}}</code> {{/StatusCode.Valid}}<i>{{Error.String}}</i>
+{{/deliveries}}{{^deliveries}}
+No deliveries yet.
+{{/deliveries}}
+            `, map[string]interface{}{"id": id, "deliveries": deliveries}))
+		default:
+			hooks, err := u.listWebhooks()
+			if err != nil {
+				log.Warn().Err(err).Str("user", u.Username).Msg("failed to list webhooks")
+				break
+			}
+
+			u.notify(mustache.Render(`<b>Webhooks</b>
+{{#hooks}}
+<code>{{Id}}</code> {{URL}}
+{{/hooks}}{{^hooks}}
+No webhooks registered. /help webhook
+{{/hooks}}
+            `, map[string]interface{}{"hooks": hooks}))
+		}
 	case opts["help"].(bool):
 		command, _ := opts.String("<command>")
 		handleHelp(u, command)
@@ -633,12 +1401,89 @@ Have contributed: %s`, receiverdisplayname, nparticipants, sats, sats*nparticipa
 		}
 
 		switch {
+		case opts["ticket"].(bool) && opts["window"].(bool):
+			window, err := parseInterval(opts["<duration>"].(string))
+			if err != nil || window < MIN_TICKET_WINDOW || window > MAX_TICKET_WINDOW {
+				notify(message.Chat.ID, fmt.Sprintf("The ticket window must be between %s and %s.",
+					formatInterval(MIN_TICKET_WINDOW), formatInterval(MAX_TICKET_WINDOW)))
+				break
+			}
+
+			err = setTicketSetting(message.Chat.ID, "ticket_window", int(window.Seconds()))
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to set ticket window")
+				break
+			}
+			notify(message.Chat.ID, fmt.Sprintf("New entrants will have %s to pay.", formatInterval(window)))
+		case opts["ticket"].(bool) && opts["ban"].(bool):
+			value := opts["<duration>"].(string)
+
+			var ban time.Duration
+			if value != "off" {
+				ban, err = parseInterval(value)
+				if err != nil || ban < MIN_TICKET_BAN || ban > MAX_TICKET_BAN {
+					notify(message.Chat.ID, fmt.Sprintf("The ban must be between %s and %s, or \"off\".",
+						formatInterval(MIN_TICKET_BAN), formatInterval(MAX_TICKET_BAN)))
+					break
+				}
+			}
+
+			err = setTicketSetting(message.Chat.ID, "ticket_ban", int(ban.Seconds()))
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to set ticket ban")
+				break
+			}
+			if ban == 0 {
+				notify(message.Chat.ID, "Those who don't pay will be kicked, but can join again.")
+			} else {
+				notify(message.Chat.ID, fmt.Sprintf("Those who don't pay will be banned for %s.", formatInterval(ban)))
+			}
+		case opts["ticket"].(bool) && opts["payee"].(bool):
+			payee := strings.ToLower(opts["<payee>"].(string))
+			if payee != "owner" && payee != "treasury" && payee != "admins" {
+				notify(message.Chat.ID, "Tickets can go to the \"owner\", the \"treasury\" or be split between the \"admins\".")
+				break
+			}
+			if _, err := getTreasury(message.Chat.ID); err != nil && payee == "treasury" {
+				notify(message.Chat.ID, "This group has no treasury yet, open one with /treasury first.")
+				break
+			}
+
+			err = setTicketSetting(message.Chat.ID, "ticket_payee", payee)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to set ticket payee")
+				break
+			}
+			notify(message.Chat.ID, map[string]string{
+				"owner":    "Tickets will go to the group owner.",
+				"treasury": "Tickets will go to the group treasury.",
+				"admins":   "Tickets will be split between the group admins.",
+			}[payee])
+		case opts["ticket"].(bool) && (opts["whitelist"].(bool) || opts["unwhitelist"].(bool)):
+			target, _, err := parseUsername(message, opts["<user>"])
+			if err != nil || target == nil {
+				notify(message.Chat.ID, "Who?")
+				break
+			}
+
+			whitelisted := opts["whitelist"].(bool)
+			err = setTicketWhitelisted(message.Chat.ID, *target, whitelisted)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to change ticket whitelist")
+				break
+			}
+			if whitelisted {
+				notify(message.Chat.ID, target.AtName()+" can join without a ticket.")
+			} else {
+				notify(message.Chat.ID, target.AtName()+" will need a ticket like everybody else.")
+			}
 		case opts["ticket"].(bool):
 			log.Debug().Int64("group", message.Chat.ID).Msg("toggling ticket")
 			price, err := opts.Int("<price>")
 			if err != nil {
 				setTicketPrice(message.Chat.ID, 0)
 				notify(message.Chat.ID, "This group is now free to join.")
+				break
 			}
 			setTicketPrice(message.Chat.ID, price)
 			notify(message.Chat.ID, fmt.Sprintf(
@@ -673,3 +1518,38 @@ func handleEditedMessage(message *tgbotapi.Message) {
 
 	handleMessage(message)
 }
+
+func handleReplyRoute(u User, kind, id string, message *tgbotapi.Message) {
+	switch kind {
+	case "inbox":
+		inboxId, err := strconv.Atoi(id)
+		if err != nil {
+			return
+		}
+		u.relayInboxReply(inboxId, message)
+	case "ask":
+		questionId, err := strconv.Atoi(id)
+		if err != nil {
+			return
+		}
+		u.answerQuestion(questionId, message)
+	case "auction":
+		auctionId, err := strconv.Atoi(id)
+		if err != nil {
+			return
+		}
+		u.bidFromReply(auctionId, message)
+	case "raffle":
+		raffleId, err := strconv.Atoi(id)
+		if err != nil {
+			return
+		}
+		u.buyRaffleTicketsFromReply(raffleId, message)
+	case "crowdfund":
+		crowdfundId, err := strconv.Atoi(id)
+		if err != nil {
+			return
+		}
+		u.contributeFromReply(crowdfundId, message)
+	}
+}
@@ -1,35 +1,81 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/fiatjaf/lightningd-gjson-rpc"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-var pendingApproval = make(map[string]KickData)
+const (
+	MIN_TICKET_WINDOW = time.Minute
+	MAX_TICKET_WINDOW = time.Hour * 24
+	MIN_TICKET_BAN    = time.Minute
+	MAX_TICKET_BAN    = time.Hour * 24 * 365
+)
+
+// a ticket is created when someone joins a group that charges for entry.
+// it starts "pending" and ends exactly once as "paid", "approved" (by an
+// admin), "kicked" (didn't pay in time) or "canceled" (we couldn't charge).
+// every transition is a single UPDATE ... WHERE status = 'pending', so when
+// a payment, an approval and the kick job race only one of them wins.
+type Ticket struct {
+	Id               int        `db:"id"`
+	ChatId           int64      `db:"chat_id"`
+	TelegramId       int        `db:"telegram_id"`
+	Username         string     `db:"username"`
+	Label            string     `db:"label"`
+	Hash             string     `db:"hash"`
+	Status           string     `db:"status"`
+	JoinMessageId    int        `db:"join_message_id"`
+	NotifyMessageId  int        `db:"notify_message_id"`
+	InvoiceMessageId int        `db:"invoice_message_id"`
+	ExpiresAt        time.Time  `db:"expires_at"`
+	CreatedAt        time.Time  `db:"created_at"`
+	ResolvedAt       *time.Time `db:"resolved_at"`
+	ResolvedBy       *int       `db:"resolved_by"`
+}
 
 func handleNewMember(joinMessage *tgbotapi.Message, newmember tgbotapi.User) {
-	sats, err := getTicketPrice(joinMessage.Chat.ID)
+	settings, err := getTicketSettings(joinMessage.Chat.ID)
 	if err != nil {
-		log.Error().Err(err).Str("chat", joinMessage.Chat.Title).Msg("error fetching ticket price for chat")
+		log.Error().Err(err).Str("chat", joinMessage.Chat.Title).Msg("error fetching ticket settings for chat")
 		return
 	}
+	sats := settings.Price
 
 	if sats == 0 {
 		// no ticket policy
 		return
 	}
 
+	if member, _, err := ensureUser(newmember.ID, newmember.UserName); err == nil &&
+		isTicketWhitelisted(joinMessage.Chat.ID, member) {
+		return
+	}
+
 	// label for the invoice that will be shown
 	label := fmt.Sprintf("newmember:%d:%d", newmember.ID, joinMessage.Chat.ID)
 
-	if _, isPending := pendingApproval[label]; isPending {
+	var ticket Ticket
+	err = pg.Get(&ticket, `
+INSERT INTO telegram.ticket (chat_id, telegram_id, username, label, join_message_id, expires_at)
+VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6))
+ON CONFLICT (chat_id, telegram_id) WHERE status = 'pending' DO NOTHING
+RETURNING *
+    `, joinMessage.Chat.ID, newmember.ID, newmember.UserName, label,
+		joinMessage.MessageID, settings.Window)
+	if err == sql.ErrNoRows {
 		// user joined, left and joined again.
 		// do nothing as the old timer is still counting.
 		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("label", label).Msg("failed to save ticket. allowing user.")
+		return
 	}
 
 	var username string
@@ -39,144 +85,275 @@ func handleNewMember(joinMessage *tgbotapi.Message, newmember tgbotapi.User) {
 		username = newmember.FirstName
 	}
 
-	notifyMessage := notify(joinMessage.Chat.ID, fmt.Sprintf(
-		"Hello, %s. You have 15min to pay the following invoice for %d sat if you want to stay in this group:",
-		username, sats))
+	chattable := tgbotapi.NewMessage(joinMessage.Chat.ID, fmt.Sprintf(
+		"Hello, %s. You have %s to pay the following invoice for %d sat if you want to stay in this group:",
+		escapeHTML(username), formatInterval(settings.WindowDuration()), sats))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Approve (admins)",
+				fmt.Sprintf("ticket=approve-%d", newmember.ID)),
+		),
+	)
+	notifyMessage, _ := bot.Send(chattable)
+	pg.Exec(`UPDATE telegram.ticket SET notify_message_id = $2 WHERE id = $1`,
+		ticket.Id, notifyMessage.MessageID)
 
 	ln.Call("delinvoice", label, "unpaid")  // we don't care if it doesn't exist
 	ln.Call("delinvoice", label, "paid")    // we don't care if it doesn't exist
 	ln.Call("delinvoice", label, "expired") // we don't care if it doesn't exist
 
-	chatOwner, err := getChatOwner(joinMessage.Chat.ID)
+	receiver, err := ticketReceiver(joinMessage.Chat.ID)
 	if err != nil {
 		log.Warn().Err(err).Msg("chat has no owner, failed to create a ticket invoice. allowing user.")
+		resolveTicket(label, "canceled", nil)
 		return
 	}
 
-	expiration := time.Minute * 15
+	expiration := settings.WindowDuration()
 
-	bolt11, hash, qrpath, err := chatOwner.makeInvoice(sats, fmt.Sprintf(
+	bolt11, hash, qrpath, err := receiver.makeInvoice(sats, fmt.Sprintf(
 		"ticket for %s to join %s (%d).",
 		username, joinMessage.Chat.Title, joinMessage.Chat.ID,
 	), label, &expiration, nil, "", false)
+	if err != nil {
+		log.Warn().Err(err).Str("label", label).Msg("failed to create a ticket invoice. allowing user.")
+		resolveTicket(label, "canceled", nil)
+		return
+	}
+
+	// the hash must be there before anyone can see the invoice
+	pg.Exec(`UPDATE telegram.ticket SET hash = $2 WHERE id = $1`, ticket.Id, hash)
 
 	invoiceMessage := notifyWithPicture(joinMessage.Chat.ID, qrpath, bolt11)
+	pg.Exec(`UPDATE telegram.ticket SET invoice_message_id = $2 WHERE id = $1`,
+		ticket.Id, invoiceMessage.MessageID)
+}
 
-	kickdata := KickData{
-		invoiceMessage,
-		notifyMessage,
-		*joinMessage,
-		tgbotapi.ChatMemberConfig{
-			UserID: newmember.ID,
-			ChatID: joinMessage.Chat.ID,
-		},
-		newmember,
-		hash,
+// resolveTicket moves a pending ticket to its final status. it fails with
+// sql.ErrNoRows if the ticket was already resolved by someone else.
+func resolveTicket(label string, status string, by *User) (ticket Ticket, err error) {
+	var resolvedBy interface{}
+	if by != nil {
+		resolvedBy = by.Id
 	}
 
-	kickdatajson, _ := json.Marshal(kickdata)
-	err = rds.HSet("ticket-pending", label, string(kickdatajson)).Err()
-	if err != nil {
-		log.Warn().Err(err).Str("kickdata", string(kickdatajson)).Msg("error saving kickdata")
+	err = pg.Get(&ticket, `
+UPDATE telegram.ticket SET status = $2, resolved_at = now(), resolved_by = $3
+WHERE label = $1 AND status = 'pending'
+RETURNING *
+    `, label, status, resolvedBy)
+	return
+}
+
+// pendingTicketLabel returns the label of the pending ticket that has an
+// invoice with the given hash.
+func pendingTicketLabel(hash string) (label string, ok bool) {
+	err := pg.Get(&label, `
+SELECT label FROM telegram.ticket WHERE hash = $1 AND status = 'pending'
+    `, hash)
+	return label, err == nil
+}
+
+func (t Ticket) deleteMessages(ids ...int) {
+	for _, id := range ids {
+		if id != 0 {
+			bot.Send(tgbotapi.NewDeleteMessage(t.ChatId, id))
+		}
 	}
-	pendingApproval[label] = kickdata
-	go waitToKick(label, kickdata)
 }
 
-func waitToKick(label string, kickdata KickData) {
-	log.Debug().Str("label", label).Msg("waiting to kick")
-	invpaid, err := ln.CallWithCustomTimeout(time.Minute*60, "waitinvoice", label)
-	if err == nil && invpaid.Get("status").String() == "paid" {
-		// the user did pay. allow.
-		ticketPaid(label, kickdata)
+// kickExpiredTickets removes everybody who didn't pay in time. it runs
+// periodically, so tickets pending when the bot restarts are still enforced.
+func kickExpiredTickets() {
+	var tickets []Ticket
+	err := pg.Select(&tickets, `
+UPDATE telegram.ticket SET status = 'kicked', resolved_at = now()
+WHERE status = 'pending' AND expires_at < now()
+RETURNING *
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch expired tickets")
 		return
-	} else if err != nil {
-		if cmderr, ok := err.(lightning.ErrorCommand); ok {
-			if cmderr.Code == -1 {
-				log.Info().Str("label", label).
-					Msg("invoice deleted, assume it was paid internally")
-				ticketPaid(label, kickdata)
-				return
-			} else if cmderr.Code == -2 {
-				if _, isPending := pendingApproval[label]; !isPending {
-					// not pending anymore, means the invoice was paid internally. don't kick.
-					return
-				}
-
-				// didn't pay. kick.
-				log.Info().Str("label", label).Msg("invoice expired, kicking user")
-
-				banuntil := time.Now()
-				banuntil.AddDate(0, 0, 1)
-
-				bot.KickChatMember(tgbotapi.KickChatMemberConfig{
-					kickdata.ChatMemberConfig,
-					banuntil.Unix(),
-				})
-
-				delete(pendingApproval, label)
-				rds.HDel("ticket-pending", label)
-
-				// delete messages
-				deleteMessage(&kickdata.JoinMessage)
-				deleteMessage(&kickdata.NotifyMessage)
-				deleteMessage(&kickdata.InvoiceMessage)
-				return
-			}
+	}
+
+	for _, t := range tickets {
+		// didn't pay. kick.
+		log.Info().Str("label", t.Label).Msg("ticket expired, kicking user")
+
+		member := tgbotapi.ChatMemberConfig{
+			UserID: t.TelegramId,
+			ChatID: t.ChatId,
 		}
-		log.Warn().Err(err).Msg("unexpected error while waiting to kick")
-	} else {
-		// should never happen
-		log.Error().Str("invoice", invpaid.String()).
-			Msg("got a response for an invoice that wasn't paid. shouldn't have happened.")
+
+		settings, _ := getTicketSettings(t.ChatId)
+		banuntil := time.Now().Add(settings.BanDuration())
+
+		bot.KickChatMember(tgbotapi.KickChatMemberConfig{
+			member,
+			banuntil.Unix(),
+		})
+		if settings.Ban == 0 {
+			// kick only, they can come back
+			bot.UnbanChatMember(member)
+		}
+
+		ln.Call("delinvoice", t.Label, "unpaid")
+		t.deleteMessages(t.JoinMessageId, t.NotifyMessageId, t.InvoiceMessageId)
 	}
 }
 
-func ticketPaid(label string, kickdata KickData) {
-	log.Debug().Str("label", label).Msg("ticket paid")
-	delete(pendingApproval, label)
-	rds.HDel("ticket-pending", label)
+func ticketOnEvent(event interface{}) {
+	if ev, ok := event.(TicketPaid); ok {
+		if ticketPaid(ev.Label) {
+			shareTicketWithAdmins(ev)
+		}
+	}
+}
 
-	// delete the invoice message
-	deleteMessage(&kickdata.InvoiceMessage)
+// shareTicketWithAdmins splits what the owner got for a ticket among all the
+// admins, when that's the group setting. all the shares are paid together.
+func shareTicketWithAdmins(ev TicketPaid) {
+	parts := strings.Split(ev.Label, ":")
+	chatId, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return
+	}
 
-	user, _, _ := ensureUser(kickdata.NewMember.ID, kickdata.NewMember.UserName)
+	settings, err := getTicketSettings(chatId)
+	if err != nil || settings.Payee != "admins" {
+		return
+	}
 
-	// replace caption
-	_, err := bot.Send(tgbotapi.NewEditMessageText(
-		kickdata.NotifyMessage.Chat.ID,
-		kickdata.NotifyMessage.MessageID,
-		"Invoice paid. "+user.AtName()+" allowed.",
-	))
-	if err != nil {
-		log.Warn().Err(err).Msg("failed to replace invoice with 'paid' message.")
+	admins, err := getChatAdmins(chatId)
+	if err != nil || len(admins) < 2 {
+		return
 	}
-}
 
-func startKicking() {
-	data, err := rds.HGetAll("ticket-pending").Result()
+	weights := make([]int, len(admins))
+	for i := range weights {
+		weights[i] = 1
+	}
+	shares := splitShares(int(ev.Msats), weights)
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
-		log.Warn().Err(err).Msg("error getting tickets pending")
+		log.Warn().Err(err).Str("label", ev.Label).Msg("failed to share ticket with admins")
 		return
 	}
+	defer txn.Rollback()
 
-	for label, kickdatastr := range data {
-		var kickdata KickData
-		err := json.Unmarshal([]byte(kickdatastr), &kickdata)
-		if err != nil {
-			log.Warn().Err(err).Msg("failed to unmarshal kickdata from redis")
+	desc := "share of a group ticket"
+	var events []InternalTransfer
+	for i, admin := range admins {
+		if admin.Id == ev.Owner.Id || shares[i] == 0 {
 			continue
 		}
 
-		log.Debug().Msg("restarted kick invoice wait")
-		pendingApproval[label] = kickdata
-		go waitToKick(label, kickdata)
+		var hash string
+		err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description)
+VALUES ($1, $2, $3, $4)
+RETURNING payment_hash
+        `, ev.Owner.Id, admin.Id, shares[i], desc)
+		if err != nil {
+			log.Warn().Err(err).Str("label", ev.Label).Msg("failed to share ticket with admins")
+			return
+		}
+
+		events = append(events, InternalTransfer{
+			From:        ev.Owner,
+			To:          admin,
+			Msats:       shares[i],
+			Hash:        hash,
+			Description: desc,
+		})
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, ev.Owner.Id)
+	if err != nil || balance < 0 {
+		log.Warn().Err(err).Int64("balance", balance).Str("label", ev.Label).
+			Msg("failed to share ticket with admins")
+		return
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		log.Warn().Err(err).Str("label", ev.Label).Msg("failed to share ticket with admins")
+		return
+	}
+
+	for _, event := range events {
+		publish(event)
 	}
 }
 
+// ticketApproved lets a new member stay without paying, by decision of an admin.
+func ticketApproved(label string, admin User) (err error) {
+	ticket, err := resolveTicket(label, "approved", &admin)
+	if err != nil {
+		return
+	}
+
+	log.Debug().Str("label", label).Str("admin", admin.Username).Msg("ticket approved")
+
+	ln.Call("delinvoice", label, "unpaid")
+	ticket.deleteMessages(ticket.InvoiceMessageId)
+
+	user, _, _ := ensureUser(ticket.TelegramId, ticket.Username)
+	bot.Send(tgbotapi.NewEditMessageText(
+		ticket.ChatId,
+		ticket.NotifyMessageId,
+		user.AtName()+" was approved by "+admin.AtName()+".",
+	))
+	return
+}
+
+// ticketPaid lets the new member stay. it tells if the ticket was still
+// pending, as it may have been approved or kicked in the meantime.
+func ticketPaid(label string) bool {
+	ticket, err := resolveTicket(label, "paid", nil)
+	if err != nil {
+		// already handled
+		return false
+	}
+
+	log.Debug().Str("label", label).Msg("ticket paid")
+
+	// delete the invoice message
+	ticket.deleteMessages(ticket.InvoiceMessageId)
+
+	user, _, _ := ensureUser(ticket.TelegramId, ticket.Username)
+
+	// replace caption
+	_, err = bot.Send(tgbotapi.NewEditMessageText(
+		ticket.ChatId,
+		ticket.NotifyMessageId,
+		"Invoice paid. "+user.AtName()+" allowed.",
+	))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to replace invoice with 'paid' message.")
+	}
+	return true
+}
+
 func interceptMessage(message *tgbotapi.Message) (proceed bool) {
-	label := fmt.Sprintf("newmember:%d:%d", message.From.ID, message.Chat.ID)
-	if _, isPending := pendingApproval[label]; isPending {
+	if message.Chat.Type == "private" || !hasTicket(message.Chat.ID) {
+		return true
+	}
+
+	var isPending bool
+	pg.Get(&isPending, `
+SELECT EXISTS (
+  SELECT 1 FROM telegram.ticket
+  WHERE chat_id = $1 AND telegram_id = $2 AND status = 'pending'
+)
+    `, message.Chat.ID, message.From.ID)
+	if isPending {
 		log.Debug().Str("user", message.From.String()).Msg("user pending, can't speak")
 		return false
 	}
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf16"
 
 	"github.com/fiatjaf/lightningd-gjson-rpc"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
@@ -55,17 +56,17 @@ func parseLabel(label string) (messageId, userId int, preimage string, ok bool)
 	return
 }
 
-func chatOwnerFromTicketLabel(label string) (owner User, err error) {
+func ticketReceiverFromLabel(label string) (receiver User, err error) {
 	parts := strings.Split(label, ":")
-	chatId, err := strconv.Atoi(parts[2])
+	chatId, err := strconv.ParseInt(parts[2], 10, 64)
 	if err != nil {
 		log.Error().Err(err).Str("label", label).Msg("failed to parse ticket invoice")
 		return
 	}
 
-	owner, err = getChatOwner(int64(chatId))
+	receiver, err = ticketReceiver(chatId)
 	if err != nil {
-		log.Error().Err(err).Str("label", label).Msg("failed to get chat owner in ticket invoice handling")
+		log.Error().Err(err).Str("label", label).Msg("failed to get ticket receiver in ticket invoice handling")
 		return
 	}
 
@@ -277,6 +278,37 @@ func hashFromPreimage(preimage string) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// splitReceiverAndMemo separates the words that identify the receiver of a send
+// (an @username, a telegram id or a text_mention, which may span many words)
+// from the words after it, which are a memo.
+func splitReceiverAndMemo(message *tgbotapi.Message, words []string) (receiver []string, memo string) {
+	if len(words) == 0 {
+		return
+	}
+
+	if _, err := strconv.Atoi(words[0]); err == nil || strings.HasPrefix(words[0], "@") {
+		return words[:1], strings.Join(words[1:], " ")
+	}
+
+	if message.Entities != nil {
+		text := utf16.Encode([]rune(message.Text))
+		for _, entity := range *message.Entities {
+			if entity.Type == "text_mention" && entity.User != nil &&
+				entity.Offset+entity.Length <= len(text) {
+				name := string(utf16.Decode(text[entity.Offset : entity.Offset+entity.Length]))
+				n := len(strings.Fields(name))
+				if n > len(words) {
+					n = len(words)
+				}
+				return words[:n], strings.Join(words[n:], " ")
+			}
+		}
+	}
+
+	// no receiver, maybe this is a reply-tip
+	return nil, strings.Join(words, " ")
+}
+
 func parseUsername(message *tgbotapi.Message, value interface{}) (u *User, display string, err error) {
 	var username string
 	var user User
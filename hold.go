@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// a hold takes funds out of an account's balance without giving them to
+// anyone yet. they are later captured (given to someone) or released (given
+// back). it's always a single lightning.transaction with a hold_id, so it
+// shows up in /transactions and /tx for both parties during its whole life.
+type Hold struct {
+	Id          string `db:"id"`
+	Status      string `db:"status"`
+	FromId      int    `db:"from_id"`
+	ToId        int    `db:"to_id"`
+	Msats       int    `db:"amount"`
+	Hash        string `db:"payment_hash"`
+	Description string `db:"description"`
+}
+
+// holdFunds must be called inside a serializable transaction, which should
+// be committed by the caller. toId may be 0 when the final receiver is not known.
+func holdFunds(
+	txn *sqlx.Tx,
+	holdId string,
+	from User,
+	toId int,
+	msats int,
+	desc string,
+	messageId int,
+) (hash string, errMsg string, err error) {
+	if msats <= 0 {
+		return "", "Invalid amount.", errors.New("invalid amount")
+	}
+	if toId == from.Id {
+		return "", "Can't pay yourself.", errors.New("user trying to pay itself")
+	}
+
+	_, err = txn.Exec(`INSERT INTO lightning.hold (id) VALUES ($1)`, holdId)
+	if err != nil {
+		return "", "Database error.", err
+	}
+
+	var vto interface{}
+	if toId != 0 {
+		vto = toId
+	}
+
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction
+  (from_id, to_id, amount, description, trigger_message, hold_id)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING payment_hash
+    `, from.Id, vto, msats, desc, messageId, holdId)
+	if err != nil {
+		return "", "Database error.", err
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, from.Id)
+	if err != nil {
+		return "", "Database error.", err
+	}
+
+	if balance < 0 {
+		return "", fmt.Sprintf("Insufficient balance. Needs %.3f sat more.",
+				-float64(balance)/1000),
+			errors.New("insufficient balance")
+	}
+
+	return hash, "", nil
+}
+
+// captureHold delivers the held funds to toId (or to the receiver given when
+// the hold was created, if toId is 0). the caller must commit the transaction.
+func captureHold(txn *sqlx.Tx, holdId string, toId int, note string) (hold Hold, err error) {
+	hold, err = resolveHold(txn, holdId, "captured", note)
+	if err != nil {
+		return
+	}
+
+	if toId == 0 {
+		toId = hold.ToId
+	}
+	if toId == 0 {
+		return hold, errors.New("hold has no receiver")
+	}
+	if toId == hold.FromId {
+		return hold, errors.New("can't capture a hold to its owner, release it instead")
+	}
+
+	_, err = txn.Exec(`
+UPDATE lightning.transaction SET to_id = $2, time = now() WHERE hold_id = $1
+    `, holdId, toId)
+	hold.ToId = toId
+	return
+}
+
+// releaseHold gives the held funds back. the caller must commit the transaction.
+func releaseHold(txn *sqlx.Tx, holdId string, note string) (hold Hold, err error) {
+	return resolveHold(txn, holdId, "released", note)
+}
+
+func resolveHold(txn *sqlx.Tx, holdId, status, note string) (hold Hold, err error) {
+	err = txn.Get(&hold, `
+WITH resolved AS (
+  UPDATE lightning.hold
+  SET status = $2, note = $3, resolved_at = now()
+  WHERE id = $1 AND status = 'held'
+  RETURNING id, status
+)
+SELECT r.id, r.status, t.from_id, coalesce(t.to_id, 0) AS to_id,
+  t.amount, t.payment_hash, coalesce(t.description, '') AS description
+FROM resolved AS r
+INNER JOIN lightning.transaction AS t ON t.hold_id = r.id
+    `, holdId, status, note)
+	return
+}
+
+type HoldHistory struct {
+	Status     string `db:"status"`
+	Note       string `db:"note"`
+	CreatedAt  string `db:"created_at"`
+	ResolvedAt string `db:"resolved_at"`
+}
+
+func getHoldHistory(hash string) (history HoldHistory, err error) {
+	err = pg.Get(&history, `
+SELECT h.status, coalesce(h.note, '') AS note,
+  to_char(h.created_at, 'DD Mon YYYY HH24:MI') AS created_at,
+  coalesce(to_char(h.resolved_at, 'DD Mon YYYY HH24:MI'), '') AS resolved_at
+FROM lightning.hold AS h
+INNER JOIN lightning.transaction AS t ON t.hold_id = h.id
+WHERE t.payment_hash = $1
+    `, hash)
+	return
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// how long the "Reply" prompts stay valid
+const INBOX_REPLY_EXPIRATION = time.Hour * 24
+
+type InboxSettings struct {
+	Price   int   `json:"price"` // in satoshis, 0 means the inbox is closed
+	Blocked []int `json:"blocked"`
+}
+
+func (s InboxSettings) isBlocked(id int) bool {
+	for _, blocked := range s.Blocked {
+		if blocked == id {
+			return true
+		}
+	}
+	return false
+}
+
+type InboxMessage struct {
+	Id          int       `db:"id"`
+	SenderId    int       `db:"sender_id"`
+	RecipientId int       `db:"recipient_id"`
+	Amount      int       `db:"amount"`
+	Refunded    bool      `db:"refunded"`
+	SenderTurn  bool      `db:"sender_turn"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+func (u User) getInboxSettings() (settings InboxSettings) {
+	// a missing inbox is the same as a closed one
+	u.getAppData("inbox", &settings)
+	return
+}
+
+func (u User) setInboxPrice(sats int) error {
+	settings := u.getInboxSettings()
+	settings.Price = sats
+	return u.setAppData("inbox", settings)
+}
+
+func (u User) blockInboxSender(id int) error {
+	settings := u.getInboxSettings()
+	if settings.isBlocked(id) {
+		return nil
+	}
+	settings.Blocked = append(settings.Blocked, id)
+	return u.setAppData("inbox", settings)
+}
+
+func (u User) unblockInboxSender(id int) error {
+	settings := u.getInboxSettings()
+	blocked := make([]int, 0, len(settings.Blocked))
+	for _, b := range settings.Blocked {
+		if b != id {
+			blocked = append(blocked, b)
+		}
+	}
+	settings.Blocked = blocked
+	return u.setAppData("inbox", settings)
+}
+
+func inboxKeyboard(inboxId int, recipient bool) tgbotapi.InlineKeyboardMarkup {
+	row := []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("Reply", fmt.Sprintf("inbox=reply-%d", inboxId)),
+	}
+	if recipient {
+		row = append(row,
+			tgbotapi.NewInlineKeyboardButtonData("Refund", fmt.Sprintf("inbox=refund-%d", inboxId)),
+			tgbotapi.NewInlineKeyboardButtonData("Block", fmt.Sprintf("inbox=block-%d", inboxId)),
+		)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// sendToInbox pays the recipient's inbox price and relays the message.
+func (u User) sendToInbox(recipient User, content string, messageId int) (errMsg string, err error) {
+	if recipient.Id == u.Id {
+		return "Can't message yourself.", errors.New("sending to own inbox")
+	}
+	if recipient.ChatId == 0 {
+		return fmt.Sprintf("%s can't receive messages through the bot.", recipient.AtName()),
+			errors.New("recipient has no chat")
+	}
+
+	settings := recipient.getInboxSettings()
+	if settings.Price <= 0 {
+		return fmt.Sprintf("%s doesn't have an open inbox.", recipient.AtName()),
+			errors.New("inbox closed")
+	}
+	if settings.isBlocked(u.Id) {
+		return fmt.Sprintf("%s doesn't accept your messages.", recipient.AtName()),
+			errors.New("sender blocked")
+	}
+
+	// the payment and the inbox message are saved together, so every paid
+	// message can be refunded
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return "Database error.", err
+	}
+	defer txn.Rollback()
+
+	desc := "inbox message to " + recipient.AtName()
+	var hash string
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, trigger_message)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING payment_hash
+    `, u.Id, recipient.Id, settings.Price*1000, desc, messageId)
+	if err != nil {
+		return "Database error.", err
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, u.Id)
+	if err != nil {
+		return "Database error.", err
+	}
+	if balance < 0 {
+		return fmt.Sprintf("Insufficient balance. Needs %.3f sat more.",
+				-float64(balance)/1000),
+			errors.New("insufficient balance")
+	}
+
+	var inboxId int
+	err = txn.Get(&inboxId, `
+INSERT INTO telegram.inbox_message (sender_id, recipient_id, amount)
+VALUES ($1, $2, $3)
+RETURNING id
+    `, u.Id, recipient.Id, settings.Price)
+	if err != nil {
+		return "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return "Unable to pay due to internal database error.", err
+	}
+
+	publish(InternalTransfer{
+		From:        u,
+		To:          recipient,
+		Msats:       settings.Price * 1000,
+		Hash:        hash,
+		Description: desc,
+	})
+
+	chattable := tgbotapi.NewMessage(recipient.ChatId, fmt.Sprintf(
+		"✉️ Message from %s (paid %d sat):\n\n%s",
+		u.AtName(), settings.Price, escapeHTML(content)))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = inboxKeyboard(inboxId, true)
+	bot.Send(chattable)
+
+	return "", nil
+}
+
+func loadInboxMessage(id int, partyId int) (msg InboxMessage, err error) {
+	err = pg.Get(&msg, `
+SELECT id, sender_id, recipient_id, amount, refunded, sender_turn, created_at
+FROM telegram.inbox_message
+WHERE id = $1 AND (sender_id = $2 OR recipient_id = $2)
+    `, id, partyId)
+	return
+}
+
+// promptInboxReply asks u to write an answer, which will be relayed to the
+// other party of the inbox thread by relayInboxReply.
+func (u User) promptInboxReply(inboxId int) (errMsg string, err error) {
+	msg, err := loadInboxMessage(inboxId, u.Id)
+	if err != nil {
+		return "This conversation doesn't exist anymore.", err
+	}
+
+	otherId := msg.SenderId
+	if u.Id == msg.SenderId {
+		if !msg.SenderTurn {
+			return "Wait for an answer before writing again.", errors.New("not sender's turn")
+		}
+		otherId = msg.RecipientId
+	}
+	other, err := loadUser(otherId, 0)
+	if err != nil {
+		return "Database error.", err
+	}
+
+	chattable := tgbotapi.NewMessage(u.ChatId,
+		fmt.Sprintf("Write your answer to %s as a reply to this message.", other.AtName()))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	prompt, err := bot.Send(chattable)
+	if err != nil {
+		return "Failed to send the prompt.", err
+	}
+
+	setReplyRoute(u.ChatId, prompt.MessageID, "inbox:"+strconv.Itoa(inboxId), INBOX_REPLY_EXPIRATION)
+	return "", nil
+}
+
+// relayInboxReply delivers an answer in an inbox thread. the recipient can
+// always answer for free, the sender gets one free answer for each of theirs,
+// unless they were blocked.
+func (u User) relayInboxReply(inboxId int, message *tgbotapi.Message) {
+	if message.Text == "" {
+		u.notifyAsReply("Only text can be relayed.", message.MessageID)
+		return
+	}
+
+	msg, err := loadInboxMessage(inboxId, u.Id)
+	if err != nil {
+		u.notifyAsReply("This conversation doesn't exist anymore.", message.MessageID)
+		return
+	}
+
+	recipient, _ := loadUser(msg.RecipientId, 0)
+	if u.Id == msg.SenderId && recipient.getInboxSettings().isBlocked(u.Id) {
+		u.notifyAsReply(fmt.Sprintf("%s doesn't accept your messages.", recipient.AtName()),
+			message.MessageID)
+		return
+	}
+
+	if u.Id == msg.SenderId {
+		// use up the sender's turn before relaying, so it can't be used twice
+		res, err := pg.Exec(`
+UPDATE telegram.inbox_message SET sender_turn = false
+WHERE id = $1 AND sender_turn
+        `, inboxId)
+		if err != nil {
+			u.notifyAsReply("Database error.", message.MessageID)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			u.notifyAsReply(fmt.Sprintf("Wait for %s to answer before writing again, or send a new message with /dm.",
+				recipient.AtName()), message.MessageID)
+			return
+		}
+	}
+
+	other := recipient
+	if u.Id == msg.RecipientId {
+		other, _ = loadUser(msg.SenderId, 0)
+	}
+	if other.ChatId == 0 {
+		u.notifyAsReply(fmt.Sprintf("%s can't receive messages through the bot anymore.",
+			other.AtName()), message.MessageID)
+		return
+	}
+
+	chattable := tgbotapi.NewMessage(other.ChatId, fmt.Sprintf("↩️ %s answered:\n\n%s",
+		u.AtName(), escapeHTML(message.Text)))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = inboxKeyboard(inboxId, other.Id == msg.RecipientId)
+	_, err = bot.Send(chattable)
+	if err != nil {
+		if u.Id == msg.SenderId {
+			pg.Exec(`UPDATE telegram.inbox_message SET sender_turn = true WHERE id = $1`, inboxId)
+		}
+		u.notifyAsReply("Failed to relay your answer.", message.MessageID)
+		return
+	}
+
+	if u.Id == msg.RecipientId {
+		// the sender may answer this once
+		pg.Exec(`UPDATE telegram.inbox_message SET sender_turn = true WHERE id = $1`, inboxId)
+	}
+
+	u.notifyAsReply("Answer delivered.", message.MessageID)
+}
+
+// refundInboxMessage gives the price of an inbox message back to its sender.
+func (u User) refundInboxMessage(inboxId int) (msg InboxMessage, errMsg string, err error) {
+	err = pg.Get(&msg, `
+UPDATE telegram.inbox_message SET refunded = true
+WHERE id = $1 AND recipient_id = $2 AND NOT refunded
+RETURNING id, sender_id, recipient_id, amount, refunded, sender_turn, created_at
+    `, inboxId, u.Id)
+	if err != nil {
+		return msg, "This message can't be refunded.", err
+	}
+
+	sender, err := loadUser(msg.SenderId, 0)
+	if err != nil {
+		return msg, "Database error.", err
+	}
+
+	errMsg, err = u.sendInternally(0, 0, sender, false, msg.Amount*1000,
+		"inbox refund from "+u.AtName(), nil)
+	if err != nil {
+		pg.Exec(`UPDATE telegram.inbox_message SET refunded = false WHERE id = $1`, inboxId)
+		return
+	}
+
+	sender.notify(fmt.Sprintf("%s refunded the %d sat you paid to message them.",
+		u.AtName(), msg.Amount))
+	return msg, "", nil
+}
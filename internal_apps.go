@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lucsky/cuid"
 )
 
 // hide and reveal
@@ -38,6 +39,50 @@ func getHiddenMessage(redisKey string) (sourceuser int, id, content, preview str
 	return
 }
 
+func createHiddenMessage(u User, sats int, content string) (hiddenid string, err error) {
+	hiddenid = cuid.Slug()
+	err = rds.Set(fmt.Sprintf("hidden:%d:%s:%d", u.Id, hiddenid, sats), content, s.HiddenMessageTimeout).Err()
+	return
+}
+
+func findHiddenMessage(hiddenid string) (redisKey string, ok bool) {
+	found := rds.Keys("hidden:*:" + hiddenid + ":*").Val()
+	if len(found) == 0 {
+		return "", false
+	}
+	return found[0], true
+}
+
+// revealHiddenMessage pays the author of the hidden message and returns its content.
+// both parties are notified.
+func revealHiddenMessage(revealer User, messageId int, redisKey string) (content string, errMsg string, err error) {
+	sourceUserId, hiddenid, content, _, satoshis, err := getHiddenMessage(redisKey)
+	if err != nil {
+		return "", "Hidden message not found.", err
+	}
+
+	sourceuser, err := loadUser(sourceUserId, 0)
+	if err != nil {
+		log.Warn().Err(err).
+			Int("id", sourceUserId).
+			Msg("failed to load source user on reveal")
+		return "", "Error.", err
+	}
+
+	errMsg, err = revealer.sendInternally(messageId, 0, sourceuser, false, satoshis*1000, "reveal", nil)
+	if err != nil {
+		return "", "Failed to reveal: " + errMsg, err
+	}
+
+	revealer.notify(fmt.Sprintf("%d sat paid to reveal the message <code>%s</code>.", satoshis, hiddenid))
+	sourceuser.notify(
+		fmt.Sprintf("Hidden message <code>%s</code> revealed by %s. You've got %d sat.",
+			hiddenid, revealer.AtName(), satoshis),
+	)
+
+	return content, "", nil
+}
+
 func revealKeyboard(fullRedisKey string, sats int) tgbotapi.InlineKeyboardMarkup {
 	return tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Invoice struct {
+	Hash        string          `db:"payment_hash"`
+	Label       string          `db:"label"`
+	Bolt11      string          `db:"bolt11"`
+	Description string          `db:"description"`
+	Amount      sql.NullFloat64 `db:"amount"`
+	PaidAmount  float64         `db:"paid_amount"`
+	Status      string          `db:"status"`
+	CreatedAt   time.Time       `db:"created_at"`
+	ExpiresAt   time.Time       `db:"expires_at"`
+}
+
+const INVOICEFIELDS = `
+  payment_hash,
+  label,
+  bolt11,
+  description,
+  amount::float/1000 AS amount,
+  coalesce(paid_amount, 0)::float/1000 AS paid_amount,
+  CASE
+    WHEN paid_at IS NOT NULL THEN 'PAID'
+    WHEN expires_at < now() THEN 'EXPIRED'
+    ELSE 'UNPAID'
+  END AS status,
+  created_at,
+  expires_at
+`
+
+func (inv Invoice) IsPaid() bool {
+	return inv.Status == "PAID"
+}
+
+func (inv Invoice) IsExpired() bool {
+	return inv.Status == "EXPIRED"
+}
+
+func (inv Invoice) Expiry() time.Duration {
+	return inv.ExpiresAt.Sub(inv.CreatedAt)
+}
+
+func saveInvoice(
+	accountId int,
+	hash, label, bolt11, desc string,
+	msatoshi interface{},
+	expiry time.Duration,
+) (err error) {
+	var vamount sql.NullInt64
+	if msats, ok := msatoshi.(int); ok {
+		vamount.Scan(int64(msats))
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO lightning.invoice
+  (payment_hash, account_id, label, bolt11, description, amount, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, now() + make_interval(secs => $7))
+ON CONFLICT (payment_hash) DO NOTHING
+    `, hash, accountId, label, bolt11, desc, vamount, expiry.Seconds())
+	return
+}
+
+func markInvoicePaid(hash string, msats int64) (err error) {
+	_, err = pg.Exec(`
+UPDATE lightning.invoice
+SET paid_at = now(), paid_amount = $2
+WHERE payment_hash = $1 AND paid_at IS NULL
+    `, hash, msats)
+	return
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const LEADERBOARD_SIZE = 10
+
+type LeaderboardEntry struct {
+	AccountId int `db:"account_id"`
+	Sats      int `db:"sats"`
+}
+
+type GroupStats struct {
+	Volume     int `db:"volume"`
+	Transfers  int `db:"transfers"`
+	Giveaways  int `db:"giveaways"`
+	Coinflips  int `db:"coinflips"`
+	Recipients int `db:"recipients"`
+}
+
+// periodStart is the beginning of "week", "month" or "all" (zero time).
+func periodStart(period string) time.Time {
+	switch period {
+	case "week":
+		return time.Now().AddDate(0, 0, -7)
+	case "month":
+		return time.Now().AddDate(0, -1, 0)
+	default:
+		return time.Time{}
+	}
+}
+
+// only transactions that actually moved money count: no pending ones and
+// no holds that were released or are still held.
+const GROUP_TXN_FILTER = `
+  t.chat_id = $1 AND t.time > $2 AND NOT t.pending
+  AND (t.hold_id IS NULL OR EXISTS (
+    SELECT 1 FROM lightning.hold AS h WHERE h.id = t.hold_id AND h.status = 'captured'
+  ))
+`
+
+// leaderboard lists the biggest senders (side "from_id") or receivers (side
+// "to_id") in a group. anonymous sends are never attributed to their senders
+// and users hidden by the admins never appear.
+func leaderboard(chatId int64, side string, since time.Time) (entries []LeaderboardEntry, err error) {
+	anonymous := ""
+	if side == "from_id" {
+		anonymous = "AND NOT t.anonymous"
+	}
+
+	err = pg.Select(&entries, `
+SELECT t.`+side+` AS account_id, (sum(t.amount) / 1000)::int AS sats
+FROM lightning.transaction AS t
+WHERE `+GROUP_TXN_FILTER+` `+anonymous+`
+  AND t.`+side+` IS NOT NULL
+  AND t.`+side+` NOT IN (
+    SELECT account_id FROM telegram.leaderboard_hidden WHERE chat_id = $1
+  )
+GROUP BY t.`+side+`
+ORDER BY sats DESC
+LIMIT $3
+    `, chatId, since, LEADERBOARD_SIZE)
+	return
+}
+
+func groupStats(chatId int64, since time.Time) (stats GroupStats, err error) {
+	err = pg.Get(&stats, `
+SELECT
+  coalesce((sum(t.amount) / 1000)::int, 0) AS volume,
+  count(*) AS transfers,
+  count(DISTINCT t.to_id) AS recipients,
+  (SELECT count(*) FROM telegram.game
+    WHERE chat_id = $1 AND status = 'settled' AND settled_at > $2
+      AND kind IN ('giveaway', 'giveflip')) AS giveaways,
+  (SELECT count(*) FROM telegram.game
+    WHERE chat_id = $1 AND status = 'settled' AND settled_at > $2
+      AND kind = 'coinflip') AS coinflips
+FROM lightning.transaction AS t
+WHERE `+GROUP_TXN_FILTER+`
+    `, chatId, since)
+	return
+}
+
+func renderLeaderboard(chatId int64, period string) (string, error) {
+	since := periodStart(period)
+
+	tippers, err := leaderboard(chatId, "from_id", since)
+	if err != nil {
+		return "", err
+	}
+	receivers, err := leaderboard(chatId, "to_id", since)
+	if err != nil {
+		return "", err
+	}
+
+	title := map[string]string{
+		"week":  "this week",
+		"month": "this month",
+		"all":   "of all time",
+	}[period]
+
+	lines := func(entries []LeaderboardEntry) string {
+		if len(entries) == 0 {
+			return "\nNobody yet."
+		}
+		var text string
+		for i, e := range entries {
+			user, _ := loadUser(e.AccountId, 0)
+			text += fmt.Sprintf("\n%d. %s %s sat", i+1, user.AtName(), formatThousands(e.Sats))
+		}
+		return text
+	}
+
+	return fmt.Sprintf("🏆 <b>Leaderboard %s</b>\n\n<b>Top tippers</b>%s\n\n<b>Top receivers</b>%s",
+		title, lines(tippers), lines(receivers)), nil
+}
+
+func renderGroupStats(chatId int64) (string, error) {
+	var sections []string
+	for _, period := range []string{"week", "month", "all"} {
+		stats, err := groupStats(chatId, periodStart(period))
+		if err != nil {
+			return "", err
+		}
+
+		sections = append(sections, fmt.Sprintf(
+			"<b>%s</b>\nVolume: %s sat in %d transfers to %d people\nGiveaways: %d\nCoinflips: %d",
+			map[string]string{"week": "Last 7 days", "month": "Last 30 days", "all": "All time"}[period],
+			formatThousands(stats.Volume), stats.Transfers, stats.Recipients,
+			stats.Giveaways, stats.Coinflips))
+	}
+	return "📊 " + strings.Join(sections, "\n\n"), nil
+}
+
+func setLeaderboardHidden(chatId int64, u User, hidden bool) (err error) {
+	if hidden {
+		_, err = pg.Exec(`
+INSERT INTO telegram.leaderboard_hidden (chat_id, account_id) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+        `, chatId, u.Id)
+	} else {
+		_, err = pg.Exec(`
+DELETE FROM telegram.leaderboard_hidden WHERE chat_id = $1 AND account_id = $2
+        `, chatId, u.Id)
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+func isLightningAddress(value string) bool {
+	parts := strings.Split(value, "@")
+	return len(parts) == 2 && parts[0] != "" && strings.Contains(parts[1], ".")
+}
+
+// invoiceFromLightningAddress gets an invoice for the given amount from a
+// lightning address (user@domain) through the lnurl-pay protocol.
+func invoiceFromLightningAddress(address string, msats int) (bolt11 string, err error) {
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 {
+		return "", errors.New("Invalid lightning address.")
+	}
+
+	var params struct {
+		Tag         string `json:"tag"`
+		Callback    string `json:"callback"`
+		MinSendable int    `json:"minSendable"`
+		MaxSendable int    `json:"maxSendable"`
+		Metadata    string `json:"metadata"`
+		Status      string `json:"status"`
+		Reason      string `json:"reason"`
+	}
+	_, err = napping.Get(
+		"https://"+parts[1]+"/.well-known/lnurlp/"+url.PathEscape(parts[0]),
+		nil, &params, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to reach %s.", parts[1])
+	}
+	if params.Status == "ERROR" {
+		return "", fmt.Errorf("%s: %s", address, params.Reason)
+	}
+	if params.Tag != "payRequest" || params.Callback == "" {
+		return "", fmt.Errorf("%s is not a valid lightning address.", address)
+	}
+	if msats < params.MinSendable || (params.MaxSendable > 0 && msats > params.MaxSendable) {
+		return "", fmt.Errorf("%s only accepts between %d and %d sat.",
+			address, params.MinSendable/1000, params.MaxSendable/1000)
+	}
+
+	var values struct {
+		PR     string `json:"pr"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	_, err = napping.Get(params.Callback, &url.Values{"amount": {fmt.Sprint(msats)}}, &values, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get an invoice from %s.", address)
+	}
+	if values.Status == "ERROR" {
+		return "", fmt.Errorf("%s: %s", address, values.Reason)
+	}
+
+	// check that we got what we asked for
+	inv, err := ln.Call("decodepay", values.PR)
+	if err != nil {
+		return "", fmt.Errorf("%s returned an invalid invoice.", address)
+	}
+	if inv.Get("msatoshi").Int() != int64(msats) {
+		return "", fmt.Errorf("%s returned an invoice for the wrong amount.", address)
+	}
+	// and that it is for the metadata we were shown (LUD-06)
+	metadataHash := sha256.Sum256([]byte(params.Metadata))
+	if inv.Get("description_hash").String() != hex.EncodeToString(metadataHash[:]) {
+		return "", fmt.Errorf("%s returned an invoice for something else.", address)
+	}
+
+	return values.PR, nil
+}
@@ -26,10 +26,11 @@ type Settings struct {
 	RedisURL    string `envconfig:"REDIS_URL" required:"true"`
 	SocketPath  string `envconfig:"SOCKET_PATH" required:"true"`
 
-	InvoiceTimeout       time.Duration `envconfig:"INVOICE_TIMEOUT" default:"24h"`
-	PayConfirmTimeout    time.Duration `envconfig:"PAY_CONFIRM_TIMEOUT" default:"5h"`
-	GiveAwayTimeout      time.Duration `envconfig:"GIVE_AWAY_TIMEOUT" default:"5h"`
-	HiddenMessageTimeout time.Duration `envconfig:"HIDDEN_MESSAGE_TIMEOUT" default:5d"`
+	InvoiceTimeout        time.Duration `envconfig:"INVOICE_TIMEOUT" default:"24h"`
+	PayConfirmTimeout     time.Duration `envconfig:"PAY_CONFIRM_TIMEOUT" default:"5h"`
+	GiveAwayTimeout       time.Duration `envconfig:"GIVE_AWAY_TIMEOUT" default:"5h"`
+	HiddenMessageTimeout  time.Duration `envconfig:"HIDDEN_MESSAGE_TIMEOUT" default:5d"`
+	PaymentRequestTimeout time.Duration `envconfig:"PAYMENT_REQUEST_TIMEOUT" default:"72h"`
 
 	NodeId string
 	Usage  string
@@ -137,14 +138,18 @@ func main() {
 	// lndhub-compatible routes
 	startBlueWallet()
 
+	// native JSON API
+	startAPI()
+	startStream()
+
 	// start http server
 	go http.ListenAndServe("0.0.0.0:"+s.Port, nil)
 
 	// pause here until lightningd works
 	s.NodeId = probeLightningd()
 
-	// dispatch kick job for pending users
-	startKicking()
+	// background jobs
+	startPeriodicJobs()
 
 	for update := range updates {
 		handle(update)
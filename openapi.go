@@ -0,0 +1,323 @@
+package main
+
+// served at /api/v1/openapi.json, {{SERVICE_URL}} is replaced on the fly.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "lntxbot API",
+    "version": "1.0.0",
+    "description": "Access your bot wallet over HTTP. Authenticate with the same credentials used by the lndhub interface: get them with /bluewallet and send base64('<login>:<password>') as a Bearer token."
+  },
+  "servers": [{"url": "{{SERVICE_URL}}/api/v1"}],
+  "security": [{"bearer": []}],
+  "paths": {
+    "/balance": {
+      "get": {
+        "summary": "Current balance and totals, in satoshis.",
+        "responses": {
+          "200": {"description": "Balance.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Balance"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/transactions": {
+      "get": {
+        "summary": "Lists transactions from the newest to the oldest.",
+        "parameters": [
+          {"name": "direction", "in": "query", "schema": {"type": "string", "enum": ["in", "out", "both"], "default": "both"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 500, "default": 50}},
+          {"name": "cursor", "in": "query", "description": "The next_cursor returned by the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "A page of transactions.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TransactionPage"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/invoices": {
+      "get": {
+        "summary": "Lists invoices created by this account from the newest to the oldest.",
+        "parameters": [
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 500, "default": 50}},
+          {"name": "cursor", "in": "query", "description": "The next_cursor returned by the previous page.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "A page of invoices.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/InvoicePage"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Creates an invoice.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {
+            "amount": {"type": "integer", "description": "In satoshis. Omit for an invoice of undefined amount."},
+            "description": {"type": "string"},
+            "expiry": {"type": "integer", "description": "In seconds."}
+          }
+        }}}},
+        "responses": {
+          "201": {"description": "The invoice.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Invoice"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/payments": {
+      "post": {
+        "summary": "Pays a BOLT11 invoice. The payment is resolved asynchronously.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["invoice"],
+          "properties": {
+            "invoice": {"type": "string"},
+            "amount": {"type": "integer", "description": "In satoshis, only for invoices of undefined amount."}
+          }
+        }}}},
+        "responses": {
+          "202": {"description": "Payment started.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Payment"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/sends": {
+      "post": {
+        "summary": "Sends satoshis to a Telegram user.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["username", "amount"],
+          "properties": {
+            "username": {"type": "string"},
+            "amount": {"type": "integer", "description": "In satoshis."},
+            "anonymous": {"type": "boolean"}
+          }
+        }}}},
+        "responses": {
+          "201": {"description": "Sent.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Send"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks": {
+      "get": {
+        "summary": "Lists your webhooks.",
+        "responses": {
+          "200": {"description": "Webhooks.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Registers a URL to receive account events. Each delivery is a POST with an AccountEvent JSON body and an X-Signature header containing 'sha256=' followed by the hex-encoded HMAC-SHA256 of the body, keyed with the webhook secret.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["url"],
+          "properties": {"url": {"type": "string"}}
+        }}}},
+        "responses": {
+          "201": {"description": "The webhook.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks/{id}": {
+      "delete": {
+        "summary": "Removes a webhook.",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}],
+        "responses": {
+          "204": {"description": "Removed."},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks/{id}/deliveries": {
+      "get": {
+        "summary": "Lists the latest delivery attempts for a webhook.",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 500, "default": 50}}
+        ],
+        "responses": {
+          "200": {"description": "Delivery attempts.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/stream": {
+      "get": {
+        "summary": "Server-sent events stream of AccountEvents for this account (invoice_paid, payment_sent, payment_failed, transfer_received). Clients that can't set headers, like browsers, may get a stream token from /stream/token and pass it as a query parameter, everybody else should use the Authorization header.",
+        "parameters": [{"name": "token", "in": "query", "description": "A token from /stream/token, valid once. Never the Bearer token.", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "An endless text/event-stream where each message has the event type as 'event' and an AccountEvent as 'data'.", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/AccountEvent"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/stream/token": {
+      "post": {
+        "summary": "Creates a single-use token to open /stream from clients that can't set headers. It expires in a minute.",
+        "responses": {
+          "200": {"description": "The token.", "content": {"application/json": {"schema": {
+            "type": "object",
+            "properties": {
+              "token": {"type": "string"},
+              "expires_in": {"type": "integer", "description": "Seconds."}
+            }
+          }}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hidden": {
+      "post": {
+        "summary": "Hides a message that can be revealed later with a payment.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {
+          "type": "object",
+          "required": ["amount", "content"],
+          "properties": {
+            "amount": {"type": "integer", "description": "Price to reveal, in satoshis."},
+            "content": {"type": "string"},
+            "preview": {"type": "string", "description": "Teaser shown before the message is revealed."}
+          }
+        }}}},
+        "responses": {
+          "201": {"description": "Hidden.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HiddenMessage"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/hidden/{id}/reveal": {
+      "post": {
+        "summary": "Pays for and reveals a hidden message.",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "Revealed.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HiddenMessage"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"}
+    },
+    "responses": {
+      "Error": {"description": "Error.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "object",
+            "properties": {
+              "code": {"type": "string", "example": "invalid_params"},
+              "message": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Balance": {
+        "type": "object",
+        "properties": {
+          "balance": {"type": "number"},
+          "total_received": {"type": "number"},
+          "total_sent": {"type": "number"},
+          "total_fees": {"type": "number"}
+        }
+      },
+      "Transaction": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "integer", "description": "Unix timestamp."},
+          "status": {"type": "string", "enum": ["sent", "received", "pending", "held", "incoming", "refunded"], "description": "held: taken from this account but not delivered yet; incoming: on hold for this account, not in the balance yet; refunded: a hold that was given back."},
+          "amount": {"type": "number", "description": "In satoshis, negative when outgoing."},
+          "fees": {"type": "number"},
+          "payment_hash": {"type": "string"},
+          "preimage": {"type": "string"},
+          "description": {"type": "string"},
+          "telegram_peer": {"type": "string"},
+          "anonymous": {"type": "boolean"}
+        }
+      },
+      "TransactionPage": {
+        "type": "object",
+        "properties": {
+          "transactions": {"type": "array", "items": {"$ref": "#/components/schemas/Transaction"}},
+          "next_cursor": {"type": "string"}
+        }
+      },
+      "Invoice": {
+        "type": "object",
+        "properties": {
+          "payment_hash": {"type": "string"},
+          "payment_request": {"type": "string"},
+          "description": {"type": "string"},
+          "amount": {"type": "integer", "nullable": true},
+          "status": {"type": "string", "enum": ["paid", "unpaid", "expired"]},
+          "paid_amount": {"type": "number"},
+          "created_at": {"type": "integer"},
+          "expires_at": {"type": "integer"}
+        }
+      },
+      "InvoicePage": {
+        "type": "object",
+        "properties": {
+          "invoices": {"type": "array", "items": {"$ref": "#/components/schemas/Invoice"}},
+          "next_cursor": {"type": "string"}
+        }
+      },
+      "Payment": {
+        "type": "object",
+        "properties": {
+          "payment_hash": {"type": "string"},
+          "status": {"type": "string", "enum": ["pending"]}
+        }
+      },
+      "Send": {
+        "type": "object",
+        "properties": {
+          "receiver": {"type": "string"},
+          "amount": {"type": "integer"},
+          "anonymous": {"type": "boolean"}
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "url": {"type": "string"},
+          "secret": {"type": "string"},
+          "created_at": {"type": "integer"}
+        }
+      },
+      "WebhookDelivery": {
+        "type": "object",
+        "properties": {
+          "event_id": {"type": "string"},
+          "event": {"type": "string"},
+          "attempt": {"type": "integer"},
+          "time": {"type": "integer"},
+          "status_code": {"type": "integer"},
+          "error": {"type": "string"},
+          "succeeded": {"type": "boolean"}
+        }
+      },
+      "AccountEvent": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "type": {"type": "string", "enum": ["invoice_paid", "payment_sent", "payment_failed", "transfer_received"]},
+          "time": {"type": "integer"},
+          "data": {"type": "object"}
+        }
+      },
+      "HiddenMessage": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "amount": {"type": "integer"},
+          "content": {"type": "string"}
+        }
+      }
+    }
+  }
+}`
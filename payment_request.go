@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx"
+)
+
+type PaymentRequest struct {
+	Id          int           `db:"id"`
+	RequesterId int           `db:"requester_id"`
+	PayerId     int           `db:"payer_id"`
+	Amount      int           `db:"amount"`
+	Memo        string        `db:"memo"`
+	MessageId   int           `db:"message_id"`
+	Status      string        `db:"status"`
+	CreatedAt   time.Time     `db:"created_at"`
+	ExpiresAt   time.Time     `db:"expires_at"`
+	SplitId     sql.NullInt64 `db:"split_id"`
+
+	// filled by listPaymentRequests and listSplitRequests
+	Peer string `db:"peer"`
+}
+
+const PAYMENTREQUESTFIELDS = `
+  id, requester_id, payer_id, amount, memo, message_id,
+  status, created_at, expires_at, split_id
+`
+
+func (req PaymentRequest) MemoNote() string {
+	if req.Memo == "" {
+		return ""
+	}
+	return ": <i>" + escapeHTML(req.Memo) + "</i>"
+}
+
+func (req PaymentRequest) ExpiresIn() string {
+	return time.Until(req.ExpiresAt).Truncate(time.Minute).String()
+}
+
+func paymentRequestKeyboard(id, sats int) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Decline", fmt.Sprintf("preq=decline-%d", id)),
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("Pay %d sat", sats),
+				fmt.Sprintf("preq=pay-%d", id),
+			),
+		),
+	)
+}
+
+// requestPayment saves a request and sends it to the payer's private chat with
+// Pay and Decline buttons.
+func (u User) requestPayment(payer User, sats int, memo string) (req PaymentRequest, err error) {
+	if payer.ChatId == 0 {
+		err = fmt.Errorf("%s hasn't started a conversation with the bot, so they can't be asked.",
+			payer.AtName())
+		return
+	}
+
+	req, err = u.savePaymentRequest(payer, sats, memo, nil)
+	if err != nil {
+		return
+	}
+
+	err = u.deliverPaymentRequest(payer, &req)
+	if err != nil {
+		pg.Exec(`DELETE FROM telegram.payment_request WHERE id = $1`, req.Id)
+	}
+	return
+}
+
+func (u User) savePaymentRequest(
+	payer User,
+	sats int,
+	memo string,
+	splitId interface{},
+) (req PaymentRequest, err error) {
+	if payer.Id == u.Id {
+		err = errors.New("Can't request a payment from yourself.")
+		return
+	}
+	if sats <= 0 {
+		err = errors.New("Invalid amount.")
+		return
+	}
+
+	err = pg.Get(&req, `
+INSERT INTO telegram.payment_request (requester_id, payer_id, amount, memo, split_id, expires_at)
+VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6))
+RETURNING `+PAYMENTREQUESTFIELDS+`
+    `, u.Id, payer.Id, sats, memo, splitId, s.PaymentRequestTimeout.Seconds())
+	if err != nil {
+		log.Warn().Err(err).Int("from", u.Id).Int("to", payer.Id).Msg("failed to save payment request")
+		err = errors.New("Database error.")
+	}
+	return
+}
+
+func (u User) deliverPaymentRequest(payer User, req *PaymentRequest) (err error) {
+	chattable := tgbotapi.NewMessage(payer.ChatId,
+		fmt.Sprintf("%s is requesting <b>%d sat</b> from you%s.", u.AtName(), req.Amount, req.MemoNote()))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = paymentRequestKeyboard(req.Id, req.Amount)
+	message, err := bot.Send(chattable)
+	if err != nil {
+		log.Warn().Err(err).Int("request", req.Id).Msg("failed to send payment request")
+		return fmt.Errorf("Failed to deliver the request to %s.", payer.AtName())
+	}
+
+	req.MessageId = message.MessageID
+	pg.Exec(`UPDATE telegram.payment_request SET message_id = $2 WHERE id = $1`,
+		req.Id, req.MessageId)
+	return nil
+}
+
+// resolvePaymentRequest moves an open request to the given status, atomically,
+// so it can only be paid, declined or expired once.
+func resolvePaymentRequest(q sqlx.Queryer, id, payerId int, status string) (req PaymentRequest, err error) {
+	err = sqlx.Get(q, &req, `
+UPDATE telegram.payment_request
+SET status = $3, resolved_at = now()
+WHERE id = $1 AND payer_id = $2 AND status = 'open' AND expires_at > now()
+RETURNING `+PAYMENTREQUESTFIELDS+`
+    `, id, payerId, status)
+	return
+}
+
+// payPaymentRequest marks the request as paid and moves the money in the
+// same transaction, so it is never paid without a transfer or the opposite.
+func (u User) payPaymentRequest(id int) (req PaymentRequest, errMsg string, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return req, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	req, err = resolvePaymentRequest(txn, id, u.Id, "paid")
+	if err != nil {
+		return req, "This request is not open anymore.", err
+	}
+
+	requester, err := loadUser(req.RequesterId, 0)
+	if err != nil {
+		return req, "Failed to load the requester.", err
+	}
+
+	var desc sql.NullString
+	if req.Memo != "" {
+		desc.Scan(req.Memo)
+	}
+
+	var hash string
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, trigger_message)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING payment_hash
+    `, u.Id, requester.Id, req.Amount*1000, desc, req.MessageId)
+	if err != nil {
+		return req, "Database error.", err
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, u.Id)
+	if err != nil {
+		return req, "Database error.", err
+	}
+	if balance < 0 {
+		return req, fmt.Sprintf("Insufficient balance. Needs %.3f sat more.",
+				-float64(balance)/1000),
+			errors.New("insufficient balance")
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return req, "Unable to pay due to internal database error.", err
+	}
+
+	publish(InternalTransfer{
+		From:        u,
+		To:          requester,
+		Msats:       req.Amount * 1000,
+		Hash:        hash,
+		Description: desc.String,
+	})
+
+	requester.notify(fmt.Sprintf("%s has paid your request of %d sat%s.",
+		u.AtName(), req.Amount, req.MemoNote()))
+
+	if req.SplitId.Valid {
+		updateSplit(int(req.SplitId.Int64))
+	}
+	return
+}
+
+func (u User) declinePaymentRequest(id int) (req PaymentRequest, err error) {
+	req, err = resolvePaymentRequest(pg, id, u.Id, "declined")
+	if err != nil {
+		return
+	}
+
+	if requester, err := loadUser(req.RequesterId, 0); err == nil {
+		requester.notify(fmt.Sprintf("%s has declined your request of %d sat%s.",
+			u.AtName(), req.Amount, req.MemoNote()))
+	}
+
+	if req.SplitId.Valid {
+		updateSplit(int(req.SplitId.Int64))
+	}
+	return
+}
+
+// listPaymentRequests returns the open requests made to this user (incoming)
+// and by this user (outgoing).
+func (u User) listPaymentRequests() (incoming []PaymentRequest, outgoing []PaymentRequest, err error) {
+	err = pg.Select(&incoming, `
+SELECT r.id, r.requester_id, r.payer_id, r.amount, r.memo, r.message_id, r.status,
+  r.created_at, r.expires_at, r.split_id, coalesce(a.username, a.telegram_id::text) AS peer
+FROM telegram.payment_request AS r
+INNER JOIN telegram.account AS a ON a.id = r.requester_id
+WHERE r.payer_id = $1 AND r.status = 'open' AND r.expires_at > now()
+ORDER BY r.created_at
+    `, u.Id)
+	if err != nil {
+		return
+	}
+
+	err = pg.Select(&outgoing, `
+SELECT r.id, r.requester_id, r.payer_id, r.amount, r.memo, r.message_id, r.status,
+  r.created_at, r.expires_at, r.split_id, coalesce(a.username, a.telegram_id::text) AS peer
+FROM telegram.payment_request AS r
+INNER JOIN telegram.account AS a ON a.id = r.payer_id
+WHERE r.requester_id = $1 AND r.status = 'open' AND r.expires_at > now()
+ORDER BY r.created_at
+    `, u.Id)
+	return
+}
+
+func expirePaymentRequests() {
+	var expired []PaymentRequest
+	err := pg.Select(&expired, `
+UPDATE telegram.payment_request
+SET status = 'expired', resolved_at = now()
+WHERE status = 'open' AND expires_at < now()
+RETURNING `+PAYMENTREQUESTFIELDS+`
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to expire payment requests")
+		return
+	}
+
+	for _, req := range expired {
+		requester, err := loadUser(req.RequesterId, 0)
+		if err != nil {
+			continue
+		}
+
+		if payer, err := loadUser(req.PayerId, 0); err == nil && req.MessageId != 0 {
+			bot.Send(tgbotapi.NewEditMessageText(payer.ChatId, req.MessageId,
+				fmt.Sprintf("The request of %d sat from %s has expired.", req.Amount, requester.AtName())))
+		}
+
+		requester.notify(fmt.Sprintf("Your request of %d sat%s has expired without being paid.",
+			req.Amount, req.MemoNote()))
+
+		if req.SplitId.Valid {
+			updateSplit(int(req.SplitId.Int64))
+		}
+	}
+}
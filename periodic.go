@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func startPeriodicJobs() {
+	go runPeriodically("retry webhook deliveries", time.Second*10, retryWebhookDeliveries)
+	go runPeriodically("expire payment requests", time.Minute, expirePaymentRequests)
+	go runPeriodically("run scheduled payments", time.Second*30, runDueSchedules)
+	go runPeriodically("refund timed out escrows", time.Minute, refundTimedOutEscrows)
+	go runPeriodically("refund unanswered questions", time.Minute, refundUnansweredQuestions)
+	go runPeriodically("end auctions", time.Second*30, endDueAuctions)
+	go runPeriodically("draw raffles", time.Second*30, drawDueRaffles)
+	go runPeriodically("refund failed crowdfunds", time.Minute, failDueCrowdfunds)
+	go runPeriodically("expire games", time.Minute, expireGames)
+	go runPeriodically("settle filled games", time.Minute, settleFilledGames)
+	go runPeriodically("expire treasury proposals", time.Hour, expireTreasuryProposals)
+	go runPeriodically("kick unpaid tickets", time.Second*30, kickExpiredTickets)
+}
+
+// runPeriodically calls job every interval forever, a panic in one run
+// doesn't stop the next ones.
+func runPeriodically(name string, interval time.Duration, job func()) {
+	for {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error().Str("job", name).Str("panic", fmt.Sprint(r)).
+						Msg("periodic job panicked")
+				}
+			}()
+			job()
+		}()
+
+		time.Sleep(interval)
+	}
+}
@@ -16,7 +16,50 @@ CREATE INDEX ON telegram.account (telegram_id);
 CREATE TABLE telegram.chat (
   telegram_id bigint PRIMARY KEY,
   spammy boolean NOT NULL DEFAULT false,
-  ticket int NOT NULL DEFAULT 0
+  ticket int NOT NULL DEFAULT 0,
+  treasury_id int UNIQUE REFERENCES telegram.account (id), -- the account owned by the group
+  treasury_approvals int NOT NULL DEFAULT 2, -- admins needed to spend from the treasury
+  ticket_window int NOT NULL DEFAULT 900, -- seconds new members have to pay the ticket
+  ticket_ban int NOT NULL DEFAULT 86400, -- seconds kicked members stay banned, 0 to just kick
+  ticket_payee text NOT NULL DEFAULT 'owner' -- owner, treasury or admins
+);
+
+CREATE TABLE telegram.ticket_whitelist (
+  chat_id bigint NOT NULL REFERENCES telegram.chat (telegram_id),
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  PRIMARY KEY (chat_id, account_id)
+);
+
+-- new members of groups with a ticket, until they pay, are approved or kicked.
+CREATE TABLE telegram.ticket (
+  id serial PRIMARY KEY,
+  chat_id bigint NOT NULL, -- telegram chat id, as it comes
+  telegram_id int NOT NULL, -- the new member
+  username text NOT NULL DEFAULT '',
+  label text NOT NULL, -- label of the invoice, reused if they join again
+  hash text NOT NULL DEFAULT '',
+  status text NOT NULL DEFAULT 'pending', -- pending, paid, approved, kicked or canceled
+  join_message_id int NOT NULL DEFAULT 0,
+  notify_message_id int NOT NULL DEFAULT 0,
+  invoice_message_id int NOT NULL DEFAULT 0,
+  expires_at timestamp NOT NULL,
+  created_at timestamp NOT NULL DEFAULT now(),
+  resolved_at timestamp,
+  resolved_by int REFERENCES telegram.account (id) -- the admin who approved
+);
+
+CREATE UNIQUE INDEX ON telegram.ticket (chat_id, telegram_id) WHERE status = 'pending';
+CREATE INDEX ON telegram.ticket (label) WHERE status = 'pending';
+CREATE INDEX ON telegram.ticket (expires_at) WHERE status = 'pending';
+
+-- funds that left an account but haven't reached anyone yet.
+-- they are either captured (delivered) or released (given back).
+CREATE TABLE lightning.hold (
+  id text PRIMARY KEY, -- chosen by the app, like 'escrow:<id>'
+  status text NOT NULL DEFAULT 'held', -- held, captured or released
+  note text, -- why it was captured or released
+  created_at timestamp NOT NULL DEFAULT now(),
+  resolved_at timestamp
 );
 
 CREATE TABLE lightning.transaction (
@@ -32,13 +75,299 @@ CREATE TABLE lightning.transaction (
   pending boolean NOT NULL DEFAULT false,
   trigger_message int NOT NULL DEFAULT 0,
   remote_node text,
-  anonymous boolean NOT NULL DEFAULT false
+  anonymous boolean NOT NULL DEFAULT false,
+  hold_id text UNIQUE REFERENCES lightning.hold (id), -- when the amount is on hold
+  chat_id bigint -- the group chat where a tip, giveaway or game happened
 );
 
 CREATE INDEX ON lightning.transaction (from_id);
 CREATE INDEX ON lightning.transaction (to_id);
 CREATE INDEX ON lightning.transaction (label);
 CREATE INDEX ON lightning.transaction (payment_hash);
+CREATE INDEX ON lightning.transaction (chat_id, time) WHERE chat_id IS NOT NULL;
+
+CREATE TABLE lightning.invoice (
+  payment_hash text PRIMARY KEY,
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  label text NOT NULL,
+  bolt11 text NOT NULL,
+  description text NOT NULL DEFAULT '',
+  amount numeric(13), -- in msatoshis, null on invoices of undefined amount
+  created_at timestamp NOT NULL DEFAULT now(),
+  expires_at timestamp NOT NULL,
+  paid_at timestamp,
+  paid_amount numeric(13) -- in msatoshis
+);
+
+CREATE INDEX ON lightning.invoice (account_id);
+
+CREATE TABLE telegram.webhook (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  url text NOT NULL,
+  secret text NOT NULL DEFAULT encode(digest(random()::text, 'sha256'), 'hex'), -- used to sign deliveries
+  created_at timestamp NOT NULL DEFAULT now(),
+  UNIQUE (account_id, url)
+);
+
+CREATE TABLE telegram.webhook_delivery (
+  id serial PRIMARY KEY,
+  webhook_id int NOT NULL REFERENCES telegram.webhook (id) ON DELETE CASCADE,
+  event_id text NOT NULL,
+  event text NOT NULL,
+  attempt int NOT NULL,
+  time timestamp NOT NULL DEFAULT now(),
+  status_code int, -- null when the request couldn't be completed
+  error text,
+  body text NOT NULL DEFAULT '', -- kept while there are retries left
+  retry_at timestamp -- when the next attempt is due, if this one failed
+);
+
+CREATE INDEX ON telegram.webhook_delivery (webhook_id);
+CREATE INDEX ON telegram.webhook_delivery (retry_at) WHERE retry_at IS NOT NULL;
+
+CREATE TABLE telegram.split (
+  id serial PRIMARY KEY,
+  initiator_id int NOT NULL REFERENCES telegram.account (id),
+  total int NOT NULL, -- in satoshis
+  initiator_share int NOT NULL DEFAULT 0, -- in satoshis, when the initiator is one of the participants
+  memo text NOT NULL DEFAULT '',
+  chat_id bigint NOT NULL, -- where the tracking message is
+  message_id int NOT NULL DEFAULT 0,
+  settled boolean NOT NULL DEFAULT false,
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE TABLE telegram.payment_request (
+  id serial PRIMARY KEY,
+  requester_id int NOT NULL REFERENCES telegram.account (id),
+  payer_id int NOT NULL REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis
+  memo text NOT NULL DEFAULT '',
+  message_id int NOT NULL DEFAULT 0, -- the message with the buttons, on the payer's chat
+  status text NOT NULL DEFAULT 'open', -- open, paid, declined or expired
+  created_at timestamp NOT NULL DEFAULT now(),
+  expires_at timestamp NOT NULL,
+  resolved_at timestamp,
+  split_id int REFERENCES telegram.split (id) -- when this is a share of a split
+);
+
+CREATE INDEX ON telegram.payment_request (payer_id);
+CREATE INDEX ON telegram.payment_request (requester_id);
+CREATE INDEX ON telegram.payment_request (split_id);
+
+CREATE TABLE lightning.schedule (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  kind text NOT NULL, -- 'send' (internal) or 'pay' (invoice or lightning address)
+  amount int, -- in satoshis, null when paying an invoice that has an amount
+  target_id int REFERENCES telegram.account (id), -- for 'send'
+  target text, -- for 'pay'
+  next_run timestamp NOT NULL,
+  interval_seconds int, -- null for one-off schedules
+  until timestamp,
+  runs_left int, -- null for no limit
+  runs int NOT NULL DEFAULT 0,
+  failures int NOT NULL DEFAULT 0, -- in a row
+  active boolean NOT NULL DEFAULT true,
+  last_error text,
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON lightning.schedule (account_id);
+CREATE INDEX ON lightning.schedule (next_run) WHERE active;
+
+CREATE TABLE telegram.escrow (
+  id serial PRIMARY KEY,
+  buyer_id int NOT NULL REFERENCES telegram.account (id),
+  seller_id int NOT NULL REFERENCES telegram.account (id),
+  arbiter_id int REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis
+  memo text NOT NULL DEFAULT '',
+  hold_id text UNIQUE NOT NULL REFERENCES lightning.hold (id),
+  status text NOT NULL DEFAULT 'open', -- open, released or refunded
+  buyer_message int NOT NULL DEFAULT 0, -- the messages with the buttons, on each party's chat
+  seller_message int NOT NULL DEFAULT 0,
+  arbiter_message int NOT NULL DEFAULT 0,
+  timeout_at timestamp NOT NULL, -- refunded to the buyer after this
+  created_at timestamp NOT NULL DEFAULT now(),
+  resolved_at timestamp
+);
+
+CREATE INDEX ON telegram.escrow (timeout_at) WHERE status = 'open';
+
+CREATE TABLE telegram.inbox_message (
+  id serial PRIMARY KEY,
+  sender_id int NOT NULL REFERENCES telegram.account (id),
+  recipient_id int NOT NULL REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis, what the sender paid
+  refunded boolean NOT NULL DEFAULT false,
+  sender_turn boolean NOT NULL DEFAULT false, -- the sender may answer once for free
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE TABLE telegram.question (
+  id serial PRIMARY KEY,
+  asker_id int NOT NULL REFERENCES telegram.account (id),
+  expert_id int NOT NULL REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis
+  question text NOT NULL,
+  answer text NOT NULL DEFAULT '',
+  hold_id text UNIQUE NOT NULL REFERENCES lightning.hold (id),
+  status text NOT NULL DEFAULT 'open', -- open, answered or refunded
+  message_id int NOT NULL DEFAULT 0, -- the relayed question, on the expert's chat
+  deadline timestamp NOT NULL, -- refunded to the asker after this
+  created_at timestamp NOT NULL DEFAULT now(),
+  answered_at timestamp
+);
+
+CREATE INDEX ON telegram.question (deadline) WHERE status = 'open';
+
+CREATE TABLE telegram.auction (
+  id serial PRIMARY KEY,
+  seller_id int NOT NULL REFERENCES telegram.account (id),
+  reserve int NOT NULL, -- in satoshis, the minimum first bid
+  description text NOT NULL,
+  chat_id bigint NOT NULL,
+  message_id int NOT NULL DEFAULT 0,
+  ends_at timestamp NOT NULL,
+  status text NOT NULL DEFAULT 'open', -- open, sold or unsold
+  top_bid int NOT NULL DEFAULT 0, -- in satoshis
+  top_bidder_id int REFERENCES telegram.account (id),
+  top_hold_id text REFERENCES lightning.hold (id), -- the funds of the top bid
+  created_at timestamp NOT NULL DEFAULT now(),
+  ended_at timestamp
+);
+
+CREATE INDEX ON telegram.auction (ends_at) WHERE status = 'open';
+
+CREATE TABLE telegram.auction_bid (
+  id serial PRIMARY KEY,
+  auction_id int NOT NULL REFERENCES telegram.auction (id),
+  bidder_id int NOT NULL REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis
+  hold_id text UNIQUE NOT NULL REFERENCES lightning.hold (id),
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON telegram.auction_bid (auction_id);
+
+CREATE TABLE telegram.raffle (
+  id serial PRIMARY KEY,
+  organizer_id int NOT NULL REFERENCES telegram.account (id),
+  ticket_price int NOT NULL, -- in satoshis
+  prize text NOT NULL DEFAULT '',
+  cut int NOT NULL DEFAULT 0, -- percent of the pot kept by the organizer
+  chat_id bigint NOT NULL,
+  message_id int NOT NULL DEFAULT 0,
+  ends_at timestamp NOT NULL,
+  status text NOT NULL DEFAULT 'open', -- open, drawn or ended (without tickets)
+  winner_id int REFERENCES telegram.account (id),
+  created_at timestamp NOT NULL DEFAULT now(),
+  drawn_at timestamp
+);
+
+CREATE INDEX ON telegram.raffle (ends_at) WHERE status = 'open';
+
+CREATE TABLE telegram.raffle_ticket (
+  id serial PRIMARY KEY, -- one row per purchase, of one or more tickets
+  raffle_id int NOT NULL REFERENCES telegram.raffle (id),
+  buyer_id int NOT NULL REFERENCES telegram.account (id),
+  tickets int NOT NULL,
+  hold_id text UNIQUE NOT NULL REFERENCES lightning.hold (id),
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON telegram.raffle_ticket (raffle_id);
+
+CREATE TABLE telegram.crowdfund (
+  id serial PRIMARY KEY,
+  creator_id int NOT NULL REFERENCES telegram.account (id),
+  receiver_id int NOT NULL REFERENCES telegram.account (id),
+  goal int NOT NULL, -- in satoshis
+  title text NOT NULL,
+  chat_id bigint NOT NULL,
+  message_id int NOT NULL DEFAULT 0,
+  ends_at timestamp NOT NULL, -- everybody is refunded after this if the goal wasn't reached
+  status text NOT NULL DEFAULT 'open', -- open, funded or failed
+  created_at timestamp NOT NULL DEFAULT now(),
+  ended_at timestamp
+);
+
+CREATE INDEX ON telegram.crowdfund (ends_at) WHERE status = 'open';
+
+CREATE TABLE telegram.crowdfund_contribution (
+  id serial PRIMARY KEY,
+  crowdfund_id int NOT NULL REFERENCES telegram.crowdfund (id),
+  backer_id int NOT NULL REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis
+  hold_id text UNIQUE NOT NULL REFERENCES lightning.hold (id),
+  created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON telegram.crowdfund_contribution (crowdfund_id);
+
+CREATE TABLE telegram.game (
+  id serial PRIMARY KEY,
+  kind text NOT NULL, -- giveaway, giveflip, coinflip or fundraise
+  creator_id int NOT NULL REFERENCES telegram.account (id),
+  receiver_id int REFERENCES telegram.account (id), -- who gets a fundraise, or the only one who can claim a giveaway
+  amount int NOT NULL, -- in satoshis, the prize for giveaway (split between claimers) and giveflip, each share for coinflip and fundraise
+  nparticipants int NOT NULL, -- the game is filled when this many have joined
+  status text NOT NULL DEFAULT 'open', -- open, filled, settled, canceled or expired
+  chat_id bigint NOT NULL DEFAULT 0, -- where the message is, when not posted through an inline query
+  message_id int NOT NULL DEFAULT 0,
+  inline_message_id text NOT NULL DEFAULT '', -- when posted through an inline query
+  winner_id int REFERENCES telegram.account (id), -- the one who got the money
+  members_only boolean NOT NULL DEFAULT false, -- only members of chat_id can join
+  seed text NOT NULL, -- random, only revealed after the draw
+  seed_hash text NOT NULL, -- sha256 of the seed, shown from the start
+  draw_height int, -- the block that decides the winner, picked when filled
+  draw_block text, -- its hash
+  created_at timestamp NOT NULL DEFAULT now(),
+  expires_at timestamp NOT NULL,
+  settled_at timestamp
+);
+
+CREATE INDEX ON telegram.game (expires_at) WHERE status = 'open';
+CREATE INDEX ON telegram.game (inline_message_id) WHERE inline_message_id != '';
+
+CREATE TABLE telegram.game_participant (
+  game_id int NOT NULL REFERENCES telegram.game (id),
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  hold_id text UNIQUE REFERENCES lightning.hold (id),
+  joined_at timestamp NOT NULL DEFAULT now(),
+  PRIMARY KEY (game_id, account_id)
+);
+
+CREATE TABLE telegram.treasury_proposal (
+  id serial PRIMARY KEY,
+  chat_id bigint NOT NULL, -- the group, as telegram sees it
+  proposer_id int NOT NULL REFERENCES telegram.account (id),
+  receiver_id int NOT NULL REFERENCES telegram.account (id),
+  amount int NOT NULL, -- in satoshis
+  memo text NOT NULL DEFAULT '',
+  required int NOT NULL, -- approvals needed, fixed when proposed
+  status text NOT NULL DEFAULT 'open', -- open, executed, rejected, failed or expired
+  message_id int NOT NULL DEFAULT 0,
+  created_at timestamp NOT NULL DEFAULT now(),
+  resolved_at timestamp
+);
+
+CREATE INDEX ON telegram.treasury_proposal (created_at) WHERE status = 'open';
+
+CREATE TABLE telegram.treasury_approval (
+  proposal_id int NOT NULL REFERENCES telegram.treasury_proposal (id),
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  approved_at timestamp NOT NULL DEFAULT now(),
+  PRIMARY KEY (proposal_id, account_id)
+);
+
+CREATE TABLE telegram.leaderboard_hidden (
+  chat_id bigint NOT NULL, -- the group, as in lightning.transaction
+  account_id int NOT NULL REFERENCES telegram.account (id),
+  PRIMARY KEY (chat_id, account_id)
+);
 
 CREATE VIEW lightning.account_txn AS
   SELECT
@@ -47,38 +376,56 @@ CREATE VIEW lightning.account_txn AS
       WHEN label IS NULL THEN coalesce(t.username, t.telegram_id::text)
       ELSE NULL
     END AS telegram_peer,
-    status, fees, payment_hash, label, description, preimage, payee_node
+    status, fees, payment_hash, label, description, preimage, payee_node, hold_id
   FROM (
       SELECT time,
         from_id AS account_id,
         anonymous,
         trigger_message,
-        CASE WHEN pending THEN 'PENDING' ELSE 'SENT' END AS status,
+        CASE
+          WHEN h.status = 'held' THEN 'HELD'
+          WHEN h.status = 'released' THEN 'REFUNDED'
+          WHEN pending THEN 'PENDING'
+          ELSE 'SENT'
+        END AS status,
         to_id AS peer,
         -amount AS amount, fees,
         payment_hash, label, description, preimage,
-        remote_node AS payee_node
+        remote_node AS payee_node,
+        hold_id
       FROM lightning.transaction
+      LEFT OUTER JOIN lightning.hold AS h ON h.id = hold_id
       WHERE from_id IS NOT NULL
     UNION ALL
       SELECT time,
         to_id AS account_id,
         anonymous,
         CASE WHEN from_id IS NULL THEN trigger_message ELSE 0 END AS trigger_message,
-        'RECEIVED' AS status,
+        CASE
+          WHEN h.status = 'held' THEN 'INCOMING'
+          WHEN h.status = 'released' THEN 'REFUNDED'
+          ELSE 'RECEIVED'
+        END AS status,
         from_id AS peer,
         amount, 0 AS fees,
         payment_hash, label, description, preimage,
-        NULL as payee_node
+        NULL as payee_node,
+        hold_id
       FROM lightning.transaction
+      LEFT OUTER JOIN lightning.hold AS h ON h.id = hold_id
       WHERE to_id IS NOT NULL
   ) AS x
   LEFT OUTER JOIN telegram.account AS t ON x.peer = t.id;
 
+-- HELD amounts are already gone from the sender, but only count for the receiver
+-- once captured. REFUNDED amounts don't count for anyone.
 CREATE VIEW lightning.balance AS
     SELECT
       account.id AS account_id,
-      (coalesce(sum(amount), 0) - coalesce(sum(fees), 0))::float AS balance
+      (
+        coalesce(sum(CASE WHEN status IN ('INCOMING', 'REFUNDED') THEN 0 ELSE amount END), 0)
+        - coalesce(sum(fees), 0)
+      )::float AS balance
     FROM lightning.account_txn
     RIGHT OUTER JOIN telegram.account AS account ON account_id = account.id
     GROUP BY account.id;
@@ -92,7 +439,7 @@ CREATE FUNCTION is_unclaimed(tx lightning.transaction) RETURNS boolean AS $$
     WHERE acct.id = tx.to_id
   )
   SELECT CASE
-    WHEN id IS NOT NULL AND chat_id IS NULL THEN CASE
+    WHEN id IS NOT NULL AND chat_id IS NULL AND tx.hold_id IS NULL THEN CASE
       WHEN (
         SELECT count(*) AS total FROM lightning.transaction
         WHERE from_id = (SELECT id FROM potentially_inactive_user)
@@ -105,7 +452,25 @@ $$ LANGUAGE SQL;
 
 table telegram.account;
 table telegram.chat;
+table lightning.hold;
 table lightning.transaction;
+table lightning.invoice;
+table telegram.webhook;
+table telegram.webhook_delivery;
+table telegram.split;
+table telegram.payment_request;
+table lightning.schedule;
+table telegram.escrow;
+table telegram.inbox_message;
+table telegram.question;
+table telegram.auction;
+table telegram.auction_bid;
+table telegram.raffle;
+table telegram.raffle_ticket;
+table telegram.crowdfund;
+table telegram.crowdfund_contribution;
+table telegram.game;
+table telegram.game_participant;
 table lightning.account_txn;
 table lightning.balance;
 select * from lightning.transaction where pending;
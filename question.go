@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	DEFAULT_QUESTION_DEADLINE = time.Hour * 48
+	MAX_QUESTION_DEADLINE     = time.Hour * 24 * 30
+)
+
+type Question struct {
+	Id         int        `db:"id"`
+	AskerId    int        `db:"asker_id"`
+	ExpertId   int        `db:"expert_id"`
+	Amount     int        `db:"amount"`
+	Question   string     `db:"question"`
+	Answer     string     `db:"answer"`
+	HoldId     string     `db:"hold_id"`
+	Status     string     `db:"status"`
+	MessageId  int        `db:"message_id"`
+	Deadline   time.Time  `db:"deadline"`
+	CreatedAt  time.Time  `db:"created_at"`
+	AnsweredAt *time.Time `db:"answered_at"`
+}
+
+// ask holds the asker's funds and relays the question to the expert, who
+// gets them by answering before the deadline.
+func (u User) ask(
+	expert User,
+	sats int,
+	question string,
+	deadline time.Duration,
+	messageId int,
+) (q Question, errMsg string, err error) {
+	if expert.Id == u.Id {
+		return q, "Can't ask yourself.", errors.New("asking self")
+	}
+	if expert.ChatId == 0 {
+		return q, fmt.Sprintf("%s can't receive questions through the bot.", expert.AtName()),
+			errors.New("expert has no chat")
+	}
+	if deadline <= 0 || deadline > MAX_QUESTION_DEADLINE {
+		return q, fmt.Sprintf("The deadline must be at most %s.", formatInterval(MAX_QUESTION_DEADLINE)),
+			errors.New("invalid deadline")
+	}
+	if question == "" {
+		return q, "What's the question?", errors.New("empty question")
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return q, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	var id int
+	err = txn.Get(&id, `SELECT nextval('telegram.question_id_seq')`)
+	if err != nil {
+		return q, "Database error.", err
+	}
+
+	holdId := fmt.Sprintf("question:%d", id)
+	_, errMsg, err = holdFunds(txn, holdId, u, expert.Id, sats*1000,
+		fmt.Sprintf("question #%d to %s", id, expert.AtName()), messageId)
+	if err != nil {
+		return
+	}
+
+	err = txn.Get(&q, `
+INSERT INTO telegram.question (id, asker_id, expert_id, amount, question, hold_id, deadline)
+VALUES ($1, $2, $3, $4, $5, $6, now() + make_interval(secs => $7))
+RETURNING *
+    `, id, u.Id, expert.Id, sats, question, holdId, deadline.Seconds())
+	if err != nil {
+		return q, "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return q, "Database error.", err
+	}
+
+	chattable := tgbotapi.NewMessage(expert.ChatId, fmt.Sprintf(
+		"❓ Question #%d from %s, worth <b>%d sat</b>:\n\n%s\n\n<i>Reply to this message to answer and get the satoshis. Unless answered by %s UTC, they go back to %s.</i>",
+		q.Id, u.AtName(), sats, escapeHTML(question),
+		q.Deadline.Format("2 Jan 2006 15:04"), u.AtName()))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Refund", fmt.Sprintf("ask=refund-%d", q.Id)),
+		),
+	)
+	relayed, err := bot.Send(chattable)
+	if err != nil {
+		log.Warn().Err(err).Int("question", q.Id).Msg("failed to relay question")
+		if rerr := q.undeliverable(); rerr != nil {
+			log.Error().Err(rerr).Int("question", q.Id).
+				Msg("failed to release hold of undelivered question")
+			return q, fmt.Sprintf("Couldn't deliver the question to %s.", expert.AtName()), err
+		}
+		return q, fmt.Sprintf("Couldn't deliver the question to %s, the %d sat are back in your balance.",
+			expert.AtName(), sats), err
+	}
+
+	q.MessageId = relayed.MessageID
+	pg.Exec(`UPDATE telegram.question SET message_id = $2 WHERE id = $1`, q.Id, q.MessageId)
+	setReplyRoute(expert.ChatId, relayed.MessageID, "ask:"+strconv.Itoa(q.Id), deadline)
+
+	return q, "", nil
+}
+
+// answerQuestion gives the held funds to the expert and the answer to the asker.
+func (expert User) answerQuestion(questionId int, message *tgbotapi.Message) {
+	answer := strings.TrimSpace(message.Text)
+	if answer == "" {
+		expert.notifyAsReply("Only text answers are accepted.", message.MessageID)
+		return
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var q Question
+	err = txn.Get(&q, `
+UPDATE telegram.question
+SET status = 'answered', answer = $3, answered_at = now()
+WHERE id = $1 AND expert_id = $2 AND status = 'open' AND deadline > now()
+RETURNING *
+    `, questionId, expert.Id, answer)
+	if err != nil {
+		expert.notifyAsReply("This question can't be answered anymore.", message.MessageID)
+		return
+	}
+
+	hold, err := captureHold(txn, q.HoldId, 0, "answered")
+	if err != nil {
+		log.Warn().Err(err).Int("question", q.Id).Msg("failed to capture question hold")
+		expert.notifyAsReply("Failed to get the satoshis for this answer.", message.MessageID)
+		return
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		expert.notifyAsReply("Failed to get the satoshis for this answer.", message.MessageID)
+		return
+	}
+
+	asker, _ := loadUser(q.AskerId, 0)
+	publish(InternalTransfer{
+		From:        asker,
+		To:          expert,
+		Msats:       hold.Msats,
+		Hash:        hold.Hash,
+		Description: hold.Description,
+	})
+
+	asker.notify(fmt.Sprintf("💬 %s answered your question #%d:\n\n<i>%s</i>\n\n%s",
+		expert.AtName(), q.Id, escapeHTML(q.Question), escapeHTML(answer)))
+
+	chattable := tgbotapi.NewMessage(expert.ChatId, fmt.Sprintf(
+		"Answer delivered, %d sat are yours. You can also publish this Q&amp;A as a hidden message, unlockable by anyone for the same price.",
+		q.Amount))
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyToMessageID = message.MessageID
+	chattable.BaseChat.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Publish", fmt.Sprintf("ask=publish-%d", q.Id)),
+		),
+	)
+	bot.Send(chattable)
+}
+
+// undeliverable gives the held funds back when the question never reached
+// the expert.
+func (q Question) undeliverable() (err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`
+UPDATE telegram.question SET status = 'refunded' WHERE id = $1 AND status = 'open'
+    `, q.Id)
+	if err != nil {
+		return
+	}
+
+	_, err = releaseHold(txn, q.HoldId, "not delivered")
+	if err != nil {
+		return
+	}
+
+	return txn.Commit()
+}
+
+// refundQuestion gives the held funds back to the asker, when the expert
+// declines (by is the expert) or on the deadline (by is nil).
+func refundQuestion(questionId int, by *User) (q Question, errMsg string, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return q, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	var expertId interface{}
+	if by != nil {
+		expertId = by.Id
+	}
+
+	err = txn.Get(&q, `
+UPDATE telegram.question SET status = 'refunded'
+WHERE id = $1 AND status = 'open' AND ($2::int IS NULL OR expert_id = $2)
+RETURNING *
+    `, questionId, expertId)
+	if err != nil {
+		return q, "This question is not open anymore.", err
+	}
+
+	note := "not answered in time"
+	if by != nil {
+		note = "declined"
+	}
+
+	_, err = releaseHold(txn, q.HoldId, note)
+	if err != nil {
+		return q, "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return q, "Database error.", err
+	}
+
+	asker, _ := loadUser(q.AskerId, 0)
+	expert, _ := loadUser(q.ExpertId, 0)
+
+	asker.notify(fmt.Sprintf("Your question #%d to %s was %s, the %d sat are back in your balance.",
+		q.Id, expert.AtName(), note, q.Amount))
+	if by == nil && q.MessageId != 0 {
+		edit := tgbotapi.NewEditMessageText(expert.ChatId, q.MessageId, fmt.Sprintf(
+			"❓ Question #%d from %s:\n\n%s\n\n<i>Not answered in time, refunded.</i>",
+			q.Id, asker.AtName(), escapeHTML(q.Question)))
+		edit.ParseMode = "HTML"
+		bot.Send(edit)
+	}
+
+	return q, "", nil
+}
+
+// publishQuestion turns an answered question into a hidden message, with the
+// question as the preview and the answer as the content.
+func (expert User) publishQuestion(questionId int) (hiddenid string, err error) {
+	var q Question
+	err = pg.Get(&q, `
+SELECT * FROM telegram.question
+WHERE id = $1 AND expert_id = $2 AND status = 'answered'
+    `, questionId, expert.Id)
+	if err != nil {
+		return
+	}
+
+	// "~" separates the preview from the content
+	question := strings.Replace(q.Question, "~", "-", -1)
+	return createHiddenMessage(expert, q.Amount, fmt.Sprintf(
+		"❓ %s ~ ❓ %s\n\n💬 %s", question, question, q.Answer))
+}
+
+func refundUnansweredQuestions() {
+	var ids []int
+	err := pg.Select(&ids, `
+SELECT id FROM telegram.question WHERE status = 'open' AND deadline < now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load unanswered questions")
+		return
+	}
+
+	for _, id := range ids {
+		_, _, err := refundQuestion(id, nil)
+		if err != nil {
+			log.Warn().Err(err).Int("question", id).Msg("failed to refund unanswered question")
+		}
+	}
+}
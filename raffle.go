@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	MAX_RAFFLE_DURATION    = time.Hour * 24 * 30
+	MAX_RAFFLE_CUT         = 50 // percent
+	MAX_TICKETS_PER_ACTION = 1000
+)
+
+type Raffle struct {
+	Id          int           `db:"id"`
+	OrganizerId int           `db:"organizer_id"`
+	TicketPrice int           `db:"ticket_price"`
+	Prize       string        `db:"prize"`
+	Cut         int           `db:"cut"`
+	ChatId      int64         `db:"chat_id"`
+	MessageId   int           `db:"message_id"`
+	EndsAt      time.Time     `db:"ends_at"`
+	Status      string        `db:"status"`
+	WinnerId    sql.NullInt64 `db:"winner_id"`
+	CreatedAt   time.Time     `db:"created_at"`
+	DrawnAt     *time.Time    `db:"drawn_at"`
+}
+
+type RaffleTickets struct {
+	BuyerId int    `db:"buyer_id"`
+	Tickets int    `db:"tickets"`
+	HoldId  string `db:"hold_id"`
+}
+
+func (r Raffle) tickets() (sold []RaffleTickets, err error) {
+	err = pg.Select(&sold, `
+SELECT buyer_id, tickets, hold_id FROM telegram.raffle_ticket
+WHERE raffle_id = $1
+ORDER BY id
+    `, r.Id)
+	return
+}
+
+// prizeFor is what the winner gets from a pot of the given size.
+func (r Raffle) prizeFor(pot int) int {
+	return pot * (100 - r.Cut) / 100
+}
+
+func (r Raffle) render() string {
+	organizer, _ := loadUser(r.OrganizerId, 0)
+
+	text := fmt.Sprintf("🎟 <b>Raffle #%d</b> by %s", r.Id, organizer.AtName())
+	if r.Prize != "" {
+		text += "\n" + escapeHTML(r.Prize)
+	}
+
+	var ntickets int
+	buyers := make(map[int]bool)
+	sold, _ := r.tickets()
+	for _, t := range sold {
+		ntickets += t.Tickets
+		buyers[t.BuyerId] = true
+	}
+	pot := ntickets * r.TicketPrice
+
+	text += fmt.Sprintf("\n\nTicket price: %d sat. Sold: <b>%d</b> tickets to %d people.\nThe winner gets %d sat",
+		r.TicketPrice, ntickets, len(buyers), r.prizeFor(pot))
+	if r.Cut > 0 {
+		text += fmt.Sprintf(" (%d%% goes to the organizer)", r.Cut)
+	}
+	text += "."
+
+	switch r.Status {
+	case "open":
+		return text + fmt.Sprintf(
+			"\nDraw on %s UTC.\n\n<i>Reply to this message with a number to buy that many tickets.</i>",
+			r.EndsAt.Format("2 Jan 2006 15:04"))
+	case "drawn":
+		winner, _ := loadUser(int(r.WinnerId.Int64), 0)
+		return text + fmt.Sprintf("\n\n🎉 Won by %s!", winner.AtName())
+	default:
+		return text + "\n\nEnded without tickets."
+	}
+}
+
+func (r Raffle) keyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Buy 1 ticket", fmt.Sprintf("raffle=%d-1", r.Id)),
+			tgbotapi.NewInlineKeyboardButtonData("Buy 5 tickets", fmt.Sprintf("raffle=%d-5", r.Id)),
+		),
+	)
+}
+
+func (r Raffle) refreshMessage() {
+	if r.Status == "open" {
+		editWithKeyboard(r.ChatId, r.MessageId, r.render(), r.keyboard())
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(r.ChatId, r.MessageId, r.render())
+	edit.ParseMode = "HTML"
+	bot.Send(edit)
+}
+
+func (u User) startRaffle(
+	chatId int64,
+	ticketPrice int,
+	duration time.Duration,
+	prize string,
+	cut int,
+) (r Raffle, err error) {
+	if duration <= 0 || duration > MAX_RAFFLE_DURATION {
+		return r, fmt.Errorf("the deadline must be at most %s from now",
+			formatInterval(MAX_RAFFLE_DURATION))
+	}
+	if cut < 0 || cut > MAX_RAFFLE_CUT {
+		return r, fmt.Errorf("the organizer cut must be between 0 and %d%%", MAX_RAFFLE_CUT)
+	}
+
+	err = pg.Get(&r, `
+INSERT INTO telegram.raffle (organizer_id, ticket_price, prize, cut, chat_id, ends_at)
+VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6))
+RETURNING *
+    `, u.Id, ticketPrice, prize, cut, chatId, duration.Seconds())
+	if err != nil {
+		return
+	}
+
+	chattable := tgbotapi.NewMessage(chatId, r.render())
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = r.keyboard()
+	message, err := bot.Send(chattable)
+	if err != nil {
+		pg.Exec(`DELETE FROM telegram.raffle WHERE id = $1`, r.Id)
+		return
+	}
+
+	r.MessageId = message.MessageID
+	_, err = pg.Exec(`UPDATE telegram.raffle SET message_id = $2 WHERE id = $1`, r.Id, r.MessageId)
+	setReplyRoute(chatId, r.MessageId, "raffle:"+strconv.Itoa(r.Id), duration)
+	return
+}
+
+// buyRaffleTickets holds the price of the tickets until the draw.
+func (u User) buyRaffleTickets(raffleId int, n int) (r Raffle, errMsg string, err error) {
+	if n <= 0 || n > MAX_TICKETS_PER_ACTION {
+		return r, fmt.Sprintf("Buy between 1 and %d tickets at a time.", MAX_TICKETS_PER_ACTION),
+			errors.New("invalid number of tickets")
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return r, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&r, `
+SELECT * FROM telegram.raffle
+WHERE id = $1 AND status = 'open' AND ends_at > now()
+FOR SHARE
+    `, raffleId)
+	if err != nil {
+		return r, "This raffle has ended.", err
+	}
+	if r.OrganizerId == u.Id {
+		return r, "Can't buy tickets for your own raffle.", errors.New("organizer buying")
+	}
+
+	var purchaseId int
+	err = txn.Get(&purchaseId, `SELECT nextval('telegram.raffle_ticket_id_seq')`)
+	if err != nil {
+		return r, "Database error.", err
+	}
+
+	// the receiver is only known at the draw
+	holdId := fmt.Sprintf("raffle:%d", purchaseId)
+	_, errMsg, err = holdFunds(txn, holdId, u, 0, n*r.TicketPrice*1000,
+		fmt.Sprintf("%d tickets for raffle #%d", n, r.Id), 0)
+	if err != nil {
+		return
+	}
+
+	_, err = txn.Exec(`
+INSERT INTO telegram.raffle_ticket (id, raffle_id, buyer_id, tickets, hold_id)
+VALUES ($1, $2, $3, $4, $5)
+    `, purchaseId, r.Id, u.Id, n, holdId)
+	if err != nil {
+		return r, "Database error.", err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return r, "Database error.", err
+	}
+
+	r.refreshMessage()
+	return r, "", nil
+}
+
+func (u User) buyRaffleTicketsFromReply(raffleId int, message *tgbotapi.Message) {
+	n, err := strconv.Atoi(strings.TrimSpace(message.Text))
+	if err != nil || n <= 0 {
+		if message.Chat.Type == "private" {
+			notifyAsReply(message.Chat.ID, "To buy tickets, reply with just the number of tickets.", message.MessageID)
+		}
+		// in groups this is just people talking about it
+		return
+	}
+
+	_, errMsg, err := u.buyRaffleTickets(raffleId, n)
+	if err != nil {
+		log.Debug().Err(err).Int("raffle", raffleId).Str("user", u.Username).
+			Msg("failed to buy raffle tickets")
+		notifyAsReply(message.Chat.ID, "Tickets not bought: "+errMsg, message.MessageID)
+		return
+	}
+
+	notifyAsReply(message.Chat.ID, fmt.Sprintf("%s bought %d tickets.", u.AtName(), n), message.MessageID)
+}
+
+// drawRaffle picks a winner with odds proportional to their tickets. all the
+// tickets are paid to the organizer, who pays the prize to the winner, in
+// the same transaction.
+func drawRaffle(raffleId int) (err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var r Raffle
+	err = txn.Get(&r, `
+UPDATE telegram.raffle SET status = 'ended', drawn_at = now()
+WHERE id = $1 AND status = 'open'
+RETURNING *
+    `, raffleId)
+	if err != nil {
+		return
+	}
+
+	var sold []RaffleTickets
+	err = txn.Select(&sold, `
+SELECT buyer_id, tickets, hold_id FROM telegram.raffle_ticket
+WHERE raffle_id = $1
+ORDER BY id
+    `, r.Id)
+	if err != nil {
+		return
+	}
+
+	var ntickets int
+	for _, t := range sold {
+		ntickets += t.Tickets
+	}
+
+	if ntickets == 0 {
+		err = txn.Commit()
+		if err == nil {
+			r.refreshMessage()
+		}
+		return
+	}
+
+	draw := rand.Intn(ntickets)
+	var winnerId int
+	for _, t := range sold {
+		if draw < t.Tickets {
+			winnerId = t.BuyerId
+			break
+		}
+		draw -= t.Tickets
+	}
+
+	organizer, _ := loadUser(r.OrganizerId, 0)
+	winner, _ := loadUser(winnerId, 0)
+
+	transfers := make([]InternalTransfer, len(sold))
+	for i, t := range sold {
+		hold, err := captureHold(txn, t.HoldId, r.OrganizerId,
+			fmt.Sprintf("raffle #%d drawn", r.Id))
+		if err != nil {
+			return err
+		}
+		buyer, _ := loadUser(t.BuyerId, 0)
+		transfers[i] = InternalTransfer{
+			From:        buyer,
+			To:          organizer,
+			Msats:       hold.Msats,
+			Hash:        hold.Hash,
+			Description: hold.Description,
+		}
+	}
+
+	pot := ntickets * r.TicketPrice
+	prize := r.prizeFor(pot)
+
+	var hash string
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description)
+VALUES ($1, $2, $3, $4)
+RETURNING payment_hash
+    `, r.OrganizerId, winnerId, prize*1000, fmt.Sprintf("prize of raffle #%d", r.Id))
+	if err != nil {
+		return
+	}
+
+	err = txn.Get(&r, `
+UPDATE telegram.raffle SET status = 'drawn', winner_id = $2
+WHERE id = $1
+RETURNING *
+    `, r.Id, winnerId)
+	if err != nil {
+		return
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return
+	}
+
+	publish(PooledTransfer{To: organizer, Transfers: transfers})
+	publish(InternalTransfer{
+		From:        organizer,
+		To:          winner,
+		Msats:       prize * 1000,
+		Hash:        hash,
+		Description: fmt.Sprintf("prize of raffle #%d", r.Id),
+		ReceiverNotice: fmt.Sprintf("🎉 You won raffle #%d by %s! %d sat are in your balance.",
+			r.Id, organizer.AtName(), prize),
+		SenderNotice: fmt.Sprintf("Raffle #%d was won by %s, who got %d sat. You kept %d sat.",
+			r.Id, winner.AtName(), prize, pot-prize),
+	})
+
+	r.refreshMessage()
+	return
+}
+
+func drawDueRaffles() {
+	var ids []int
+	err := pg.Select(&ids, `
+SELECT id FROM telegram.raffle WHERE status = 'open' AND ends_at < now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load due raffles")
+		return
+	}
+
+	for _, id := range ids {
+		err := drawRaffle(id)
+		if err != nil {
+			log.Warn().Err(err).Int("raffle", id).Msg("failed to draw raffle")
+		}
+	}
+}
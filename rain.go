@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+const (
+	RAIN_WINDOW          = time.Hour * 24
+	RAIN_MAX_TRACKED     = 500
+	DEFAULT_RAIN_MEMBERS = 10
+	MAX_RAIN_MEMBERS     = 100
+)
+
+// activity is kept per chat in a sorted set of account ids scored by the
+// time they last spoke, trimmed to the RAIN_WINDOW.
+func activityKey(chatId int64) string {
+	return fmt.Sprintf("activity:%d", chatId)
+}
+
+func recordActivity(chatId int64, u User) {
+	key := activityKey(chatId)
+	now := time.Now()
+
+	rds.ZAdd(key, redis.Z{Score: float64(now.Unix()), Member: u.Id})
+	rds.ZRemRangeByScore(key, "-inf", strconv.FormatInt(now.Add(-RAIN_WINDOW).Unix(), 10))
+	rds.ZRemRangeByRank(key, 0, -RAIN_MAX_TRACKED-1)
+	rds.Expire(key, RAIN_WINDOW)
+}
+
+// recentlyActive returns up to n users who spoke in the chat within the
+// RAIN_WINDOW, most recent first, except the given one.
+func recentlyActive(chatId int64, n int, except int) (users []User, err error) {
+	ids, err := rds.ZRevRangeByScore(activityKey(chatId), redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Add(-RAIN_WINDOW).Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return
+	}
+
+	for _, sid := range ids {
+		if len(users) == n {
+			break
+		}
+
+		id, err := strconv.Atoi(sid)
+		if err != nil || id == except {
+			continue
+		}
+		user, err := loadUser(id, 0)
+		if err != nil {
+			continue
+		}
+		users = append(users, user)
+	}
+	return
+}
+
+// rain splits sats equally between the n most recently active members of a
+// chat, all in one transaction. what doesn't divide evenly stays with the
+// sender.
+func (u User) rain(chatId int64, chatTitle string, sats int, n int, messageId int) (
+	recipients []User, share int, errMsg string, err error,
+) {
+	if n < 1 || n > MAX_RAIN_MEMBERS {
+		return nil, 0, fmt.Sprintf("Rain on 1 to %d people.", MAX_RAIN_MEMBERS),
+			errors.New("invalid number of recipients")
+	}
+
+	recipients, err = recentlyActive(chatId, n, u.Id)
+	if err != nil {
+		return nil, 0, "Failed to get the active members.", err
+	}
+	if len(recipients) == 0 {
+		return nil, 0, "Nobody else has been active here lately.", errors.New("no recipients")
+	}
+
+	share = sats / len(recipients)
+	if share < 1 {
+		return nil, 0, fmt.Sprintf("%d sat is not enough for %d people.", sats, len(recipients)),
+			errors.New("amount too small")
+	}
+
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, 0, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	desc := "rain on " + chatTitle
+	transfers := make([]InternalTransfer, len(recipients))
+	for i, recipient := range recipients {
+		var hash string
+		err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, trigger_message, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING payment_hash
+        `, u.Id, recipient.Id, share*1000, desc, messageId, nullChat(chatId))
+		if err != nil {
+			return nil, 0, "Database error.", err
+		}
+
+		transfers[i] = InternalTransfer{
+			From:        u,
+			To:          recipient,
+			Msats:       share * 1000,
+			Hash:        hash,
+			Description: desc,
+			ReceiverNotice: fmt.Sprintf("🌧 %s made it rain on %s, you got %d sat.",
+				u.AtName(), escapeHTML(chatTitle), share),
+		}
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, u.Id)
+	if err != nil {
+		return nil, 0, "Database error.", err
+	}
+	if balance < 0 {
+		return nil, 0, fmt.Sprintf("Insufficient balance. Needs %.3f sat more.",
+				-float64(balance)/1000),
+			errors.New("insufficient balance")
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return nil, 0, "Database error.", err
+	}
+
+	for _, transfer := range transfers {
+		publish(transfer)
+	}
+	return recipients, share, "", nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/lib/pq"
+)
+
+const (
+	MAX_SCHEDULES         = 20
+	MIN_SCHEDULE_INTERVAL = time.Hour
+	MAX_SCHEDULE_FAILURES = 3
+)
+
+type Schedule struct {
+	Id              int            `db:"id"`
+	AccountId       int            `db:"account_id"`
+	Kind            string         `db:"kind"`
+	Amount          sql.NullInt64  `db:"amount"`
+	TargetId        sql.NullInt64  `db:"target_id"`
+	Target          sql.NullString `db:"target"`
+	NextRun         time.Time      `db:"next_run"`
+	IntervalSeconds sql.NullInt64  `db:"interval_seconds"`
+	Until           pq.NullTime    `db:"until"`
+	RunsLeft        sql.NullInt64  `db:"runs_left"`
+	Runs            int            `db:"runs"`
+	Failures        int            `db:"failures"`
+	Active          bool           `db:"active"`
+	LastError       sql.NullString `db:"last_error"`
+	CreatedAt       time.Time      `db:"created_at"`
+
+	// filled by listSchedules
+	TargetName sql.NullString `db:"target_name"`
+}
+
+func (sch Schedule) Description() string {
+	var what string
+	switch sch.Kind {
+	case "send":
+		what = fmt.Sprintf("send %d sat to @%s", sch.Amount.Int64, sch.TargetName.String)
+		if _, err := strconv.Atoi(sch.TargetName.String); err == nil {
+			what = fmt.Sprintf("send %d sat to user %s", sch.Amount.Int64, sch.TargetName.String)
+		}
+	case "pay":
+		target := sch.Target.String
+		if len(target) > 24 {
+			target = target[:24] + "…"
+		}
+		what = "pay " + target
+		if sch.Amount.Valid {
+			what = fmt.Sprintf("pay %d sat to %s", sch.Amount.Int64, target)
+		}
+	}
+
+	when := "at " + sch.NextRun.Format("2006-01-02 15:04") + " UTC"
+	if sch.IntervalSeconds.Valid {
+		when = "every " + formatInterval(time.Duration(sch.IntervalSeconds.Int64)*time.Second) +
+			", next at " + sch.NextRun.Format("2006-01-02 15:04") + " UTC"
+		if sch.RunsLeft.Valid {
+			when += fmt.Sprintf(", %d times left", sch.RunsLeft.Int64)
+		}
+		if sch.Until.Valid {
+			when += ", until " + sch.Until.Time.Format("2006-01-02 15:04") + " UTC"
+		}
+	}
+
+	return escapeHTML(what + ", " + when)
+}
+
+// parseInterval accepts Go durations ("36h") plus days and weeks ("3d", "2w")
+// and the words hourly, daily and weekly.
+func parseInterval(value string) (interval time.Duration, err error) {
+	switch strings.ToLower(value) {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return time.Hour * 24, nil
+	case "weekly":
+		return time.Hour * 24 * 7, nil
+	}
+
+	if len(value) > 1 {
+		unit := time.Duration(0)
+		switch value[len(value)-1] {
+		case 'd':
+			unit = time.Hour * 24
+		case 'w':
+			unit = time.Hour * 24 * 7
+		}
+		if unit != 0 {
+			n, err := strconv.Atoi(value[:len(value)-1])
+			if err != nil || n <= 0 {
+				return 0, errors.New("Invalid interval: " + value)
+			}
+			return unit * time.Duration(n), nil
+		}
+	}
+
+	interval, err = time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, errors.New("Invalid interval: " + value)
+	}
+	return interval, nil
+}
+
+func formatInterval(interval time.Duration) string {
+	day := time.Hour * 24
+	switch {
+	case interval%(day*7) == 0:
+		return fmt.Sprintf("%dw", interval/(day*7))
+	case interval%day == 0:
+		return fmt.Sprintf("%dd", interval/day)
+	default:
+		return strings.TrimSuffix(strings.TrimSuffix(interval.String(), "0s"), "0m")
+	}
+}
+
+// parseScheduleTime accepts absolute times in UTC ("2020-01-31T14:00",
+// "2020-01-31") or a duration from now ("2h", "3d").
+func parseScheduleTime(value string) (t time.Time, err error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err = time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	if d, err := parseInterval(value); err == nil {
+		return time.Now().UTC().Add(d), nil
+	}
+
+	return t, errors.New("Invalid time: " + value + ". Use something like 2020-01-31T14:00 (UTC) or 3d.")
+}
+
+func (u User) countActiveSchedules() (count int, err error) {
+	err = pg.Get(&count, `
+SELECT count(*) FROM lightning.schedule WHERE account_id = $1 AND active
+    `, u.Id)
+	return
+}
+
+func (u User) scheduleSend(
+	target User,
+	sats int,
+	first time.Time,
+	interval time.Duration,
+	until *time.Time,
+	times int,
+) (sch Schedule, err error) {
+	if target.Id == u.Id {
+		err = errors.New("Can't send to yourself.")
+		return
+	}
+	if interval < MIN_SCHEDULE_INTERVAL {
+		err = fmt.Errorf("The interval must be at least %s.", formatInterval(MIN_SCHEDULE_INTERVAL))
+		return
+	}
+
+	if count, _ := u.countActiveSchedules(); count >= MAX_SCHEDULES {
+		err = fmt.Errorf("You can't have more than %d active schedules.", MAX_SCHEDULES)
+		return
+	}
+
+	var vuntil pq.NullTime
+	if until != nil {
+		vuntil = pq.NullTime{Time: *until, Valid: true}
+	}
+	var vtimes sql.NullInt64
+	if times > 0 {
+		vtimes.Scan(int64(times))
+	}
+
+	err = pg.Get(&sch, `
+INSERT INTO lightning.schedule
+  (account_id, kind, amount, target_id, next_run, interval_seconds, until, runs_left)
+VALUES ($1, 'send', $2, $3, $4, $5, $6, $7)
+RETURNING *
+    `, u.Id, sats, target.Id, first, int64(interval.Seconds()), vuntil, vtimes)
+	return
+}
+
+func (u User) schedulePay(target string, sats int, at time.Time) (sch Schedule, err error) {
+	var vamount sql.NullInt64
+	if sats > 0 {
+		vamount.Scan(int64(sats))
+	}
+
+	if isLightningAddress(target) {
+		if sats <= 0 {
+			err = errors.New("An amount is needed for paying a lightning address.")
+			return
+		}
+	} else {
+		inv, err := ln.Call("decodepay", target)
+		if err != nil {
+			return sch, errors.New("Invalid invoice or lightning address.")
+		}
+		if inv.Get("msatoshi").Int() == 0 && sats <= 0 {
+			return sch, errors.New("This invoice has no amount, please specify one.")
+		}
+		expiry := time.Unix(inv.Get("created_at").Int()+inv.Get("expiry").Int(), 0)
+		if expiry.Before(at) {
+			return sch, errors.New("The invoice will have expired by then.")
+		}
+	}
+
+	if count, _ := u.countActiveSchedules(); count >= MAX_SCHEDULES {
+		err = fmt.Errorf("You can't have more than %d active schedules.", MAX_SCHEDULES)
+		return
+	}
+
+	err = pg.Get(&sch, `
+INSERT INTO lightning.schedule (account_id, kind, amount, target, next_run, runs_left)
+VALUES ($1, 'pay', $2, $3, $4, 1)
+RETURNING *
+    `, u.Id, vamount, target, at)
+	return
+}
+
+func (u User) getSchedule(id int) (sch Schedule, err error) {
+	err = pg.Get(&sch, `
+SELECT s.*, coalesce(a.username, a.telegram_id::text) AS target_name
+FROM lightning.schedule AS s
+LEFT OUTER JOIN telegram.account AS a ON a.id = s.target_id
+WHERE s.id = $1 AND s.account_id = $2
+    `, id, u.Id)
+	return
+}
+
+func (u User) listSchedules() (schedules []Schedule, err error) {
+	err = pg.Select(&schedules, `
+SELECT s.*, coalesce(a.username, a.telegram_id::text) AS target_name
+FROM lightning.schedule AS s
+LEFT OUTER JOIN telegram.account AS a ON a.id = s.target_id
+WHERE s.account_id = $1 AND s.active
+ORDER BY s.next_run
+    `, u.Id)
+	return
+}
+
+func (u User) cancelSchedule(id int) (err error) {
+	res, err := pg.Exec(`
+UPDATE lightning.schedule SET active = false
+WHERE id = $1 AND account_id = $2 AND active
+    `, id, u.Id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Schedule not found.")
+	}
+	return
+}
+
+func schedulesKeyboard(schedules []Schedule) tgbotapi.InlineKeyboardMarkup {
+	rows := make([][]tgbotapi.InlineKeyboardButton, len(schedules))
+	for i, sch := range schedules {
+		rows[i] = tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("Cancel #%d", sch.Id),
+				fmt.Sprintf("unsch=%d", sch.Id),
+			),
+		)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// runDueSchedules takes the schedules that are due, advances them and only
+// then executes them, so a crash in the middle can't cause a run to happen twice.
+// failed runs are reported and not retried, but a schedule that fails too many
+// times in a row is stopped.
+func runDueSchedules() {
+	txn, err := pg.Beginx()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to start schedules transaction")
+		return
+	}
+	defer txn.Rollback()
+
+	var due []Schedule
+	err = txn.Select(&due, `
+SELECT * FROM lightning.schedule
+WHERE active AND next_run <= now()
+ORDER BY next_run
+LIMIT 50
+FOR UPDATE SKIP LOCKED
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load due schedules")
+		return
+	}
+
+	for _, sch := range due {
+		_, err = txn.Exec(`
+UPDATE lightning.schedule
+SET
+  runs = runs + 1,
+  runs_left = runs_left - 1,
+  next_run = CASE WHEN interval_seconds IS NULL THEN next_run
+    ELSE greatest(next_run + make_interval(secs => interval_seconds), now())
+  END,
+  active = interval_seconds IS NOT NULL
+    AND coalesce(runs_left - 1 > 0, true)
+    AND coalesce(greatest(next_run + make_interval(secs => interval_seconds), now()) <= until, true)
+WHERE id = $1
+        `, sch.Id)
+		if err != nil {
+			log.Warn().Err(err).Int("schedule", sch.Id).Msg("failed to advance schedule")
+			return
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to commit schedules transaction")
+		return
+	}
+
+	for _, sch := range due {
+		go runSchedule(sch)
+	}
+}
+
+func runSchedule(sch Schedule) {
+	u, err := loadUser(sch.AccountId, 0)
+	if err != nil {
+		log.Warn().Err(err).Int("schedule", sch.Id).Msg("failed to load schedule owner")
+		return
+	}
+
+	var errMsg string
+	switch sch.Kind {
+	case "send":
+		var target User
+		target, err = loadUser(int(sch.TargetId.Int64), 0)
+		if err != nil {
+			errMsg = "Failed to load the receiver."
+			break
+		}
+
+		sats := int(sch.Amount.Int64)
+		errMsg, err = u.sendInternally(0, 0, target, false, sats*1000,
+			fmt.Sprintf("scheduled payment #%d", sch.Id), nil)
+		if err != nil {
+			break
+		}
+
+		target.notify(fmt.Sprintf("%s has sent you %d sat (scheduled payment).", u.AtName(), sats))
+		u.notify(fmt.Sprintf("Scheduled payment #%d: %d sat sent to %s.", sch.Id, sats, target.AtName()))
+	case "pay":
+		bolt11 := sch.Target.String
+		msats := int(sch.Amount.Int64) * 1000
+		if isLightningAddress(bolt11) {
+			bolt11, err = invoiceFromLightningAddress(sch.Target.String, msats)
+			if err != nil {
+				errMsg = err.Error()
+				break
+			}
+			msats = 0
+		}
+
+		u.notify(fmt.Sprintf("Scheduled payment #%d: paying %s.", sch.Id, escapeHTML(sch.Target.String)))
+		err = u.payInvoice(0, bolt11, msats)
+		if err != nil {
+			errMsg = err.Error()
+		}
+	}
+
+	if err == nil {
+		pg.Exec(`UPDATE lightning.schedule SET failures = 0, last_error = NULL WHERE id = $1`, sch.Id)
+		return
+	}
+
+	log.Info().Err(err).Int("schedule", sch.Id).Str("msg", errMsg).Msg("scheduled payment failed")
+
+	var failures int
+	pg.Get(&failures, `
+UPDATE lightning.schedule
+SET failures = failures + 1, last_error = $2,
+  active = active AND failures + 1 < $3
+WHERE id = $1
+RETURNING failures
+    `, sch.Id, errMsg, MAX_SCHEDULE_FAILURES)
+
+	stopped := ""
+	if failures >= MAX_SCHEDULE_FAILURES && sch.IntervalSeconds.Valid {
+		stopped = fmt.Sprintf(" It has failed %d times in a row and won't run again.", failures)
+	}
+	u.notify(fmt.Sprintf("Scheduled payment #%d failed: %s.%s", sch.Id, escapeHTML(errMsg), stopped))
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const MAX_SPLIT_PARTICIPANTS = 50
+
+type Split struct {
+	Id             int       `db:"id"`
+	InitiatorId    int       `db:"initiator_id"`
+	Total          int       `db:"total"`
+	InitiatorShare int       `db:"initiator_share"`
+	Memo           string    `db:"memo"`
+	ChatId         int64     `db:"chat_id"`
+	MessageId      int       `db:"message_id"`
+	Settled        bool      `db:"settled"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+type SplitParticipant struct {
+	User   User
+	Weight int
+}
+
+// parseSplitParticipants reads "@a @b:2 @c for dinner" as a list of participants,
+// each with an optional weight, followed by a memo. users without a username
+// (text mentions) are also accepted.
+func parseSplitParticipants(
+	message *tgbotapi.Message,
+	words []string,
+) (participants []SplitParticipant, memo string, err error) {
+	var textmentions []tgbotapi.MessageEntity
+	if message.Entities != nil {
+		for _, entity := range *message.Entities {
+			if entity.Type == "text_mention" && entity.User != nil {
+				textmentions = append(textmentions, entity)
+			}
+		}
+	}
+	text := utf16.Encode([]rune(message.Text))
+
+	index := make(map[int]int) // user id -> position in participants
+	add := func(user User, weight int) {
+		if i, ok := index[user.Id]; ok {
+			participants[i].Weight += weight
+			return
+		}
+		index[user.Id] = len(participants)
+		participants = append(participants, SplitParticipant{user, weight})
+	}
+
+	i := 0
+words:
+	for i < len(words) {
+		word, weight := cutWeight(words[i])
+
+		if strings.HasPrefix(word, "@") && len(word) > 1 {
+			var user User
+			user, err = ensureUsername(strings.ToLower(word[1:]))
+			if err != nil {
+				return
+			}
+			add(user, weight)
+			i++
+			continue
+		}
+
+		for t, entity := range textmentions {
+			if entity.Offset+entity.Length > len(text) {
+				continue
+			}
+			name := strings.Fields(string(utf16.Decode(text[entity.Offset : entity.Offset+entity.Length])))
+			if len(name) == 0 || i+len(name) > len(words) {
+				continue
+			}
+
+			last, weight := cutWeight(words[i+len(name)-1])
+			matches := last == name[len(name)-1]
+			for j := 0; j < len(name)-1 && matches; j++ {
+				matches = words[i+j] == name[j]
+			}
+			if !matches {
+				continue
+			}
+
+			var user User
+			user, err = ensureTelegramId(entity.User.ID)
+			if err != nil {
+				return
+			}
+			add(user, weight)
+			i += len(name)
+			textmentions = append(textmentions[:t], textmentions[t+1:]...)
+			continue words
+		}
+
+		// not a participant, everything from here on is the memo
+		break
+	}
+
+	memo = strings.TrimSpace(strings.Join(words[i:], " "))
+	return
+}
+
+// cutWeight splits "@someone:3" into "@someone" and 3.
+func cutWeight(word string) (string, int) {
+	if idx := strings.LastIndex(word, ":"); idx > 0 {
+		if weight, err := strconv.Atoi(word[idx+1:]); err == nil && weight > 0 {
+			return word[:idx], weight
+		}
+	}
+	return word, 1
+}
+
+// splitShares divides total proportionally to the weights, the satoshis that
+// don't divide evenly go one each to the first participants.
+func splitShares(total int, weights []int) []int {
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+
+	shares := make([]int, len(weights))
+	assigned := 0
+	for i, w := range weights {
+		shares[i] = total * w / sum
+		assigned += shares[i]
+	}
+	for i := 0; assigned < total; i = (i + 1) % len(shares) {
+		shares[i]++
+		assigned++
+	}
+
+	return shares
+}
+
+func (u User) startSplit(
+	chatId int64,
+	total int,
+	participants []SplitParticipant,
+	memo string,
+) (split Split, err error) {
+	if len(participants) == 0 {
+		err = errors.New("No participants given.")
+		return
+	}
+	if len(participants) > MAX_SPLIT_PARTICIPANTS {
+		err = fmt.Errorf("Can't split among more than %d people.", MAX_SPLIT_PARTICIPANTS)
+		return
+	}
+	if len(participants) == 1 && participants[0].User.Id == u.Id {
+		err = errors.New("Can't split only with yourself.")
+		return
+	}
+
+	weights := make([]int, len(participants))
+	for i, p := range participants {
+		weights[i] = p.Weight
+	}
+	shares := splitShares(total, weights)
+	for _, share := range shares {
+		if share == 0 {
+			err = errors.New("The total is too small to be split among everybody.")
+			return
+		}
+	}
+
+	initiatorShare := 0
+	for i, p := range participants {
+		if p.User.Id == u.Id {
+			initiatorShare = shares[i]
+		}
+	}
+
+	err = pg.Get(&split, `
+INSERT INTO telegram.split (initiator_id, total, initiator_share, memo, chat_id)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *
+    `, u.Id, total, initiatorShare, memo, chatId)
+	if err != nil {
+		log.Warn().Err(err).Int("user", u.Id).Msg("failed to save split")
+		err = errors.New("Database error.")
+		return
+	}
+
+	requests := make([]PaymentRequest, 0, len(participants))
+	for i, p := range participants {
+		if p.User.Id == u.Id {
+			continue
+		}
+
+		var req PaymentRequest
+		req, err = u.savePaymentRequest(p.User, shares[i], memo, split.Id)
+		if err != nil {
+			pg.Exec(`DELETE FROM telegram.payment_request WHERE split_id = $1`, split.Id)
+			pg.Exec(`DELETE FROM telegram.split WHERE id = $1`, split.Id)
+			return
+		}
+		requests = append(requests, req)
+	}
+
+	// the tracking message
+	text, _ := split.render()
+	chattable := tgbotapi.NewMessage(chatId, text)
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = splitKeyboard(split.Id)
+	message, err := bot.Send(chattable)
+	if err != nil {
+		log.Warn().Err(err).Int("split", split.Id).Msg("failed to send split message")
+		err = nil
+	} else {
+		split.MessageId = message.MessageID
+		pg.Exec(`UPDATE telegram.split SET message_id = $2 WHERE id = $1`, split.Id, split.MessageId)
+	}
+
+	// participants that have a chat with the bot also get a private request
+	for i, req := range requests {
+		payer, _ := loadUser(req.PayerId, 0)
+		if payer.ChatId != 0 {
+			u.deliverPaymentRequest(payer, &requests[i])
+		}
+	}
+
+	return
+}
+
+func splitKeyboard(splitId int) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Pay my share", fmt.Sprintf("split=%d", splitId)),
+		),
+	)
+}
+
+func loadSplit(id int) (split Split, err error) {
+	err = pg.Get(&split, `SELECT * FROM telegram.split WHERE id = $1`, id)
+	return
+}
+
+func (split Split) requests() (requests []PaymentRequest, err error) {
+	err = pg.Select(&requests, `
+SELECT r.id, r.requester_id, r.payer_id, r.amount, r.memo, r.message_id, r.status,
+  r.created_at, r.expires_at, r.split_id, coalesce(a.username, a.telegram_id::text) AS peer
+FROM telegram.payment_request AS r
+INNER JOIN telegram.account AS a ON a.id = r.payer_id
+WHERE r.split_id = $1
+ORDER BY r.id
+    `, split.Id)
+	return
+}
+
+// render returns the text of the tracking message and whether every share
+// is already resolved.
+func (split Split) render() (text string, done bool) {
+	initiator, _ := loadUser(split.InitiatorId, 0)
+	requests, err := split.requests()
+	if err != nil {
+		log.Warn().Err(err).Int("split", split.Id).Msg("failed to load split requests")
+	}
+
+	memo := ""
+	if split.Memo != "" {
+		memo = " for <i>" + escapeHTML(split.Memo) + "</i>"
+	}
+
+	lines := []string{fmt.Sprintf("🧾 %s is splitting <b>%d sat</b>%s:", initiator.AtName(), split.Total, memo)}
+	if split.InitiatorShare > 0 {
+		lines = append(lines, fmt.Sprintf("✅ %s: %d sat", initiator.AtName(), split.InitiatorShare))
+	}
+
+	done = true
+	paid := split.InitiatorShare
+	for _, req := range requests {
+		var icon, note string
+		switch req.Status {
+		case "paid":
+			icon = "✅"
+			paid += req.Amount
+		case "declined":
+			icon = "❌"
+			note = " (declined)"
+		case "expired":
+			icon = "⌛"
+			note = " (expired)"
+		default:
+			icon = "⏳"
+			done = false
+		}
+
+		peer := req.Peer
+		if _, err := strconv.Atoi(peer); err != nil {
+			peer = "@" + peer
+		}
+		lines = append(lines, fmt.Sprintf("%s %s: %d sat%s", icon, escapeHTML(peer), req.Amount, note))
+	}
+
+	lines = append(lines, fmt.Sprintf("\n<b>Paid</b>: %d of %d sat", paid, split.Total))
+	return strings.Join(lines, "\n"), done
+}
+
+// updateSplit refreshes the tracking message and tells the initiator when
+// all shares are resolved.
+func updateSplit(id int) {
+	split, err := loadSplit(id)
+	if err != nil {
+		log.Warn().Err(err).Int("split", id).Msg("failed to load split")
+		return
+	}
+
+	text, done := split.render()
+
+	keyboard := splitKeyboard(split.Id)
+	if done {
+		keyboard = tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
+				[]tgbotapi.InlineKeyboardButton{},
+			},
+		}
+	}
+	if split.MessageId != 0 {
+		editWithKeyboard(split.ChatId, split.MessageId, text, keyboard)
+	}
+
+	if !done {
+		return
+	}
+
+	var settled bool
+	err = pg.Get(&settled, `
+UPDATE telegram.split SET settled = true
+WHERE id = $1 AND NOT settled
+RETURNING settled
+    `, split.Id)
+	if err != nil || !settled {
+		// already notified
+		return
+	}
+
+	if initiator, err := loadUser(split.InitiatorId, 0); err == nil {
+		initiator.notify("Your split is settled.\n\n" + text)
+	}
+}
+
+// paySplitShare pays the open share the user has in the given split.
+func (u User) paySplitShare(splitId int) (req PaymentRequest, errMsg string, err error) {
+	var requestId int
+	err = pg.Get(&requestId, `
+SELECT id FROM telegram.payment_request
+WHERE split_id = $1 AND payer_id = $2 AND status = 'open'
+    `, splitId, u.Id)
+	if err != nil {
+		return req, "You have nothing to pay here.", err
+	}
+
+	req, errMsg, err = u.payPaymentRequest(requestId)
+	if err != nil {
+		return
+	}
+
+	if req.MessageId != 0 {
+		bot.Send(tgbotapi.NewEditMessageText(u.ChatId, req.MessageId,
+			fmt.Sprintf("Paid %d sat.", req.Amount)))
+	}
+	return
+}
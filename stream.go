@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connected stream clients, by account id.
+var streams = struct {
+	sync.Mutex
+	clients map[int]map[chan AccountEvent]bool
+}{clients: make(map[int]map[chan AccountEvent]bool)}
+
+func subscribeStream(accountId int) chan AccountEvent {
+	ch := make(chan AccountEvent, 32)
+
+	streams.Lock()
+	defer streams.Unlock()
+	if _, ok := streams.clients[accountId]; !ok {
+		streams.clients[accountId] = make(map[chan AccountEvent]bool)
+	}
+	streams.clients[accountId][ch] = true
+
+	return ch
+}
+
+func unsubscribeStream(accountId int, ch chan AccountEvent) {
+	streams.Lock()
+	defer streams.Unlock()
+	delete(streams.clients[accountId], ch)
+	if len(streams.clients[accountId]) == 0 {
+		delete(streams.clients, accountId)
+	}
+}
+
+func publishToStreams(accountId int, event AccountEvent) {
+	streams.Lock()
+	defer streams.Unlock()
+	for ch := range streams.clients[accountId] {
+		select {
+		case ch <- event:
+		default:
+			// slow client, drop the event instead of blocking everybody
+			log.Debug().Int("account", accountId).Str("event", event.Id).
+				Msg("stream client buffer full, dropping event")
+		}
+	}
+}
+
+// emitAccountEvent is how account events leave the bot: to webhooks and to
+// connected stream clients.
+func emitAccountEvent(accountId int, event AccountEvent) {
+	publishToStreams(accountId, event)
+	dispatchWebhooks(accountId, event)
+}
+
+func accountEventOnEvent(event interface{}) {
+	switch ev := event.(type) {
+	case InvoicePaid:
+		emitAccountEvent(ev.Receiver.Id, newAccountEvent("invoice_paid", map[string]interface{}{
+			"payment_hash": ev.Hash,
+			"amount":       float64(ev.Msats) / 1000,
+			"description":  ev.Description,
+		}))
+	case PaymentSent:
+		emitAccountEvent(ev.Payer.Id, newAccountEvent("payment_sent", map[string]interface{}{
+			"payment_hash": ev.Hash,
+			"amount":       ev.Msats / 1000,
+			"fees":         ev.Fees / 1000,
+			"preimage":     ev.Preimage,
+		}))
+	case PaymentFailed:
+		emitAccountEvent(ev.Payer.Id, newAccountEvent("payment_failed", map[string]interface{}{
+			"payment_hash": ev.Hash,
+		}))
+	case InternalTransfer:
+		transfer := map[string]interface{}{
+			"payment_hash": ev.Hash,
+			"amount":       float64(ev.Msats) / 1000,
+			"description":  ev.Description,
+		}
+		if !ev.Anonymous {
+			transfer["from"] = ev.From.AtName()
+		}
+		emitAccountEvent(ev.To.Id, newAccountEvent("transfer_received", transfer))
+	case PooledTransfer:
+		for _, transfer := range ev.Transfers {
+			accountEventOnEvent(transfer)
+		}
+	}
+}
+
+const STREAM_TOKEN_EXPIRATION = time.Minute
+
+type APIStreamToken struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+func streamTokenKey(token string) string {
+	return "stream-token:" + token
+}
+
+// server-sent events, one AccountEvent per message.
+// since browsers can't set headers on EventSource they may instead get a
+// short-lived, single-use token from POST /api/v1/stream/token and pass it
+// as ?token=<token>. the long-lived credentials are never put in the URL.
+func startStream() {
+	http.HandleFunc("/api/v1/stream/token", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := apiAuth(w, r, "POST")
+		if !ok {
+			return
+		}
+
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			apiError(w, 500, "internal", "Failed to create a token.")
+			return
+		}
+		token := hex.EncodeToString(b)
+
+		err := rds.Set(streamTokenKey(token), user.Id, STREAM_TOKEN_EXPIRATION).Err()
+		if err != nil {
+			log.Warn().Err(err).Int("user", user.Id).Msg("api: failed to save stream token")
+			apiError(w, 500, "internal", "Failed to create a token.")
+			return
+		}
+
+		apiJSON(w, 200, APIStreamToken{token, int(STREAM_TOKEN_EXPIRATION.Seconds())})
+	})
+
+	http.HandleFunc("/api/v1/stream", func(w http.ResponseWriter, r *http.Request) {
+		var (
+			user User
+			ok   bool
+		)
+		if token := r.URL.Query().Get("token"); token != "" {
+			if r.Method != "GET" {
+				w.Header().Set("Allow", "GET")
+				apiError(w, 405, "method_not_allowed", "Method not allowed.")
+				return
+			}
+
+			// tokens are used only once, a reconnection needs a new one
+			key := streamTokenKey(token)
+			accountId, err := rds.Get(key).Int64()
+			if err != nil || rds.Del(key).Val() == 0 {
+				apiError(w, 401, "bad_auth", "Invalid or expired stream token.")
+				return
+			}
+			user, err = loadUser(int(accountId), 0)
+			if err != nil {
+				apiError(w, 401, "bad_auth", "Invalid or expired stream token.")
+				return
+			}
+		} else if user, ok = apiAuth(w, r, "GET"); !ok {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			apiError(w, 500, "internal", "Streaming not supported.")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		ch := subscribeStream(user.Id)
+		defer unsubscribeStream(user.Id, ch)
+
+		keepalive := time.NewTicker(time.Second * 25)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case event := <-ch:
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Warn().Err(err).Str("event", event.Type).Msg("failed to encode stream event")
+					continue
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+				flusher.Flush()
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
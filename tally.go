@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const TIP_TALLY_EXPIRATION = time.Hour * 24 * 7
+
+// reply-tips in spammy groups are summed per tipped message and shown in a
+// single bot reply under it, edited as more tips come. tippers are only
+// counted, never named, so anonymous tips stay anonymous.
+
+func tallyKey(chatId int64, messageId int) string {
+	return fmt.Sprintf("tally:%d:%d", chatId, messageId)
+}
+
+func formatThousands(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+func readTally(key string) string {
+	sats, _ := rds.HGet(key, "sats").Int64()
+	npeople := rds.SCard(key + ":from").Val()
+
+	people := "people"
+	if npeople == 1 {
+		people = "person"
+	}
+	return fmt.Sprintf("⚡ %s sat from %d %s", formatThousands(int(sats)), npeople, people)
+}
+
+// tallyTip adds a tip to the tally of the tipped message and updates the
+// bot reply, posting it on the first tip.
+func tallyTip(chatId int64, messageId int, tipper User, sats int) {
+	key := tallyKey(chatId, messageId)
+
+	rds.HIncrBy(key, "sats", int64(sats))
+	rds.SAdd(key+":from", tipper.Id)
+	rds.Expire(key, TIP_TALLY_EXPIRATION)
+	rds.Expire(key+":from", TIP_TALLY_EXPIRATION)
+
+	// only the first tip posts the reply, the others edit it
+	if rds.HSetNX(key, "reply", 0).Val() {
+		text := readTally(key)
+		reply := notifyAsReply(chatId, text, messageId)
+		if reply.MessageID == 0 {
+			// failed to post, let the next tip try again
+			rds.HDel(key, "reply")
+			return
+		}
+		rds.HSet(key, "reply", reply.MessageID)
+
+		// tips that came while we were posting
+		if latest := readTally(key); latest != text {
+			bot.Send(tgbotapi.NewEditMessageText(chatId, reply.MessageID, latest))
+		}
+		return
+	}
+
+	replyId, _ := rds.HGet(key, "reply").Int64()
+	if replyId == 0 {
+		// still being posted, it will pick up this tip
+		return
+	}
+	bot.Send(tgbotapi.NewEditMessageText(chatId, int(replyId), readTally(key)))
+}
@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
-	"github.com/lucsky/cuid"
 )
 
 func notify(chatId int64, msg string) tgbotapi.Message {
@@ -72,62 +72,6 @@ func getBaseEdit(cb *tgbotapi.CallbackQuery) tgbotapi.BaseEdit {
 	return baseedit
 }
 
-func giveawayKeyboard(giverId, sats int) tgbotapi.InlineKeyboardMarkup {
-	giveawayid := cuid.Slug()
-	buttonData := fmt.Sprintf("give=%d-%d-%s", giverId, sats, giveawayid)
-
-	rds.Set("giveaway:"+giveawayid, buttonData, s.GiveAwayTimeout)
-
-	return tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Cancel", fmt.Sprintf("cancel=%d", giverId)),
-			tgbotapi.NewInlineKeyboardButtonData(
-				"Claim!",
-				buttonData,
-			),
-		),
-	)
-}
-
-func giveflipKeyboard(giveflipid string, giverId, nparticipants, sats int) tgbotapi.InlineKeyboardMarkup {
-	return tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Cancel", fmt.Sprintf("cancel=%d", giverId)),
-			tgbotapi.NewInlineKeyboardButtonData(
-				"Try to win!",
-				fmt.Sprintf("gifl=%d-%d-%d-%s", giverId, nparticipants, sats, giveflipid),
-			),
-		),
-	)
-}
-
-func coinflipKeyboard(coinflipid string, nparticipants, sats int) tgbotapi.InlineKeyboardMarkup {
-	return tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(
-				"Join lottery",
-				fmt.Sprintf("flip=%d-%d-%s", nparticipants, sats, coinflipid),
-			),
-		),
-	)
-}
-
-func fundraiseKeyboard(
-	fundraiseid string,
-	receiverId int,
-	nparticipants int,
-	sats int,
-) tgbotapi.InlineKeyboardMarkup {
-	return tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(
-				"Contribute",
-				fmt.Sprintf("raise=%d-%d-%d-%s", receiverId, nparticipants, sats, fundraiseid),
-			),
-		),
-	)
-}
-
 func escapeHTML(m string) string {
 	return strings.Replace(
 		strings.Replace(
@@ -199,10 +143,70 @@ func isAdmin(message *tgbotapi.Message) bool {
 	}
 }
 
+// isChatAdmin is like isAdmin, but for any user and without exceptions for
+// basic groups.
+func isChatAdmin(chatId int64, telegramId int) bool {
+	chatmember, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{
+		ChatID: chatId,
+		UserID: telegramId,
+	})
+	if err != nil {
+		return false
+	}
+	return chatmember.IsAdministrator() || chatmember.IsCreator()
+}
+
+// countChatAdmins counts the human admins of a chat, 0 if unknown.
+func countChatAdmins(chatId int64) (n int) {
+	admins, err := bot.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: chatId})
+	if err != nil {
+		return 0
+	}
+	for _, admin := range admins {
+		if !admin.User.IsBot {
+			n++
+		}
+	}
+	return
+}
+
 func deleteMessage(message *tgbotapi.Message) {
 	bot.Send(tgbotapi.NewDeleteMessage(message.Chat.ID, message.MessageID))
 }
 
+// ticketReceiver is the account that gets the tickets paid to join a group:
+// the treasury, if that's the setting and it exists, or the chat owner. when
+// the payee is "admins" the owner gets it first and splits it afterwards.
+func ticketReceiver(chatId int64) (User, error) {
+	settings, err := getTicketSettings(chatId)
+	if err == nil && settings.Payee == "treasury" {
+		if treasury, err := getTreasury(chatId); err == nil {
+			return treasury, nil
+		}
+	}
+	return getChatOwner(chatId)
+}
+
+// getChatAdmins returns the human admins of a chat.
+func getChatAdmins(chatId int64) (users []User, err error) {
+	admins, err := bot.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: chatId})
+	if err != nil {
+		return
+	}
+
+	for _, admin := range admins {
+		if admin.User.IsBot {
+			continue
+		}
+		user, _, err := ensureUser(admin.User.ID, admin.User.UserName)
+		if err != nil {
+			continue
+		}
+		users = append(users, user)
+	}
+	return
+}
+
 func getChatOwner(chatId int64) (User, error) {
 	admins, err := bot.GetChatAdministrators(tgbotapi.ChatConfig{
 		ChatID: chatId,
@@ -228,3 +232,34 @@ func getChatOwner(chatId int64) (User, error) {
 
 	return User{}, errors.New("chat has no owner")
 }
+
+// setReplyRoute marks a message so that replies to it are handled by
+// handleReplyRoute instead of being parsed as commands. route is
+// "<kind>:<id>".
+func setReplyRoute(chatId int64, messageId int, route string, expiration time.Duration) {
+	rds.Set(fmt.Sprintf("replyto:%d:%d", chatId, messageId), route, expiration)
+}
+
+func startsWithCommand(message *tgbotapi.Message) bool {
+	return message.Entities != nil && len(*message.Entities) > 0 &&
+		(*message.Entities)[0].Type == "bot_command" &&
+		(*message.Entities)[0].Offset == 0
+}
+
+func getReplyRoute(message *tgbotapi.Message) (kind, id string, ok bool) {
+	if message.ReplyToMessage == nil {
+		return
+	}
+
+	route, err := rds.Get(fmt.Sprintf("replyto:%d:%d",
+		message.Chat.ID, message.ReplyToMessage.MessageID)).Result()
+	if err != nil {
+		return
+	}
+
+	parts := strings.SplitN(route, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	return parts[0], parts[1], true
+}
@@ -25,6 +25,7 @@ type Transaction struct {
 	Label          sql.NullString `db:"label"`
 	Description    string         `db:"description"`
 	Payee          sql.NullString `db:"payee_node"`
+	HoldId         sql.NullString `db:"hold_id"`
 
 	unclaimed *bool
 }
@@ -39,7 +40,7 @@ func (t Transaction) PeerActionDescription() string {
 		name = fmt.Sprintf(`tg://user?id=%[1]s`, t.TelegramPeer.String)
 	}
 
-	if t.Status == "RECEIVED" {
+	if t.Amount > 0 {
 		if t.Anonymous {
 			return "from someone"
 		} else {
@@ -58,11 +59,39 @@ func (t Transaction) StatusSmall() string {
 		return "S"
 	case "PENDING":
 		return "-"
+	case "HELD":
+		return "H"
+	case "INCOMING":
+		return "I"
+	case "REFUNDED":
+		return "X"
 	default:
 		return t.Status
 	}
 }
 
+// HoldInfo describes the lifecycle of a transaction that went through a hold.
+func (t Transaction) HoldInfo() string {
+	if !t.HoldId.Valid {
+		return ""
+	}
+
+	history, err := getHoldHistory(t.Hash)
+	if err != nil {
+		log.Warn().Err(err).Str("hash", t.Hash).Msg("failed to load hold history")
+		return ""
+	}
+
+	info := "held on " + history.CreatedAt
+	if history.ResolvedAt != "" {
+		info += ", " + history.Status + " on " + history.ResolvedAt
+	}
+	if history.Note != "" {
+		info += " (" + history.Note + ")"
+	}
+	return escapeHTML(info)
+}
+
 func (t Transaction) IsReceive() bool {
 	return t.Status == "RECEIVED"
 }
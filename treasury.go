@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx"
+)
+
+const TREASURY_PROPOSAL_TIMEOUT = time.Hour * 24 * 7
+
+// errTreasuryBalance is returned by execute when the treasury can't pay, the
+// only case in which a proposal fails. anything else leaves it open.
+var errTreasuryBalance = errors.New("insufficient treasury balance")
+
+// a treasury is an account owned by a group chat, without a telegram user.
+// anyone can pay into it, but it only spends through proposals approved by
+// a number of the group admins.
+
+type TreasuryProposal struct {
+	Id         int        `db:"id"`
+	ChatId     int64      `db:"chat_id"`
+	ProposerId int        `db:"proposer_id"`
+	ReceiverId int        `db:"receiver_id"`
+	Amount     int        `db:"amount"`
+	Memo       string     `db:"memo"`
+	Required   int        `db:"required"`
+	Status     string     `db:"status"`
+	MessageId  int        `db:"message_id"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ResolvedAt *time.Time `db:"resolved_at"`
+}
+
+func getTreasury(chatId int64) (treasury User, err error) {
+	var id int
+	err = pg.Get(&id, `
+SELECT treasury_id FROM telegram.chat
+WHERE telegram_id = $1 AND treasury_id IS NOT NULL
+    `, -chatId)
+	if err != nil {
+		return
+	}
+	return loadUser(id, 0)
+}
+
+// ensureTreasury returns the treasury of a group, creating it the first time.
+func ensureTreasury(chatId int64) (treasury User, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`
+INSERT INTO telegram.chat (telegram_id) VALUES ($1)
+ON CONFLICT (telegram_id) DO NOTHING
+    `, -chatId)
+	if err != nil {
+		return
+	}
+
+	var id sql.NullInt64
+	err = txn.Get(&id, `
+SELECT treasury_id FROM telegram.chat WHERE telegram_id = $1 FOR UPDATE
+    `, -chatId)
+	if err != nil {
+		return
+	}
+
+	if !id.Valid {
+		err = txn.Get(&id, `INSERT INTO telegram.account DEFAULT VALUES RETURNING id`)
+		if err != nil {
+			return
+		}
+		_, err = txn.Exec(`
+UPDATE telegram.chat SET treasury_id = $2 WHERE telegram_id = $1
+        `, -chatId, id)
+		if err != nil {
+			return
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return
+	}
+	return loadUser(int(id.Int64), 0)
+}
+
+func getTreasuryApprovals(chatId int64) (n int) {
+	n = 2
+	pg.Get(&n, `
+SELECT treasury_approvals FROM telegram.chat WHERE telegram_id = $1
+    `, -chatId)
+	return
+}
+
+func setTreasuryApprovals(chatId int64, n int) (err error) {
+	_, err = pg.Exec(`
+INSERT INTO telegram.chat AS c (telegram_id, treasury_approvals) VALUES ($1, $2)
+ON CONFLICT (telegram_id)
+  DO UPDATE SET treasury_approvals = $2
+    `, -chatId, n)
+	return
+}
+
+func (p TreasuryProposal) approvers() (approvers []User) {
+	var ids []int
+	pg.Select(&ids, `
+SELECT account_id FROM telegram.treasury_approval
+WHERE proposal_id = $1
+ORDER BY approved_at
+    `, p.Id)
+
+	for _, id := range ids {
+		if user, err := loadUser(id, 0); err == nil {
+			approvers = append(approvers, user)
+		}
+	}
+	return
+}
+
+func (p TreasuryProposal) render() string {
+	proposer, _ := loadUser(p.ProposerId, 0)
+	receiver, _ := loadUser(p.ReceiverId, 0)
+
+	text := fmt.Sprintf("🏛 <b>Treasury proposal #%d</b> by %s\nSend %d sat to %s",
+		p.Id, proposer.AtName(), p.Amount, receiver.AtName())
+	if p.Memo != "" {
+		text += ": <i>" + escapeHTML(p.Memo) + "</i>"
+	}
+
+	approvers := p.approvers()
+	names := make([]string, len(approvers))
+	for i, approver := range approvers {
+		names[i] = approver.AtName()
+	}
+	text += fmt.Sprintf("\n\nApprovals: %d of %d needed", len(approvers), p.Required)
+	if len(names) > 0 {
+		text += " (" + strings.Join(names, " ") + ")"
+	}
+
+	switch p.Status {
+	case "open":
+		return text + fmt.Sprintf(".\nOpen until %s UTC.",
+			p.CreatedAt.Add(TREASURY_PROPOSAL_TIMEOUT).Format("2 Jan 2006 15:04"))
+	case "executed":
+		return text + ".\n\n✅ Sent."
+	case "rejected":
+		return text + ".\n\n❌ Rejected."
+	case "failed":
+		return text + ".\n\nFailed, the treasury didn't have enough balance."
+	default:
+		return text + ".\n\nExpired."
+	}
+}
+
+func (p TreasuryProposal) keyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Reject", fmt.Sprintf("treasury=reject-%d", p.Id)),
+			tgbotapi.NewInlineKeyboardButtonData("Approve", fmt.Sprintf("treasury=approve-%d", p.Id)),
+		),
+	)
+}
+
+func (p TreasuryProposal) refreshMessage() {
+	if p.MessageId == 0 {
+		return
+	}
+	if p.Status == "open" {
+		editWithKeyboard(p.ChatId, p.MessageId, p.render(), p.keyboard())
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(p.ChatId, p.MessageId, p.render())
+	edit.ParseMode = "HTML"
+	bot.Send(edit)
+}
+
+// proposeTreasurySend opens a proposal with the proposer's approval. the
+// number of approvals needed is the group setting, but never more than the
+// number of admins.
+func (u User) proposeTreasurySend(
+	chatId int64,
+	receiver User,
+	sats int,
+	memo string,
+) (p TreasuryProposal, errMsg string, err error) {
+	treasury, err := getTreasury(chatId)
+	if err != nil {
+		return p, "This group has no treasury.", err
+	}
+	if receiver.Id == treasury.Id {
+		return p, "Can't send from the treasury to itself.", errors.New("treasury to itself")
+	}
+
+	info, err := treasury.getInfo()
+	if err != nil {
+		return p, "Database error.", err
+	}
+	if int(info.Balance) < sats {
+		return p, fmt.Sprintf("The treasury has only %.3f sat.", info.Balance),
+			errors.New("insufficient treasury balance")
+	}
+
+	required := getTreasuryApprovals(chatId)
+	if nadmins := countChatAdmins(chatId); nadmins > 0 && nadmins < required {
+		required = nadmins
+	}
+	if required < 1 {
+		required = 1
+	}
+
+	err = pg.Get(&p, `
+INSERT INTO telegram.treasury_proposal (chat_id, proposer_id, receiver_id, amount, memo, required)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING *
+    `, chatId, u.Id, receiver.Id, sats, memo, required)
+	if err != nil {
+		return p, "Database error.", err
+	}
+
+	chattable := tgbotapi.NewMessage(chatId, p.render())
+	chattable.ParseMode = "HTML"
+	chattable.BaseChat.ReplyMarkup = p.keyboard()
+	message, err := bot.Send(chattable)
+	if err == nil {
+		p.MessageId = message.MessageID
+		pg.Exec(`UPDATE telegram.treasury_proposal SET message_id = $2 WHERE id = $1`,
+			p.Id, p.MessageId)
+	}
+
+	p, errMsg, err = approveTreasuryProposal(chatId, p.Id, u)
+	return
+}
+
+// approveTreasuryProposal adds an approval and, if it is the last one
+// needed, sends the money in the same transaction.
+func approveTreasuryProposal(chatId int64, proposalId int, u User) (p TreasuryProposal, errMsg string, err error) {
+	txn, err := pg.BeginTxx(context.TODO(),
+		&sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return p, "Database error.", err
+	}
+	defer txn.Rollback()
+
+	err = txn.Get(&p, `
+SELECT * FROM telegram.treasury_proposal
+WHERE id = $1 AND chat_id = $3 AND status = 'open'
+  AND created_at > now() - make_interval(secs => $2)
+FOR UPDATE
+    `, proposalId, TREASURY_PROPOSAL_TIMEOUT.Seconds(), chatId)
+	if err != nil {
+		return p, "This proposal is closed.", err
+	}
+
+	res, err := txn.Exec(`
+INSERT INTO telegram.treasury_approval (proposal_id, account_id) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+    `, p.Id, u.Id)
+	if err != nil {
+		return p, "Database error.", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return p, "You've already approved this.", errors.New("already approved")
+	}
+
+	var count int
+	err = txn.Get(&count, `
+SELECT count(*) FROM telegram.treasury_approval WHERE proposal_id = $1
+    `, p.Id)
+	if err != nil {
+		return p, "Database error.", err
+	}
+
+	var event InternalTransfer
+	if count >= p.Required {
+		event, err = p.execute(txn)
+		if err == errTreasuryBalance {
+			// record the failure instead of the approval
+			txn.Rollback()
+			pg.Exec(`
+UPDATE telegram.treasury_proposal SET status = 'failed', resolved_at = now()
+WHERE id = $1 AND status = 'open'
+            `, p.Id)
+			p.Status = "failed"
+			p.refreshMessage()
+			return p, "The treasury doesn't have enough balance.", err
+		} else if err != nil {
+			return p, "Database error.", err
+		}
+		p.Status = "executed"
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return p, "Database error.", err
+	}
+
+	if p.Status == "executed" {
+		publish(event)
+	}
+	p.refreshMessage()
+	return p, "", nil
+}
+
+func (p TreasuryProposal) execute(txn *sqlx.Tx) (event InternalTransfer, err error) {
+	treasury, err := getTreasury(p.ChatId)
+	if err != nil {
+		return
+	}
+	receiver, _ := loadUser(p.ReceiverId, 0)
+
+	desc := fmt.Sprintf("treasury proposal #%d", p.Id)
+	if p.Memo != "" {
+		desc += ": " + p.Memo
+	}
+
+	var hash string
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, trigger_message, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING payment_hash
+    `, treasury.Id, receiver.Id, p.Amount*1000, desc, p.MessageId, nullChat(p.ChatId))
+	if err != nil {
+		return
+	}
+
+	var balance int64
+	err = txn.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, treasury.Id)
+	if err != nil {
+		return
+	}
+	if balance < 0 {
+		err = errTreasuryBalance
+		return
+	}
+
+	var id int
+	err = txn.Get(&id, `
+UPDATE telegram.treasury_proposal SET status = 'executed', resolved_at = now()
+WHERE id = $1
+RETURNING id
+    `, p.Id)
+	if err != nil {
+		return
+	}
+
+	return InternalTransfer{
+		From:        treasury,
+		To:          receiver,
+		Msats:       p.Amount * 1000,
+		Hash:        hash,
+		Description: desc,
+		ReceiverNotice: fmt.Sprintf("🏛 You've got %d sat from a group treasury (proposal #%d).",
+			p.Amount, p.Id),
+	}, nil
+}
+
+func rejectTreasuryProposal(chatId int64, proposalId int) (p TreasuryProposal, err error) {
+	err = pg.Get(&p, `
+UPDATE telegram.treasury_proposal SET status = 'rejected', resolved_at = now()
+WHERE id = $1 AND chat_id = $2 AND status = 'open'
+RETURNING *
+    `, proposalId, chatId)
+	if err != nil {
+		return
+	}
+	p.refreshMessage()
+	return
+}
+
+func expireTreasuryProposals() {
+	var proposals []TreasuryProposal
+	err := pg.Select(&proposals, `
+UPDATE telegram.treasury_proposal SET status = 'expired', resolved_at = now()
+WHERE status = 'open' AND created_at < now() - make_interval(secs => $1)
+RETURNING *
+    `, TREASURY_PROPOSAL_TIMEOUT.Seconds())
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to expire treasury proposals")
+		return
+	}
+
+	for _, p := range proposals {
+		p.refreshMessage()
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -168,7 +167,8 @@ SELECT
   amount::float/1000 AS amount,
   payment_hash,
   coalesce(preimage, '') AS preimage,
-  payee_node
+  payee_node,
+  hold_id
 FROM lightning.account_txn
 WHERE account_id = $1
   AND substring(payment_hash from 0 for $3) = $2
@@ -291,16 +291,15 @@ func (u User) makeInvoice(
 	bolt11 = res.Get("bolt11").String()
 	hash = res.Get("payment_hash").String()
 
-	if bluewallet {
-		encodedinv, _ := json.Marshal(map[string]interface{}{
-			"hash":   hash,
-			"bolt11": bolt11,
-			"desc":   desc,
-			"amount": sats,
-			"expiry": int(exp),
-		})
-		rds.Set("justcreatedbluewalletinvoice:"+strconv.Itoa(u.Id), string(encodedinv), time.Minute*10)
-	} else {
+	// save invoice so it can be listed later
+	err = saveInvoice(u.Id, hash, label, bolt11, desc, msatoshi, exp*time.Second)
+	if err != nil {
+		log.Warn().Err(err).Str("invoice", bolt11).
+			Msg("failed to save invoice.")
+		err = nil
+	}
+
+	if !bluewallet {
 		err = qrcode.WriteFile(strings.ToUpper(bolt11), qrcode.Medium, 256, qrImagePath(label))
 		if err != nil {
 			log.Warn().Err(err).Str("invoice", bolt11).
@@ -343,37 +342,33 @@ func (u User) payInvoice(messageId int, bolt11 string, msatoshi int) (err error)
 
 		// handle ticket invoices
 		if strings.HasPrefix(desc, "ticket for") {
-			for label, kickdata := range pendingApproval {
-				if kickdata.Hash == hash {
-					var target User
-					target, err = chatOwnerFromTicketLabel(label)
-					if err != nil {
-						return
-					}
-
-					err = u.addInternalPendingInvoice(
-						0,
-						target.Id,
-						amount,
-						hash,
-						desc,
-						label,
-					)
-					if err != nil {
-						return
-					}
-
-					ticketPaid(label, kickdata)
-					handleInvoicePaid(
-						-1,
-						amount,
-						desc,
-						hash,
-						label,
-					)
-					paymentHasSucceeded(u, messageId, float64(amount), float64(amount), "", hash)
-					break
+			if label, ok := pendingTicketLabel(hash); ok {
+				var target User
+				target, err = ticketReceiverFromLabel(label)
+				if err != nil {
+					return
+				}
+
+				err = u.addInternalPendingInvoice(
+					0,
+					target.Id,
+					amount,
+					hash,
+					desc,
+					label,
+				)
+				if err != nil {
+					return
 				}
+
+				handleInvoicePaid(
+					-1,
+					amount,
+					desc,
+					hash,
+					label,
+				)
+				paymentHasSucceeded(u, messageId, float64(amount), float64(amount), "", hash)
 			}
 		}
 
@@ -591,8 +586,10 @@ SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
 	return nil
 }
 
+// chatId is where the send happened, only recorded for groups.
 func (u User) sendInternally(
 	messageId int,
+	chatId int64,
 	target User,
 	anonymous bool,
 	msats int,
@@ -623,11 +620,13 @@ func (u User) sendInternally(
 	defer txn.Rollback()
 
 	var balance int64
-	_, err = txn.Exec(`
+	var hash string
+	err = txn.Get(&hash, `
 INSERT INTO lightning.transaction
-  (from_id, to_id, anonymous, amount, description, label, trigger_message)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
-    `, u.Id, target.Id, anonymous, msats, vdesc, vlabel, messageId)
+  (from_id, to_id, anonymous, amount, description, label, trigger_message, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING payment_hash
+    `, u.Id, target.Id, anonymous, msats, vdesc, vlabel, messageId, nullChat(chatId))
 	if err != nil {
 		return "Database error.", err
 	}
@@ -650,6 +649,15 @@ SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
 		return "Unable to pay due to internal database error.", err
 	}
 
+	publish(InternalTransfer{
+		From:        u,
+		To:          target,
+		Msats:       msats,
+		Hash:        hash,
+		Description: vdesc.String,
+		Anonymous:   anonymous,
+	})
+
 	return "", nil
 }
 
@@ -678,16 +686,16 @@ SELECT
   b.account_id,
   b.balance/1000 AS balance,
   (
-    SELECT coalesce(sum(amount), 0)::float/1000 FROM lightning.transaction AS t
-    WHERE b.account_id = t.to_id
+    SELECT coalesce(sum(amount), 0)::float/1000 FROM lightning.account_txn AS t
+    WHERE b.account_id = t.account_id AND t.status = 'RECEIVED'
   ) AS totalrecv,
   (
-    SELECT coalesce(sum(amount), 0)::float/1000 FROM lightning.transaction AS t
-    WHERE b.account_id = t.from_id
+    SELECT coalesce(-sum(amount), 0)::float/1000 FROM lightning.account_txn AS t
+    WHERE b.account_id = t.account_id AND t.amount < 0 AND t.status != 'REFUNDED'
   ) AS totalsent,
   ( 
-    SELECT coalesce(sum(fees), 0)::float/1000 FROM lightning.transaction AS t
-    WHERE b.account_id = t.from_id
+    SELECT coalesce(sum(fees), 0)::float/1000 FROM lightning.account_txn AS t
+    WHERE b.account_id = t.account_id
   ) AS fees
 FROM lightning.balance AS b
 WHERE b.account_id = $1
@@ -704,18 +712,27 @@ const (
 	Both
 )
 
-func (u User) listTransactions(limit, offset, descCharLimit int, inOrOut InOut) (txns []Transaction, err error) {
-	filterBy := func(inOrOut InOut) string {
-		switch inOrOut {
-		case In:
-			return " AND amount > 0 "
-		case Out:
-			return " AND amount < 0 "
-		case Both:
-			return ""
-		}
+func (inOrOut InOut) filter() string {
+	switch inOrOut {
+	case In:
+		return " AND amount > 0 "
+	case Out:
+		return " AND amount < 0 "
+	case Both:
 		return ""
 	}
+	return ""
+}
+
+func (u User) listTransactions(
+	limit, offset, descCharLimit int,
+	search string,
+	inOrOut InOut,
+) (txns []Transaction, err error) {
+	// search is a case-insensitive substring match on descriptions and peer
+	// names. the peer of an anonymous receipt is never matched, otherwise
+	// searching for a name would tell who sent it.
+	search = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search)
 
 	err = pg.Select(&txns, `
 SELECT * FROM (
@@ -729,15 +746,19 @@ SELECT * FROM (
       ELSE substring(coalesce(description, '') from 0 for ($4 - 1)) || '…'
     END AS description,
     amount::float/1000 AS amount,
+    fees::float/1000 AS fees,
     payment_hash,
+    label,
     preimage
   FROM lightning.account_txn
-  WHERE account_id = $1 `+filterBy(inOrOut)+`
+  WHERE account_id = $1 `+inOrOut.filter()+`
+    AND ($5 = '' OR description ILIKE '%' || $5 || '%'
+      OR (telegram_peer ILIKE '%' || $5 || '%' AND NOT (anonymous AND amount > 0)))
   ORDER BY time DESC
   LIMIT $2
   OFFSET $3
 ) AS latest ORDER BY time ASC
-    `, u.Id, limit, offset, descCharLimit)
+    `, u.Id, limit, offset, descCharLimit, search)
 	if err != nil {
 		return
 	}
@@ -749,6 +770,72 @@ SELECT * FROM (
 	return
 }
 
+// listTransactionsBefore pages through transactions from the newest to the oldest,
+// starting right after the transaction identified by (before, beforeHash).
+func (u User) listTransactionsBefore(
+	before time.Time,
+	beforeHash string,
+	limit, descCharLimit int,
+	inOrOut InOut,
+) (txns []Transaction, err error) {
+	if before.IsZero() {
+		before = time.Now().AddDate(100, 0, 0)
+	}
+
+	err = pg.Select(&txns, `
+SELECT
+  time,
+  telegram_peer,
+  anonymous,
+  status,
+  CASE WHEN char_length(coalesce(description, '')) <= $5
+    THEN coalesce(description, '')
+    ELSE substring(coalesce(description, '') from 0 for ($5 - 1)) || '…'
+  END AS description,
+  amount::float/1000 AS amount,
+  fees::float/1000 AS fees,
+  payment_hash,
+  label,
+  preimage
+FROM lightning.account_txn
+WHERE account_id = $1 `+inOrOut.filter()+`
+  AND (time, payment_hash) < ($2, $3)
+ORDER BY time DESC, payment_hash DESC
+LIMIT $4
+    `, u.Id, before, beforeHash, limit, descCharLimit)
+	return
+}
+
+func (u User) listInvoices(limit, offset int) (invoices []Invoice, err error) {
+	err = pg.Select(&invoices, `
+SELECT * FROM (
+  SELECT `+INVOICEFIELDS+`
+  FROM lightning.invoice
+  WHERE account_id = $1
+  ORDER BY created_at DESC
+  LIMIT $2
+  OFFSET $3
+) AS latest ORDER BY created_at ASC
+    `, u.Id, limit, offset)
+	return
+}
+
+func (u User) listInvoicesBefore(before time.Time, beforeHash string, limit int) (invoices []Invoice, err error) {
+	if before.IsZero() {
+		before = time.Now().AddDate(100, 0, 0)
+	}
+
+	err = pg.Select(&invoices, `
+SELECT `+INVOICEFIELDS+`
+FROM lightning.invoice
+WHERE account_id = $1
+  AND (created_at, payment_hash) < ($2, $3)
+ORDER BY created_at DESC, payment_hash DESC
+LIMIT $4
+    `, u.Id, before, beforeHash, limit)
+	return
+}
+
 func (u User) checkBalanceFor(sats int, purpose string) bool {
 	if sats < 40 {
 		u.notify("That's too small, please start your " + purpose + " with at least 40 sat.")
@@ -763,71 +850,6 @@ func (u User) checkBalanceFor(sats int, purpose string) bool {
 	return true
 }
 
-func fromManyToOne(sats int, toId int, fromIds []int,
-	desc, receiverMessage, giverMessage string,
-) (receiver User, err error) {
-	txn, err := pg.BeginTxx(context.TODO(),
-		&sql.TxOptions{Isolation: sql.LevelSerializable})
-	if err != nil {
-		return
-	}
-	defer txn.Rollback()
-
-	receiver, _ = loadUser(toId, 0)
-	giverNames := make([]string, 0, len(fromIds))
-
-	msats := sats * 1000
-	var (
-		vdesc  = &sql.NullString{}
-		vlabel = &sql.NullString{}
-	)
-	vdesc.Scan(desc)
-
-	for _, fromId := range fromIds {
-		if fromId == toId {
-			continue
-		}
-
-		_, err = txn.Exec(`
-INSERT INTO lightning.transaction
-  (from_id, to_id, amount, description, label)
-VALUES ($1, $2, $3, $4, $5)
-    `, fromId, toId, msats, vdesc, vlabel)
-		if err != nil {
-			return
-		}
-
-		var balance int
-		err = txn.Get(&balance, `
-SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
-    `, fromId)
-		if err != nil {
-			return
-		}
-
-		if balance < 0 {
-			err = errors.New("insufficient balance")
-			return
-		}
-
-		giver, _ := loadUser(fromId, 0)
-		giverNames = append(giverNames, giver.AtName())
-
-		giver.notify(fmt.Sprintf(giverMessage, sats, receiver.AtName()))
-	}
-
-	err = txn.Commit()
-	if err != nil {
-		return
-	}
-
-	receiver.notify(
-		fmt.Sprintf(receiverMessage,
-			sats*len(fromIds), strings.Join(giverNames, " ")),
-	)
-	return
-}
-
 func (u User) setAppData(appname string, data interface{}) (err error) {
 	j, err := json.Marshal(data)
 	if err != nil {
@@ -883,25 +905,29 @@ WHERE payment_hash = $3
 		u.notifyAsReply("Database error: failed to mark the transaction as not pending.", messageId)
 	}
 
-	u.notifyAsReply(fmt.Sprintf(
-		"Paid with <b>%d sat</b> (+ %.3f fee). \n\n<b>Hash:</b> %s\n\n<b>Proof:</b> %s\n\n/tx%s",
-		int(msatoshi/1000),
-		fees/1000,
-		hash,
-		preimage,
-		hash[:5],
-	), messageId)
+	publish(PaymentSent{
+		Payer:     u,
+		MessageId: messageId,
+		Msats:     msatoshi,
+		Fees:      fees,
+		Hash:      hash,
+		Preimage:  preimage,
+	})
 }
 
 func paymentHasFailed(u User, messageId int, hash string) {
-	u.notifyAsReply(fmt.Sprintf("Payment failed. /log%s", hash[:5]), messageId)
-
 	_, err := pg.Exec(
 		`DELETE FROM lightning.transaction WHERE payment_hash = $1`, hash)
 	if err != nil {
 		log.Error().Err(err).Str("hash", hash).
 			Msg("failed to cancel transaction after routing failure.")
 	}
+
+	publish(PaymentFailed{
+		Payer:     u,
+		MessageId: messageId,
+		Hash:      hash,
+	})
 }
 
 type Info struct {
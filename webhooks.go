@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lucsky/cuid"
+)
+
+const MAX_WEBHOOKS = 5
+
+// time to wait before each delivery attempt, failed attempts are stored
+// with the time of the next one and picked up by retryWebhookDeliveries.
+var webhookRetrySchedule = []time.Duration{
+	0,
+	time.Second * 10,
+	time.Minute,
+	time.Minute * 10,
+	time.Hour,
+	time.Hour * 6,
+}
+
+var webhookClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 10,
+			Control: dialPublicOnly,
+		}).DialContext,
+	},
+}
+
+// webhooks can't reach our own network. this is checked when connecting,
+// after the name was resolved, so a DNS answer changing later doesn't help.
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("invalid address " + host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return errors.New("address " + host + " is not public")
+		}
+	}
+	return nil
+}
+
+type Webhook struct {
+	Id        int       `db:"id"`
+	AccountId int       `db:"account_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type WebhookDelivery struct {
+	Id         int            `db:"id"`
+	WebhookId  int            `db:"webhook_id"`
+	EventId    string         `db:"event_id"`
+	Event      string         `db:"event"`
+	Attempt    int            `db:"attempt"`
+	Time       time.Time      `db:"time"`
+	StatusCode sql.NullInt64  `db:"status_code"`
+	Error      sql.NullString `db:"error"`
+	Body       string         `db:"body"`
+	RetryAt    *time.Time     `db:"retry_at"`
+}
+
+// AccountEvent is what gets POSTed to webhooks.
+type AccountEvent struct {
+	Id   string      `json:"id"`
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+func newAccountEvent(kind string, data interface{}) AccountEvent {
+	return AccountEvent{
+		Id:   cuid.New(),
+		Type: kind,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+}
+
+func (w WebhookDelivery) Succeeded() bool {
+	return w.StatusCode.Valid && w.StatusCode.Int64 >= 200 && w.StatusCode.Int64 < 300
+}
+
+func (u User) addWebhook(rawurl string) (hook Webhook, err error) {
+	parsed, err := url.Parse(rawurl)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		err = errors.New("Invalid URL.")
+		return
+	}
+
+	var count int
+	err = pg.Get(&count, `SELECT count(*) FROM telegram.webhook WHERE account_id = $1`, u.Id)
+	if err != nil {
+		return
+	}
+	if count >= MAX_WEBHOOKS {
+		err = fmt.Errorf("You can't have more than %d webhooks.", MAX_WEBHOOKS)
+		return
+	}
+
+	err = pg.Get(&hook, `
+INSERT INTO telegram.webhook (account_id, url)
+VALUES ($1, $2)
+ON CONFLICT (account_id, url) DO UPDATE SET url = $2
+RETURNING *
+    `, u.Id, parsed.String())
+	return
+}
+
+func (u User) removeWebhook(id int) (err error) {
+	res, err := pg.Exec(`
+DELETE FROM telegram.webhook WHERE id = $1 AND account_id = $2
+    `, id, u.Id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Webhook not found.")
+	}
+	return
+}
+
+func (u User) listWebhooks() (hooks []Webhook, err error) {
+	err = pg.Select(&hooks, `
+SELECT * FROM telegram.webhook WHERE account_id = $1 ORDER BY id
+    `, u.Id)
+	return
+}
+
+func (u User) listWebhookDeliveries(webhookId, limit int) (deliveries []WebhookDelivery, err error) {
+	err = pg.Select(&deliveries, `
+SELECT d.*
+FROM telegram.webhook_delivery AS d
+INNER JOIN telegram.webhook AS w ON w.id = d.webhook_id
+WHERE w.id = $1 AND w.account_id = $2
+ORDER BY d.time DESC
+LIMIT $3
+    `, webhookId, u.Id, limit)
+	return
+}
+
+// dispatchWebhooks sends the event to all webhooks registered by the given account,
+// failed deliveries are retried according to webhookRetrySchedule.
+func dispatchWebhooks(accountId int, event AccountEvent) {
+	var hooks []Webhook
+	err := pg.Select(&hooks, `
+SELECT * FROM telegram.webhook WHERE account_id = $1
+    `, accountId)
+	if err != nil {
+		log.Warn().Err(err).Int("account", accountId).Msg("failed to load webhooks")
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Warn().Err(err).Str("event", event.Type).Msg("failed to encode webhook event")
+		return
+	}
+
+	for _, hook := range hooks {
+		go deliverWebhook(hook, event.Id, event.Type, string(body), 1)
+	}
+}
+
+// retryWebhookDeliveries runs periodically and makes the next attempt of every
+// failed delivery that is due. they are claimed by clearing retry_at, so each
+// is retried only once.
+func retryWebhookDeliveries() {
+	var due []WebhookDelivery
+	err := pg.Select(&due, `
+UPDATE telegram.webhook_delivery SET retry_at = NULL
+WHERE retry_at < now()
+RETURNING *
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch webhook deliveries to retry")
+		return
+	}
+
+	for _, d := range due {
+		var hook Webhook
+		err := pg.Get(&hook, `SELECT * FROM telegram.webhook WHERE id = $1`, d.WebhookId)
+		if err != nil {
+			// webhook was removed meanwhile
+			continue
+		}
+		go deliverWebhook(hook, d.EventId, d.Event, d.Body, d.Attempt+1)
+	}
+}
+
+func deliverWebhook(hook Webhook, eventId string, eventType string, body string, attempt int) {
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var (
+		statusCode sql.NullInt64
+		errMsg     sql.NullString
+		retryAt    *time.Time
+	)
+
+	req, _ := http.NewRequest("POST", hook.URL, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event", eventType)
+	req.Header.Set("X-Delivery", eventId)
+	req.Header.Set("X-Signature", signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		errMsg.Scan(err.Error())
+	} else {
+		resp.Body.Close()
+		statusCode.Scan(int64(resp.StatusCode))
+		if resp.StatusCode >= 300 {
+			errMsg.Scan("unexpected status " + strconv.Itoa(resp.StatusCode))
+		}
+	}
+
+	if errMsg.Valid {
+		log.Debug().Int("webhook", hook.Id).Str("event", eventId).Int("attempt", attempt).
+			Str("err", errMsg.String).Msg("webhook delivery failed")
+
+		if attempt < len(webhookRetrySchedule) {
+			next := time.Now().Add(webhookRetrySchedule[attempt])
+			retryAt = &next
+		}
+	}
+
+	// the body is only needed for retries
+	if retryAt == nil {
+		body = ""
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO telegram.webhook_delivery
+  (webhook_id, event_id, event, attempt, status_code, error, body, retry_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `, hook.Id, eventId, eventType, attempt, statusCode, errMsg, body, retryAt)
+	if err != nil {
+		log.Warn().Err(err).Int("webhook", hook.Id).Msg("failed to log webhook delivery")
+	}
+}